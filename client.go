@@ -0,0 +1,594 @@
+package hexabus
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Client talks to Hexabus devices over a single shared udp6 socket.
+// A Client is safe for concurrent use by multiple goroutines, every response
+// is matched to the outstanding request by source address, EID and packet
+// type. Error Packets carry no EID, so requests to the same device that may
+// be answered with one, Query, EpQuery, GetProperty and the writes, wait for
+// each other. The zero value is ready to use, the socket is opened on first use.
+// The configuration fields must not be changed after the first request.
+type Client struct {
+	// time to wait for a response, NET_TIMEOUT seconds if zero
+	Timeout time.Duration
+
+	// local address to bind to, any address if empty
+	LocalAddr string
+
+	// outgoing interface for link local and multicast destinations
+	Interface string
+
+	// how QueryEids finds out if an endpoint is writable, PROBE_WRITE if zero
+	Probe int
+
+	// writability of known EID's for PROBE_PROPERTY, DefaultCatalog if nil
+	Catalog map[uint32]EID
+
+	// send Write Packets with SendReliable instead of waiting for an Error
+	// Packet until the timeout
+	Reliable bool
+
+	// retransmissions of reliable packets, RELIABLE_RETRIES if zero,
+	// negative for none
+	Retries int
+
+	// wait before the first retransmission of a reliable packet, doubled
+	// after every retry, RELIABLE_INTERVAL if zero
+	RetryInterval time.Duration
+
+	once    sync.Once
+	conn    *net.UDPConn
+	err     error
+	mu      sync.Mutex
+	pending []*request
+	seqs    map[string]uint16
+	seen    seqWindow
+	dtypes  map[string]byte
+	devices map[string]*deviceLock // see lockDevice
+}
+
+// turn of the requests to a device that may be answered with an Error Packet
+type deviceLock struct {
+	turn  chan struct{}
+	users int // requests holding or waiting for the turn
+}
+
+// outstanding request waiting for a response
+type request struct {
+	addr   *net.UDPAddr
+	eid    uint32
+	prop   uint32
+	cause  uint16
+	ptypes []byte
+	resp   chan response
+}
+
+// received response, the raw packet and its decoded form
+type response struct {
+	packet []byte
+	p      Packet
+}
+
+// DefaultClient is used by the Send methods of the packet types and by
+// QueryEids.
+var DefaultClient = &Client{}
+
+// Close closes the socket of the client, outstanding requests fail.
+func (c *Client) Close() error {
+	c.once.Do(func() { c.err = net.ErrClosed })
+	if c.conn == nil {
+		return nil
+	}
+	return c.conn.Close()
+}
+
+// open the socket and start the receiver
+func (c *Client) open() error {
+	c.once.Do(func() {
+		var laddr *net.UDPAddr
+		if c.LocalAddr != "" {
+			laddr, c.err = resolveAddress(context.Background(), c.LocalAddr, c.Interface, "0")
+			if c.err != nil {
+				return
+			}
+		}
+		if c.Interface != "" {
+			_, c.err = net.InterfaceByName(c.Interface)
+			if c.err != nil {
+				return
+			}
+		}
+		c.conn, c.err = net.ListenUDP("udp6", laddr)
+		if c.err != nil {
+			return
+		}
+		go c.receive()
+	})
+	return c.err
+}
+
+// timeout of a single request
+func (c *Client) timeout() time.Duration {
+	if c.Timeout > 0 {
+		return c.Timeout
+	}
+	return time.Duration(NET_TIMEOUT) * time.Second
+}
+
+// read responses from the socket and hand them to the waiting requests,
+// datagrams that are no valid hexabus packets are dropped. Reliable packets
+// are acknowledged and their retransmissions dropped.
+func (c *Client) receive() {
+	buf := make([]byte, 1500)
+	for {
+		n, raddr, err := c.conn.ReadFromUDP(buf)
+		if err != nil {
+			if opErr, ok := err.(net.Error); ok && opErr.Timeout() {
+				continue
+			}
+			return
+		}
+		packet := append([]byte(nil), buf[:n]...)
+		p, err := Decode(packet)
+		if err != nil {
+			continue
+		}
+		if seq, ok := Sequence(packet); ok {
+			sendAck(c.conn, raddr, seq)
+			if c.seen.duplicate(raddr, seq) {
+				continue
+			}
+		}
+		c.dispatch(raddr, response{packet, p})
+	}
+}
+
+// hand a response to the oldest request it matches
+func (c *Client) dispatch(raddr *net.UDPAddr, resp response) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, req := range c.pending {
+		if req.matches(raddr, resp.p) {
+			c.pending = append(c.pending[:i], c.pending[i+1:]...)
+			req.resp <- resp
+			return
+		}
+	}
+}
+
+// check if a received packet answers the request, error packets don't
+// carry an EID and answer the oldest request to that address
+func (r *request) matches(raddr *net.UDPAddr, p Packet) bool {
+	if !r.addr.IP.Equal(raddr.IP) || r.addr.Port != raddr.Port {
+		return false
+	}
+	accepted := false
+	for _, ptype := range r.ptypes {
+		if ptype == p.PacketType() {
+			accepted = true
+		}
+	}
+	if !accepted {
+		return false
+	}
+	switch p := p.(type) {
+	case *InfoPacket:
+		return p.Eid == r.eid
+	case *EpInfoPacket:
+		return p.Eid == r.eid
+	case *ReportPacket:
+		return p.Eid == r.eid
+	case *EpReportPacket:
+		return p.Eid == r.eid
+	case *EpPropReportPacket:
+		return p.Eid == r.eid && p.PropId == r.prop
+	case *AckPacket:
+		return p.Cause == r.cause
+	}
+	return true
+}
+
+// remove a request that is no longer waiting
+func (c *Client) cancel(req *request) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, r := range c.pending {
+		if r == req {
+			c.pending = append(c.pending[:i], c.pending[i+1:]...)
+			return
+		}
+	}
+}
+
+// send a packet and wait for a response of one of the given packet types
+// for eid, failures are returned as *OpError and a canceled ctx as ctx.Err()
+func (c *Client) exchange(ctx context.Context, address string, p Packet, eid uint32, ptypes ...byte) (response, error) {
+	packet, addr, err := c.prepare(ctx, address, p)
+	if err != nil {
+		return response{}, requestError(ctx, address, p, eid, err)
+	}
+	for _, ptype := range ptypes {
+		if ptype == PTYPE_ERROR {
+			unlock, err := c.lockDevice(ctx, addr)
+			if err != nil {
+				return response{}, requestError(ctx, address, p, eid, err)
+			}
+			defer unlock()
+			break
+		}
+	}
+	req := &request{addr: addr, eid: eid, ptypes: ptypes, resp: make(chan response, 1)}
+	if q, ok := p.(EpPropQueryPacket); ok {
+		req.prop = q.PropId
+	}
+	resp, err := c.roundtrip(ctx, req, packet, c.timeout())
+	if err != nil {
+		return response{}, requestError(ctx, address, p, eid, err)
+	}
+	return resp, nil
+}
+
+// wait for the turn of a request to addr until ctx is done, the returned
+// function ends the turn. Locks are removed once no request uses them.
+func (c *Client) lockDevice(ctx context.Context, addr *net.UDPAddr) (func(), error) {
+	key := addr.String()
+	c.mu.Lock()
+	if c.devices == nil {
+		c.devices = make(map[string]*deviceLock)
+	}
+	l, ok := c.devices[key]
+	if !ok {
+		l = &deviceLock{turn: make(chan struct{}, 1)}
+		c.devices[key] = l
+	}
+	l.users++
+	c.mu.Unlock()
+
+	release := func() {
+		c.mu.Lock()
+		l.users--
+		if l.users == 0 {
+			delete(c.devices, key)
+		}
+		c.mu.Unlock()
+	}
+	select {
+	case l.turn <- struct{}{}:
+		return func() {
+			<-l.turn
+			release()
+		}, nil
+	case <-ctx.Done():
+		release()
+		return nil, ctx.Err()
+	}
+}
+
+// wrap the failure of a request in an *OpError, ctx errors are returned as
+// they are
+func requestError(ctx context.Context, address string, p Packet, eid uint32, err error) error {
+	if ctx.Err() != nil && err == ctx.Err() {
+		return err
+	}
+	return &OpError{address, eid, p.PacketType(), err}
+}
+
+// the Error Packet a request was answered with as *RemoteError
+func remoteError(address string, p Packet, eid uint32, e *ErrorPacket) error {
+	return &RemoteError{address, eid, p.PacketType(), Error(e.Error)}
+}
+
+// EID a packet is addressed to, 0 for packets without EID. Packets are
+// accepted by value and as pointer like Decode returns them.
+func packetEid(p Packet) uint32 {
+	if p, ok := p.(eidPacket); ok {
+		return p.eid()
+	}
+	return 0
+}
+
+// open the socket, encode the packet and resolve the address
+func (c *Client) prepare(ctx context.Context, address string, p Packet) ([]byte, *net.UDPAddr, error) {
+	if ctx.Err() != nil {
+		return nil, nil, ctx.Err()
+	}
+	err := c.open()
+	if err != nil {
+		return nil, nil, err
+	}
+	packet, err := p.Bytes()
+	if err != nil {
+		return nil, nil, err
+	}
+	addr, err := resolveAddress(ctx, address, c.Interface, PORT)
+	if err != nil {
+		return nil, nil, err
+	}
+	return packet, addr, nil
+}
+
+// send a packet and wait for the response to req, the packet is sent again
+// after every wait but the last
+func (c *Client) roundtrip(ctx context.Context, req *request, packet []byte, waits ...time.Duration) (response, error) {
+	c.mu.Lock()
+	c.pending = append(c.pending, req)
+	c.mu.Unlock()
+
+	for _, wait := range waits {
+		_, err := c.conn.WriteToUDP(packet, req.addr)
+		if err != nil {
+			c.cancel(req)
+			return response{}, err
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case resp := <-req.resp:
+			timer.Stop()
+			return resp, nil
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			c.cancel(req)
+			return response{}, ctx.Err()
+		}
+	}
+	c.cancel(req)
+	return response{}, &net.OpError{Op: "read", Net: "udp6", Source: c.conn.LocalAddr(), Addr: req.addr, Err: os.ErrDeadlineExceeded}
+}
+
+// Send sends a packet to address without waiting for a response, failures
+// are returned as *OpError.
+func (c *Client) Send(address string, p Packet) error {
+	packet, addr, err := c.prepare(context.Background(), address, p)
+	if err == nil {
+		_, err = c.conn.WriteToUDP(packet, addr)
+	}
+	if err != nil {
+		return &OpError{address, packetEid(p), p.PacketType(), err}
+	}
+	return nil
+}
+
+// Query sends a Query Packet for eid to address and returns the Info Packet
+// the device answered with, a Report Packet is returned as Info Packet. An
+// Error Packet is returned as *RemoteError, other failures as *OpError.
+func (c *Client) Query(address string, eid uint32) (*InfoPacket, error) {
+	return c.QueryContext(context.Background(), address, eid)
+}
+
+// QueryContext is like Query but aborts when ctx is done.
+func (c *Client) QueryContext(ctx context.Context, address string, eid uint32) (*InfoPacket, error) {
+	q := QueryPacket{FLAG_NONE, eid}
+	resp, err := c.exchange(ctx, address, q, eid, PTYPE_INFO, PTYPE_REPORT, PTYPE_ERROR)
+	if err != nil {
+		return nil, err
+	}
+	switch p := resp.p.(type) {
+	case *ErrorPacket:
+		return nil, remoteError(address, q, eid, p)
+	case *InfoPacket:
+		return p, nil
+	case *ReportPacket:
+		return &InfoPacket{p.Flags, p.Eid, p.Dtype, p.Data}, nil
+	}
+	return nil, Error(ERR_UNKNOWNPTYPE)
+}
+
+// EpQuery sends an Endpoint Query Packet for eid to address and returns the
+// Endpoint Info Packet the device answered with, an Endpoint Report Packet is
+// returned as Endpoint Info Packet.
+func (c *Client) EpQuery(address string, eid uint32) (*EpInfoPacket, error) {
+	return c.EpQueryContext(context.Background(), address, eid)
+}
+
+// EpQueryContext is like EpQuery but aborts when ctx is done.
+func (c *Client) EpQueryContext(ctx context.Context, address string, eid uint32) (*EpInfoPacket, error) {
+	q := EpQueryPacket{FLAG_NONE, eid}
+	resp, err := c.exchange(ctx, address, q, eid, PTYPE_EPINFO, PTYPE_EPREPORT, PTYPE_ERROR)
+	if err != nil {
+		return nil, err
+	}
+	switch p := resp.p.(type) {
+	case *ErrorPacket:
+		return nil, remoteError(address, q, eid, p)
+	case *EpInfoPacket:
+		c.cacheDtype(ctx, address, eid, p.Dtype)
+		return p, nil
+	case *EpReportPacket:
+		c.cacheDtype(ctx, address, eid, p.Dtype)
+		return &EpInfoPacket{p.Flags, p.Eid, p.Dtype, p.Data}, nil
+	}
+	return nil, Error(ERR_UNKNOWNPTYPE)
+}
+
+// EndpointDtype returns the data type of eid on address. It is taken from
+// the last Endpoint Query of eid, if there was none an Endpoint Query is
+// sent.
+func (c *Client) EndpointDtype(address string, eid uint32) (byte, error) {
+	return c.EndpointDtypeContext(context.Background(), address, eid)
+}
+
+// EndpointDtypeContext is like EndpointDtype but aborts when ctx is done.
+func (c *Client) EndpointDtypeContext(ctx context.Context, address string, eid uint32) (byte, error) {
+	key := c.dtypeKey(ctx, address, eid)
+	c.mu.Lock()
+	dtype, ok := c.dtypes[key]
+	c.mu.Unlock()
+	if ok {
+		return dtype, nil
+	}
+	p, err := c.EpQueryContext(ctx, address, eid)
+	if err != nil {
+		return DTYPE_UNDEFINED, err
+	}
+	return p.Dtype, nil
+}
+
+// remember the data type of an endpoint
+func (c *Client) cacheDtype(ctx context.Context, address string, eid uint32, dtype byte) {
+	key := c.dtypeKey(ctx, address, eid)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.dtypes == nil {
+		c.dtypes = make(map[string]byte)
+	}
+	c.dtypes[key] = dtype
+}
+
+// forget the data type of an endpoint
+func (c *Client) forgetDtype(ctx context.Context, address string, eid uint32) {
+	key := c.dtypeKey(ctx, address, eid)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.dtypes, key)
+}
+
+// key of an endpoint in the data type cache, different notations of the
+// same address share the key. Resolving may take long, so it mustn't be
+// called with c.mu held.
+func (c *Client) dtypeKey(ctx context.Context, address string, eid uint32) string {
+	if addr, err := resolveAddress(ctx, address, c.Interface, PORT); err == nil {
+		address = addr.String()
+	}
+	return address + "/" + strconv.FormatUint(uint64(eid), 10)
+}
+
+// GetProperty sends an Endpoint Property Query Packet for the property prop
+// of eid to address and returns the Endpoint Property Report Packet the
+// device answered with.
+func (c *Client) GetProperty(address string, eid uint32, prop uint32) (*EpPropReportPacket, error) {
+	return c.GetPropertyContext(context.Background(), address, eid, prop)
+}
+
+// GetPropertyContext is like GetProperty but aborts when ctx is done.
+func (c *Client) GetPropertyContext(ctx context.Context, address string, eid uint32, prop uint32) (*EpPropReportPacket, error) {
+	q := EpPropQueryPacket{FLAG_NONE, eid, prop}
+	resp, err := c.exchange(ctx, address, q, eid, PTYPE_EPPROPREPORT, PTYPE_ERROR)
+	if err != nil {
+		return nil, err
+	}
+	switch p := resp.p.(type) {
+	case *ErrorPacket:
+		return nil, remoteError(address, q, eid, p)
+	case *EpPropReportPacket:
+		return p, nil
+	}
+	return nil, Error(ERR_UNKNOWNPTYPE)
+}
+
+// Write sends a Write Packet with data for eid to address, pass a Value to
+// write a data type other than the one of the Go type of data. Devices only
+// answer failed writes, so Write waits for the timeout and returns nil if no
+// Error Packet arrived. An Error Packet is returned as *RemoteError. If the
+// client is Reliable the write is acknowledged instead, see SendReliable.
+func (c *Client) Write(address string, eid uint32, data interface{}) error {
+	return c.WriteContext(context.Background(), address, eid, data)
+}
+
+// WriteContext is like Write but aborts when ctx is done.
+func (c *Client) WriteContext(ctx context.Context, address string, eid uint32, data interface{}) error {
+	return c.write(ctx, address, WritePacket{FLAG_NONE, eid, DTYPE_UNDEFINED, data}, eid)
+}
+
+// Set writes data to eid converted to the data type of the endpoint, see
+// EndpointDtype. Numbers are converted between all numeric data types and
+// strings are parsed with ParseValue, so "on" or "21.5" can be passed as
+// well. Data that doesn't fit the data type is rejected with an *EidError
+// before anything is sent.
+func (c *Client) Set(address string, eid uint32, data interface{}) error {
+	return c.SetContext(context.Background(), address, eid, data)
+}
+
+// SetContext is like Set but aborts when ctx is done.
+func (c *Client) SetContext(ctx context.Context, address string, eid uint32, data interface{}) error {
+	dtype, err := c.EndpointDtypeContext(ctx, address, eid)
+	if err != nil {
+		return err
+	}
+	v, err := Coerce(dtype, data)
+	if err != nil {
+		return &EidError{eid, err}
+	}
+	err = c.write(ctx, address, WritePacket{FLAG_NONE, eid, dtype, v.Data}, eid)
+	if errors.Is(err, Error(HXB_ERR_DATATYPE)) {
+		// the endpoint changed, query it again next time
+		c.forgetDtype(ctx, address, eid)
+	}
+	return err
+}
+
+// SetProperty sends an Endpoint Property Write Packet setting the property
+// prop of eid to data. Like Write it waits for the timeout and returns nil if
+// no Error Packet arrived.
+func (c *Client) SetProperty(address string, eid uint32, prop uint32, data interface{}) error {
+	return c.SetPropertyContext(context.Background(), address, eid, prop, data)
+}
+
+// SetPropertyContext is like SetProperty but aborts when ctx is done.
+func (c *Client) SetPropertyContext(ctx context.Context, address string, eid uint32, prop uint32, data interface{}) error {
+	return c.write(ctx, address, EpPropWritePacket{FLAG_NONE, eid, DTYPE_UNDEFINED, prop, data}, eid)
+}
+
+// send a packet that is only answered on failure, a timeout means success
+// unless the client is reliable
+func (c *Client) write(ctx context.Context, address string, p Packet, eid uint32) error {
+	if c.Reliable {
+		return c.SendReliableContext(ctx, address, p)
+	}
+	resp, err := c.exchange(ctx, address, p, eid, PTYPE_ERROR)
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if opErr, ok := err.(net.Error); ok && opErr.Timeout() {
+			return nil
+		}
+		return err
+	}
+	return remoteError(address, p, eid, resp.p.(*ErrorPacket))
+}
+
+// resolve a device address, if no port is given port is used and link local
+// or multicast addresses without zone are bound to iface. Host names are
+// looked up until ctx is done.
+func resolveAddress(ctx context.Context, address string, iface string, port string) (*net.UDPAddr, error) {
+	host, p, err := net.SplitHostPort(address)
+	if err != nil {
+		host = strings.Trim(address, "[]")
+	} else {
+		port = p
+	}
+	portnum, err := net.DefaultResolver.LookupPort(ctx, "udp6", port)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	var addr *net.UDPAddr
+	for _, ip := range ips {
+		if ip.IP.To4() == nil {
+			addr = &net.UDPAddr{IP: ip.IP, Port: portnum, Zone: ip.Zone}
+			break
+		}
+	}
+	if addr == nil {
+		return nil, &net.AddrError{Err: "no suitable address found", Addr: host}
+	}
+	if addr.Zone == "" && iface != "" && (addr.IP.IsLinkLocalUnicast() || addr.IP.IsMulticast()) {
+		addr.Zone = iface
+	}
+	return addr, nil
+}
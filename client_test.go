@@ -0,0 +1,245 @@
+package hexabus
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fake device on the loopback interface, answers queries for eid with
+// eid*10 in reverse order of arrival, eid's above 20 are answered with Report
+// Packets, eid 99 does not exist and eid 2 is read only
+func fake_device(t *testing.T) (string, func()) {
+	conn, err := net.ListenUDP("udp6", &net.UDPAddr{IP: net.IPv6loopback})
+	if err != nil {
+		t.Skipf("no udp6 loopback: %s", err)
+	}
+
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, raddr, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			p, err := Decode(buf[:n])
+			if err != nil {
+				t.Errorf("fake device received invalid packet: %s", err)
+				continue
+			}
+
+			var reply Packet
+			switch p := p.(type) {
+			case *QueryPacket:
+				if p.Eid == 99 {
+					reply = ErrorPacket{FLAG_NONE, HXB_ERR_UNKNOWNEID}
+				} else if p.Eid > 20 {
+					reply = ReportPacket{FLAG_NONE, p.Eid, DTYPE_UINT32, 0, p.Eid * 10}
+				} else {
+					reply = InfoPacket{FLAG_NONE, p.Eid, DTYPE_UINT32, p.Eid * 10}
+				}
+			case *EpQueryPacket:
+				if p.Eid > 20 {
+					reply = EpReportPacket{FLAG_NONE, p.Eid, DTYPE_UINT32, 0, "Fake Endpoint"}
+				} else {
+					reply = EpInfoPacket{FLAG_NONE, p.Eid, DTYPE_UINT32, "Fake Endpoint"}
+				}
+			case *WritePacket:
+				if p.Eid == 2 {
+					reply = ErrorPacket{FLAG_NONE, HXB_ERR_WRITEREADONLY}
+				}
+			}
+			if reply == nil {
+				continue
+			}
+			packet, _ := reply.Bytes()
+			// answer later queries first to check response matching
+			delay := time.Duration(0)
+			if q, ok := p.(*QueryPacket); ok {
+				delay = time.Duration(50-q.Eid%50) * time.Millisecond
+			}
+			go func(packet []byte, raddr *net.UDPAddr) {
+				time.Sleep(delay)
+				conn.WriteToUDP(packet, raddr)
+			}(packet, raddr)
+		}
+	}()
+
+	return conn.LocalAddr().String(), func() { conn.Close() }
+}
+
+func Test_ClientQuery(t *testing.T) {
+	address, stop := fake_device(t)
+	defer stop()
+
+	c := &Client{Timeout: time.Second}
+	defer c.Close()
+
+	var wg sync.WaitGroup
+	for eid := uint32(1); eid <= 40; eid++ {
+		wg.Add(1)
+		go func(eid uint32) {
+			defer wg.Done()
+			p, err := c.Query(address, eid)
+			if err != nil {
+				t.Errorf("Query of EID %d failed: %s", eid, err)
+				return
+			}
+			if p.Eid != eid || p.Data != eid*10 {
+				t.Errorf("Query of EID %d returned %+v", eid, p)
+			}
+		}(eid)
+	}
+	wg.Wait()
+
+	_, err := c.Query(address, 99)
+	if !errors.Is(err, Error(HXB_ERR_UNKNOWNEID)) {
+		t.Errorf("Query of unknown EID returned %v", err)
+	}
+	var remoteErr *RemoteError
+	if !errors.As(err, &remoteErr) || remoteErr.Addr != address || remoteErr.Eid != 99 || remoteErr.Ptype != PTYPE_QUERY {
+		t.Errorf("Query of unknown EID returned %#v", err)
+	}
+
+	for _, eid := range []uint32{3, 30} {
+		pei, err := c.EpQuery(address, eid)
+		if err != nil || pei.Eid != eid || pei.Data != "Fake Endpoint" {
+			t.Errorf("EpQuery of EID %d returned %+v, %v", eid, pei, err)
+		}
+	}
+
+	// the Error Packet for EID 99 arrives first but must not answer EID 5
+	done := make(chan error)
+	go func() {
+		_, err := c.Query(address, 5)
+		done <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	if _, err := c.Query(address, 99); !errors.Is(err, Error(HXB_ERR_UNKNOWNEID)) {
+		t.Errorf("concurrent Query of unknown EID returned %v", err)
+	}
+	if err := <-done; err != nil {
+		t.Errorf("concurrent Query of EID 5 returned %s", err)
+	}
+
+	c.mu.Lock()
+	if len(c.devices) != 0 {
+		t.Errorf("%d device locks left after the requests", len(c.devices))
+	}
+	c.mu.Unlock()
+}
+
+func Test_ClientWrite(t *testing.T) {
+	address, stop := fake_device(t)
+	defer stop()
+
+	c := &Client{Timeout: 200 * time.Millisecond}
+	defer c.Close()
+
+	err := c.Write(address, 1, true)
+	if err != nil {
+		t.Errorf("Write to writable EID returned %s", err)
+	}
+	err = c.Write(address, 2, true)
+	if !errors.Is(err, Error(HXB_ERR_WRITEREADONLY)) {
+		t.Errorf("Write to read only EID returned %v", err)
+	}
+
+	// the Error Packet of the second write must not end the pending first one
+	done := make(chan error)
+	go func() { done <- c.Write(address, 1, true) }()
+	time.Sleep(20 * time.Millisecond)
+	err = c.Write(address, 2, true)
+	if !errors.Is(err, Error(HXB_ERR_WRITEREADONLY)) {
+		t.Errorf("concurrent Write to read only EID returned %v", err)
+	}
+	if err := <-done; err != nil {
+		t.Errorf("concurrent Write to writable EID returned %s", err)
+	}
+}
+
+func Test_ClientTimeout(t *testing.T) {
+	address, stop := fake_device(t)
+	stop()
+
+	c := &Client{Timeout: 100 * time.Millisecond}
+	defer c.Close()
+
+	_, err := c.Query(address, 1)
+	if opErr, ok := err.(net.Error); !ok || !opErr.Timeout() {
+		t.Errorf("Query without device returned %v, expected timeout", err)
+	}
+	var opErr *OpError
+	if !errors.As(err, &opErr) || opErr.Addr != address || opErr.Eid != 1 || opErr.Ptype != PTYPE_QUERY {
+		t.Errorf("Query without device returned %#v", err)
+	}
+
+	err = c.Write(address, 1, struct{}{})
+	if !errors.Is(err, Error(ERR_HXBDTYPE)) || !errors.As(err, &opErr) || opErr.Timeout() {
+		t.Errorf("Write of unsupported data returned %v", err)
+	}
+
+	// packets passed as pointer report their EID as well
+	r := &Client{Timeout: 100 * time.Millisecond, Retries: -1}
+	defer r.Close()
+	err = r.SendReliable(address, &WritePacket{FLAG_NONE, 7, DTYPE_BOOL, true})
+	if !errors.Is(err, Error(ERR_NOACK)) || !errors.As(err, &opErr) || opErr.Eid != 7 || opErr.Ptype != PTYPE_WRITE {
+		t.Errorf("SendReliable of Write Packet pointer returned %#v", err)
+	}
+}
+
+func Test_ClientContext(t *testing.T) {
+	address, stop := fake_device(t)
+	stop()
+
+	c := &Client{Timeout: 5 * time.Second}
+	defer c.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+	start := time.Now()
+	_, err := c.QueryContext(ctx, address, 1)
+	if err != context.Canceled {
+		t.Errorf("QueryContext returned %v, expected %v", err, context.Canceled)
+	}
+	if time.Since(start) > time.Second {
+		t.Errorf("QueryContext did not abort on cancel")
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err = c.WriteContext(ctx, address, 1, true)
+	if err != context.DeadlineExceeded {
+		t.Errorf("WriteContext returned %v, expected %v", err, context.DeadlineExceeded)
+	}
+	_, err = c.QueryEidsContext(ctx, address, 64)
+	if err != context.DeadlineExceeded {
+		t.Errorf("QueryEidsContext returned %v, expected %v", err, context.DeadlineExceeded)
+	}
+}
+
+func Test_resolveAddress(t *testing.T) {
+	addresses := map[string]string{
+		"::1":                     "[::1]:61616",
+		"[::1]:1234":              "[::1]:1234",
+		"fd00::50:c4ff:fe04:8390": "[fd00::50:c4ff:fe04:8390]:61616",
+		"[fd00::1]":               "[fd00::1]:61616",
+		"fe80::1%lo":              "[fe80::1%lo]:61616",
+	}
+	for address, expected := range addresses {
+		addr, err := resolveAddress(context.Background(), address, "", PORT)
+		if err != nil {
+			t.Errorf("resolveAddress(%s) failed: %s", address, err)
+			continue
+		}
+		if addr.String() != expected {
+			t.Errorf("resolveAddress(%s) returned %s, expected %s", address, addr, expected)
+		}
+	}
+}
@@ -1,31 +1,493 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	paho "github.com/eclipse/paho.mqtt.golang"
 	"github.com/jessevdk/go-flags"
 	"github.com/morriswinkler/hexabus"
+	"github.com/morriswinkler/hexabus/exporter"
+	"github.com/morriswinkler/hexabus/mqtt"
+	"github.com/morriswinkler/hexabus/recorder"
+	"net"
+	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 )
 
 var opts struct {
-	Version   bool   `long:"version" description:"print libhexabus version and exit"`
-	Command   string `short:"c" long:"command" description:"{get|set|epquery|send|listen|on|off|status|power|devinfo}"`
-	Ip        string `short:"i" long:"ip" description:"the hostname to connect to"`
-	Bind      string `short:"b" long:"bind" description:"local IP address to use"`
-	Interface string `short:"I" long:"interface" description:"for listen: interface to listen on. otherwise: outgoing interface for multicast"`
-	Eid       uint32 `short:"e" long:"eid" description:"Endpoint ID (EID)"`
-	Dtype     uint   `shor:"d" long:"datatype" description:"{1: Bool | 2: UInt8 | 3: UInt32 | 4: HexaTime | 5:Float | 6: String}"`
-	Value     string `short:"v" long:"value" description:"Value"`
-	Oneline   bool   `long:"oneline" description:"Print each receive packet on one line"`
+	Version   bool     `long:"version" description:"print libhexabus version and exit"`
+	Command   string   `short:"c" long:"command" description:"{get|set|epquery|send|listen|timeserver|smupload|mqtt|exporter|record|on|off|status|power|devinfo}"`
+	Ip        string   `short:"i" long:"ip" description:"the hostname to connect to"`
+	Bind      string   `short:"b" long:"bind" description:"local IP address to use"`
+	Interface string   `short:"I" long:"interface" description:"for listen: interface to listen on. otherwise: outgoing interface for multicast"`
+	Eid       uint32   `short:"e" long:"eid" description:"Endpoint ID (EID)"`
+	Dtype     uint     `short:"d" long:"datatype" description:"{1: Bool | 2: UInt8 | 3: UInt32 | 4: HexaTime | 5:Float | 6: String | 7: Timestamp | 8: 66Bytes | 9: 16Bytes | 10: UInt16 | 11: UInt64 | 12: Int8 | 13: Int16 | 14: Int32 | 15: Int64 | 16: Double}, set uses the data type of the endpoint if omitted"`
+	Value     string   `short:"v" long:"value" description:"Value"`
+	Oneline   bool     `long:"oneline" description:"Print each receive packet on one line"`
+	Json      bool     `long:"json" description:"Print each packet as JSON object, one object per line"`
+	Reliable  bool     `long:"reliable" description:"Send writes reliably and wait for the acknowledgement"`
+	Probe     string   `long:"probe" choice:"property" choice:"write" default:"property" description:"for devinfo and mqtt --discover: how writable endpoints are found, property asks the device and falls back to the known EID's, write changes endpoints that accept the probe value"`
+	Interval  uint     `long:"interval" description:"for timeserver: seconds between two broadcasts, for exporter: seconds between two polls" default:"60"`
+	Timezone  string   `long:"timezone" description:"for timeserver: time zone of the broadcast time like Europe/Berlin, local time if omitted"`
+	File      string   `short:"f" long:"file" description:"for smupload: compiled state machine program, for record: history log"`
+	Broker    string   `long:"broker" description:"for mqtt: URL of the MQTT broker" default:"tcp://localhost:1883"`
+	Prefix    string   `long:"prefix" description:"for mqtt: first level of the topics" default:"hexabus"`
+	Discover  []string `long:"discover" description:"for mqtt: device whose endpoints are announced on <prefix>/<device>/eids, may be repeated"`
+	Retain    bool     `long:"retain" description:"for mqtt: retain the published values"`
+	Http      string   `long:"http" description:"for exporter: address the /metrics endpoint is served on" default:":9576"`
+	Poll      []string `long:"poll" description:"for exporter: <address>/<eid> queried every --interval, may be repeated"`
+	Expiry    uint     `long:"expiry" description:"for exporter: seconds after which values that weren't updated are dropped" default:"300"`
+	Export    string   `long:"export" choice:"csv" choice:"influx" description:"for record: print the history of --ip and --eid, if given, instead of recording"`
+	From      string   `long:"from" description:"for record --export: first local time exported like 2006-01-02 15:04:05"`
+	To        string   `long:"to" description:"for record --export: local time the export ends before like 2006-01-02 15:04:05"`
+	Step      uint     `long:"step" description:"for record --export: seconds values are averaged over"`
 }
 
+// exit codes
+const (
+	EXIT_OK      = 0 // success
+	EXIT_FAILURE = 1 // network or other failure
+	EXIT_USAGE   = 2 // missing or invalid parameters
+	EXIT_TIMEOUT = 3 // the device did not answer
+	EXIT_DEVICE  = 4 // the device answered with an Error Packet
+)
+
+// well known endpoints of a hexabus plug
+const (
+	EID_RELAY = 1 // main switch
+	EID_POWER = 2 // power meter
+)
+
+// number of EID's queried by devinfo
+const DEVINFO_EIDS = 256
+
 func main() {
 
-	flags.Parse(&opts)
+	_, err := flags.Parse(&opts)
+	if err != nil {
+		if flagsErr, ok := err.(*flags.Error); ok && flagsErr.Type == flags.ErrHelp {
+			os.Exit(EXIT_OK)
+		}
+		os.Exit(EXIT_USAGE)
+	}
 
 	if opts.Version {
 		fmt.Println("go hexabus library: " + hexabus.VERSION)
-		os.Exit(0)
+		os.Exit(EXIT_OK)
+	}
+
+	os.Exit(run())
+}
+
+// writability detection selected by --probe
+func probe() int {
+	if opts.Probe == "write" {
+		return hexabus.PROBE_WRITE
+	}
+	return hexabus.PROBE_PROPERTY
+}
+
+// run the command given by --command and return the exit code
+func run() int {
+	if opts.Command == "" {
+		return usage("no command given")
+	}
+	if opts.Command == "listen" {
+		return listen()
+	}
+	if opts.Command == "timeserver" {
+		return timeserver()
+	}
+	if opts.Command == "mqtt" {
+		return bridge()
+	}
+	if opts.Command == "exporter" {
+		return export()
+	}
+	if opts.Command == "record" {
+		return record()
+	}
+	if opts.Ip == "" {
+		return usage("command " + opts.Command + " needs --ip")
+	}
+
+	client := &hexabus.Client{LocalAddr: opts.Bind, Interface: opts.Interface, Reliable: opts.Reliable, Probe: probe()}
+	defer client.Close()
+
+	switch opts.Command {
+	case "get":
+		return get(client, opts.Eid)
+	case "status":
+		return get(client, EID_RELAY)
+	case "power":
+		return get(client, EID_POWER)
+	case "set":
+		if opts.Value == "" {
+			return usage("command set needs --value")
+		}
+		if opts.Dtype == 0 {
+			// convert to the data type the endpoint reports
+			err := client.Set(opts.Ip, opts.Eid, opts.Value)
+			if _, ok := err.(*hexabus.EidError); ok {
+				return usage(err.Error())
+			}
+			return exitCode(err)
+		}
+		data, err := hexabus.ParseValue(byte(opts.Dtype), opts.Value)
+		if err != nil {
+			return usage(err.Error())
+		}
+		return exitCode(client.Write(opts.Ip, opts.Eid, data))
+	case "on":
+		return exitCode(client.Write(opts.Ip, EID_RELAY, true))
+	case "off":
+		return exitCode(client.Write(opts.Ip, EID_RELAY, false))
+	case "epquery":
+		p, err := client.EpQuery(opts.Ip, opts.Eid)
+		if err != nil {
+			return exitCode(err)
+		}
+		printPacket(nil, p)
+	case "send":
+		if opts.Value == "" {
+			return usage("command send needs --value")
+		}
+		if opts.Dtype == 0 {
+			return usage("command send needs --datatype")
+		}
+		data, err := hexabus.ParseValue(byte(opts.Dtype), opts.Value)
+		if err != nil {
+			return usage(err.Error())
+		}
+		return exitCode(client.Send(opts.Ip, hexabus.InfoPacket{Eid: opts.Eid, Dtype: data.Dtype, Data: data.Data}))
+	case "smupload":
+		return smupload(client)
+	case "devinfo":
+		eids, err := queryEids(client, opts.Ip)
+		if err != nil {
+			return exitCode(err)
+		}
+		printEids(eids)
+	default:
+		return usage("unknown command " + opts.Command)
+	}
+	return EXIT_OK
+}
+
+// query the EID's of a device, EID's that failed or whose writability is
+// unknown are only reported as warnings
+func queryEids(client *hexabus.Client, address string) ([]hexabus.EID, error) {
+	eids, err := client.QueryEids(address, DEVINFO_EIDS)
+	var eid_errors hexabus.EidErrors
+	if !errors.As(err, &eid_errors) {
+		return eids, err
+	}
+	for _, e := range eid_errors {
+		fmt.Fprintln(os.Stderr, "Warning: "+address+": "+e.Error())
+	}
+	return eids, nil
+}
+
+// query an endpoint and print the Info Packet
+func get(client *hexabus.Client, eid uint32) int {
+	p, err := client.Query(opts.Ip, eid)
+	if err != nil {
+		return exitCode(err)
+	}
+	printPacket(nil, p)
+	return EXIT_OK
+}
+
+// print every packet received on the multicast group until interrupted
+func listen() int {
+	l, err := hexabus.Listen(opts.Interface)
+	if err != nil {
+		return exitCode(err)
+	}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt)
+	go func() {
+		<-sig
+		l.Close()
+	}()
+
+	for ev := range l.Events() {
+		if ev.Err != nil {
+			fmt.Fprintf(os.Stderr, "Error from %v: %s\n", ev.Addr, ev.Err)
+			continue
+		}
+		printPacket(ev.Addr, ev.Packet)
+	}
+	return EXIT_OK
+}
+
+// upload the state machine program in --file
+func smupload(client *hexabus.Client) int {
+	if opts.File == "" {
+		return usage("command smupload needs --file")
+	}
+	program, err := os.ReadFile(opts.File)
+	if err != nil {
+		return usage(err.Error())
+	}
+	u := &hexabus.SMUploader{Client: client, Progress: func(done, total int) {
+		if !opts.Json {
+			fmt.Printf("Uploaded chunk %d of %d\n", done, total)
+		}
+	}}
+	return exitCode(u.Upload(context.Background(), opts.Ip, program))
+}
+
+// broadcast the date and time to the multicast group, or to --ip if given,
+// until interrupted
+func timeserver() int {
+	if opts.Eid == 0 {
+		return usage("command timeserver needs --eid")
 	}
+	loc := time.Local
+	if opts.Timezone != "" {
+		var err error
+		loc, err = time.LoadLocation(opts.Timezone)
+		if err != nil {
+			return usage(err.Error())
+		}
+	}
+	s := &hexabus.TimeServer{
+		Eid:       opts.Eid,
+		Interface: opts.Interface,
+		LocalAddr: opts.Bind,
+		Address:   opts.Ip,
+		Interval:  time.Duration(opts.Interval) * time.Second,
+		Location:  loc,
+		Failed:    func(err error) { fmt.Fprintln(os.Stderr, "Error: "+err.Error()) },
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sig
+		cancel()
+	}()
+
+	err := s.Run(ctx)
+	if err == context.Canceled {
+		return EXIT_OK
+	}
+	return exitCode(err)
+}
 
+// publish the packets received on the multicast group to the MQTT broker
+// and write the values published on the set topics until interrupted
+func bridge() int {
+	client := &hexabus.Client{LocalAddr: opts.Bind, Interface: opts.Interface, Reliable: opts.Reliable, Probe: probe()}
+	defer client.Close()
+
+	devices := map[string][]hexabus.EID{}
+	for _, address := range opts.Discover {
+		eids, err := queryEids(client, address)
+		if err != nil {
+			return exitCode(err)
+		}
+		devices[address] = eids
+	}
+
+	l, err := hexabus.Listen(opts.Interface)
+	if err != nil {
+		return exitCode(err)
+	}
+	defer l.Close()
+
+	broker := paho.NewClient(paho.NewClientOptions().AddBroker(opts.Broker).SetClientID("hexaswitch-" + strconv.Itoa(os.Getpid())))
+	token := broker.Connect()
+	token.Wait()
+	if token.Error() != nil {
+		return exitCode(token.Error())
+	}
+	defer broker.Disconnect(250)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sig
+		cancel()
+	}()
+
+	b := &mqtt.Bridge{
+		MQTT:    broker,
+		Client:  client,
+		Prefix:  opts.Prefix,
+		Devices: devices,
+		Retain:  opts.Retain,
+		Failed:  func(err error) { fmt.Fprintln(os.Stderr, "Error: "+err.Error()) },
+	}
+	err = b.Run(ctx, l)
+	if err == context.Canceled {
+		return EXIT_OK
+	}
+	return exitCode(err)
+}
+
+// serve the values received on the multicast group and of the --poll
+// endpoints as Prometheus metrics until interrupted
+func export() int {
+	poll := map[string][]uint32{}
+	for _, p := range opts.Poll {
+		i := strings.LastIndex(p, "/")
+		if i < 0 {
+			return usage("--poll needs <address>/<eid>, got " + p)
+		}
+		eid, err := strconv.ParseUint(p[i+1:], 10, 32)
+		if err != nil {
+			return usage("--poll needs <address>/<eid>, got " + p)
+		}
+		poll[p[:i]] = append(poll[p[:i]], uint32(eid))
+	}
+
+	client := &hexabus.Client{LocalAddr: opts.Bind, Interface: opts.Interface}
+	defer client.Close()
+	l, err := hexabus.Listen(opts.Interface)
+	if err != nil {
+		return exitCode(err)
+	}
+	defer l.Close()
+
+	e := &exporter.Exporter{
+		Client:   client,
+		Poll:     poll,
+		Interval: time.Duration(opts.Interval) * time.Second,
+		Expiry:   time.Duration(opts.Expiry) * time.Second,
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", e)
+	server := &http.Server{Addr: opts.Http, Handler: mux}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sig
+		cancel()
+		server.Close()
+	}()
+
+	failed := make(chan error, 1)
+	go func() {
+		failed <- server.ListenAndServe()
+		cancel()
+	}()
+	err = e.Run(ctx, l)
+	select {
+	case serveErr := <-failed:
+		if serveErr != http.ErrServerClosed {
+			return exitCode(serveErr)
+		}
+	default:
+		server.Close()
+	}
+	if err == context.Canceled {
+		return EXIT_OK
+	}
+	return exitCode(err)
+}
+
+// append the packets received on the multicast group to --file until
+// interrupted, or export the history with --export
+func record() int {
+	if opts.File == "" {
+		return usage("command record needs --file")
+	}
+	if opts.Export != "" {
+		return exportHistory()
+	}
+
+	r, err := recorder.Open(opts.File)
+	if err != nil {
+		return exitCode(err)
+	}
+	defer r.Close()
+	l, err := hexabus.Listen(opts.Interface)
+	if err != nil {
+		return exitCode(err)
+	}
+	defer l.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sig
+		cancel()
+	}()
+
+	err = r.Run(ctx, l)
+	if err == context.Canceled {
+		return EXIT_OK
+	}
+	return exitCode(err)
+}
+
+// print the history in --file as CSV or InfluxDB line protocol
+func exportHistory() int {
+	write := recorder.WriteCSV
+	if opts.Export == "influx" {
+		write = recorder.WriteLineProtocol
+	}
+	q := recorder.Query{Device: opts.Ip, Step: time.Duration(opts.Step) * time.Second}
+	if opts.Eid != 0 {
+		q.Eids = []uint32{opts.Eid}
+	}
+	var err error
+	if opts.From != "" {
+		q.From, err = time.ParseInLocation(hexabus.DATETIME_LAYOUT, opts.From, time.Local)
+		if err != nil {
+			return usage(err.Error())
+		}
+	}
+	if opts.To != "" {
+		q.To, err = time.ParseInLocation(hexabus.DATETIME_LAYOUT, opts.To, time.Local)
+		if err != nil {
+			return usage(err.Error())
+		}
+	}
+
+	records, err := recorder.ReadFile(opts.File, q)
+	if err != nil {
+		return exitCode(err)
+	}
+	return exitCode(write(os.Stdout, records))
+}
+
+// print a usage error
+func usage(msg string) int {
+	fmt.Fprintln(os.Stderr, "Error: "+msg)
+	return EXIT_USAGE
+}
+
+// print err and map it to an exit code
+func exitCode(err error) int {
+	if err == nil {
+		return EXIT_OK
+	}
+	fmt.Fprintln(os.Stderr, "Error: "+err.Error())
+	var remoteErr *hexabus.RemoteError
+	if errors.As(err, &remoteErr) {
+		return EXIT_DEVICE
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return EXIT_TIMEOUT
+	}
+	if errors.Is(err, hexabus.Error(hexabus.ERR_NOACK)) {
+		return EXIT_TIMEOUT
+	}
+	return EXIT_FAILURE
 }
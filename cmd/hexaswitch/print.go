@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/morriswinkler/hexabus"
+	"net"
+	"os"
+	"strings"
+)
+
+// print a packet in the format of the libhexabus hexaswitch, src is nil for
+// responses to a request
+func printPacket(src *net.UDPAddr, p hexabus.Packet) {
+	if opts.Json {
+		source := opts.Ip
+		if src != nil {
+			source = src.IP.String()
+		}
+		printJSON(source, p)
+		return
+	}
+
+	fields := []string{}
+	if src != nil {
+		fields = append(fields, "Received packet from: "+src.IP.String())
+	}
+	fields = append(fields, hexabus.PtypeName(p.PacketType()))
+	fields = append(fields, fmt.Sprintf("Flags:\t%d", p.PacketFlags()))
+
+	switch p := p.(type) {
+	case *hexabus.ErrorPacket:
+		fields = append(fields, "Error:\t"+hexabus.Error(p.Error).Error())
+	case *hexabus.InfoPacket:
+		fields = append(fields, fmt.Sprintf("EID:\t%d", p.Eid))
+		fields = append(fields, "Datatype:\t"+hexabus.DtypeName(p.Dtype))
+		fields = append(fields, "Value:\t"+formatValue(p.Data))
+	case *hexabus.WritePacket:
+		fields = append(fields, fmt.Sprintf("EID:\t%d", p.Eid))
+		fields = append(fields, "Datatype:\t"+hexabus.DtypeName(p.Dtype))
+		fields = append(fields, "Value:\t"+formatValue(p.Data))
+	case *hexabus.EpInfoPacket:
+		fields = append(fields, fmt.Sprintf("EID:\t%d", p.Eid))
+		fields = append(fields, "Datatype:\t"+hexabus.DtypeName(p.Dtype))
+		fields = append(fields, "Description:\t"+formatValue(p.Data))
+	case *hexabus.EpPropReportPacket:
+		fields = append(fields, fmt.Sprintf("EID:\t%d", p.Eid))
+		fields = append(fields, fmt.Sprintf("Property:\t%d", p.PropId))
+		fields = append(fields, "Datatype:\t"+hexabus.DtypeName(p.Dtype))
+		fields = append(fields, "Value:\t"+formatValue(p.Data))
+	case *hexabus.EpPropWritePacket:
+		fields = append(fields, fmt.Sprintf("EID:\t%d", p.Eid))
+		fields = append(fields, fmt.Sprintf("Property:\t%d", p.PropId))
+		fields = append(fields, "Datatype:\t"+hexabus.DtypeName(p.Dtype))
+		fields = append(fields, "Value:\t"+formatValue(p.Data))
+	case *hexabus.EpPropQueryPacket:
+		fields = append(fields, fmt.Sprintf("EID:\t%d", p.Eid))
+		fields = append(fields, fmt.Sprintf("Property:\t%d", p.PropId))
+	case *hexabus.ReportPacket:
+		fields = append(fields, fmt.Sprintf("EID:\t%d", p.Eid))
+		fields = append(fields, "Datatype:\t"+hexabus.DtypeName(p.Dtype))
+		fields = append(fields, fmt.Sprintf("Cause:\t%d", p.Cause))
+		fields = append(fields, "Value:\t"+formatValue(p.Data))
+	case *hexabus.EpReportPacket:
+		fields = append(fields, fmt.Sprintf("EID:\t%d", p.Eid))
+		fields = append(fields, "Datatype:\t"+hexabus.DtypeName(p.Dtype))
+		fields = append(fields, fmt.Sprintf("Cause:\t%d", p.Cause))
+		fields = append(fields, "Description:\t"+formatValue(p.Data))
+	case *hexabus.PInfoPacket:
+		fields = append(fields, "Origin:\t"+p.Origin.String())
+		fields = append(fields, fmt.Sprintf("EID:\t%d", p.Eid))
+		fields = append(fields, "Datatype:\t"+hexabus.DtypeName(p.Dtype))
+		fields = append(fields, "Value:\t"+formatValue(p.Data))
+	case *hexabus.AckPacket:
+		fields = append(fields, fmt.Sprintf("Cause:\t%d", p.Cause))
+	case *hexabus.QueryPacket:
+		fields = append(fields, fmt.Sprintf("EID:\t%d", p.Eid))
+	case *hexabus.EpQueryPacket:
+		fields = append(fields, fmt.Sprintf("EID:\t%d", p.Eid))
+	}
+
+	if opts.Oneline {
+		fmt.Println(strings.Replace(strings.Join(fields, ";"), "\t", " ", -1) + ";")
+	} else {
+		fmt.Println(strings.Join(fields, "\n") + "\n")
+	}
+}
+
+// print the endpoints of a device
+func printEids(eids []hexabus.EID) {
+	if opts.Json {
+		printJSON(opts.Ip, struct {
+			Eids []hexabus.EID `json:"eids"`
+		}{eids})
+		return
+	}
+	for _, eid := range eids {
+		access := "read only"
+		if eid.Writable {
+			access = "writable"
+		}
+		if opts.Oneline {
+			fmt.Printf("EID: %d;Datatype: %s;Description: %s;Access: %s;\n", eid.Eid, hexabus.DtypeName(eid.Dtype), eid.Desc, access)
+		} else {
+			fmt.Printf("EID:\t%d\nDatatype:\t%s\nDescription:\t%s\nAccess:\t%s\n\n", eid.Eid, hexabus.DtypeName(eid.Dtype), eid.Desc, access)
+		}
+	}
+}
+
+// format a packet payload
+func formatValue(data interface{}) string {
+	switch data := data.(type) {
+	case []byte:
+		return fmt.Sprintf("%x", data)
+	}
+	return fmt.Sprintf("%v", data)
+}
+
+// print v as JSON object on one line with the source address added
+func printJSON(source string, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error: "+err.Error())
+		return
+	}
+	obj := map[string]json.RawMessage{}
+	err = json.Unmarshal(b, &obj)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error: "+err.Error())
+		return
+	}
+	obj["source"], _ = json.Marshal(source)
+	b, _ = json.Marshal(obj)
+	fmt.Println(string(b))
+}
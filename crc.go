@@ -36,6 +36,9 @@ func addCRC(packet []byte) []byte {
 
 // validate checksum from a received hexabus package
 func checkCRC(packet []byte) (err error) {
+	if len(packet) < min_packet_length {
+		return &LengthError{Length: len(packet), Expected: min_packet_length}
+	}
 	crc_c := crc16(packet[:len(packet)-2])
 	crc_r := binary.BigEndian.Uint16(packet[len(packet)-2:])
 	if crc_c == crc_r {
@@ -0,0 +1,307 @@
+package hexabus
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+)
+
+// Endpoint served by a Device.
+type Endpoint struct {
+	Eid   uint32                      // endpoint id
+	Dtype byte                        // data type
+	Desc  string                      // description returned by Endpoint Info
+	Read  func() (interface{}, error) // returns the current value
+	Write func(interface{}) error     // sets a new value, nil for read only
+}
+
+// Device implements a Hexabus device. It answers Query, Endpoint Query,
+// Write and Endpoint Property Packets for the registered endpoints the way
+// the Hexabus firmware does, including the EID descriptors at every multiple
+// of 32. The device name and the endpoint names can be changed with
+// EP_PROP_DEVICE_NAME and EP_PROP_NAME. Handlers may
+// return an Error to reply with a specific Error Packet, any other error is
+// reported as HXB_ERR_INVALID_VALUE.
+type Device struct {
+	Name string // device name, description of EID 0, set before serving
+
+	mu        sync.RWMutex
+	endpoints map[uint32]*Endpoint
+	conns     []net.PacketConn
+	seen      seqWindow
+}
+
+// NewDevice returns a Device without endpoints.
+func NewDevice(name string) *Device {
+	return &Device{Name: name, endpoints: make(map[uint32]*Endpoint)}
+}
+
+// Register adds an endpoint to the device. EID's that are a multiple of 32
+// are reserved for the descriptors.
+func (d *Device) Register(ep Endpoint) error {
+	if ep.Eid%32 == 0 {
+		return descriptorEidError(ep.Eid)
+	}
+	if ep.Read == nil {
+		return errors.New("endpoint " + eidString(ep.Eid) + " has no Read")
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := d.endpoints[ep.Eid]; ok {
+		return errors.New("duplicate endpoint " + eidString(ep.Eid))
+	}
+	d.endpoints[ep.Eid] = &ep
+	return nil
+}
+
+// error for an EID that is reserved for a descriptor
+func descriptorEidError(eid uint32) error {
+	return errors.New(eidString(eid) + " is reserved for a descriptor")
+}
+
+func eidString(eid uint32) string {
+	return "eid " + strconv.FormatUint(uint64(eid), 10)
+}
+
+// ListenAndServe listens on the udp6 address, PORT if no port is given, and
+// serves requests until the Device is closed.
+func (d *Device) ListenAndServe(address string) error {
+	addr, err := resolveAddress(context.Background(), address, "", PORT)
+	if err != nil {
+		return err
+	}
+	conn, err := net.ListenUDP("udp6", addr)
+	if err != nil {
+		return err
+	}
+	return d.Serve(conn)
+}
+
+// Serve answers requests received on conn until conn or the Device is
+// closed. Reliable requests are acknowledged after the reply is sent,
+// retransmissions are acknowledged again but not handled twice.
+func (d *Device) Serve(conn net.PacketConn) error {
+	d.mu.Lock()
+	d.conns = append(d.conns, conn)
+	d.mu.Unlock()
+
+	buf := make([]byte, 1500)
+	for {
+		n, raddr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if opErr, ok := err.(net.Error); ok && opErr.Timeout() {
+				continue
+			}
+			return err
+		}
+		seq, reliable := Sequence(buf[:n])
+		if reliable && d.seen.duplicate(raddr, seq) {
+			sendAck(conn, raddr, seq)
+			continue
+		}
+		reply := d.handlePacket(buf[:n])
+		if reply != nil {
+			packet, err := reply.Bytes()
+			if err != nil {
+				packet, _ = ErrorPacket{FLAG_NONE, HXB_ERR_INVALID_VALUE}.Bytes()
+			}
+			conn.WriteTo(packet, raddr)
+		}
+		if reliable {
+			sendAck(conn, raddr, seq)
+		}
+	}
+}
+
+// Close closes all connections the Device serves.
+func (d *Device) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var err error
+	for _, conn := range d.conns {
+		if e := conn.Close(); e != nil {
+			err = e
+		}
+	}
+	d.conns = nil
+	return err
+}
+
+// decode a received datagram and build the reply, nil if there is none
+func (d *Device) handlePacket(packet []byte) Packet {
+	p, err := Decode(packet)
+	if errors.Is(err, Error(ERR_CRCFAILED)) {
+		return ErrorPacket{FLAG_NONE, HXB_ERR_CRCFAILED}
+	}
+	if err != nil {
+		return nil
+	}
+	return d.handle(p)
+}
+
+// build the reply to a request, nil if there is none
+func (d *Device) handle(p Packet) Packet {
+	switch p := p.(type) {
+	case *QueryPacket:
+		if p.Eid%32 == 0 {
+			mask, ok := d.descriptor(p.Eid)
+			if !ok {
+				return ErrorPacket{FLAG_NONE, HXB_ERR_UNKNOWNEID}
+			}
+			return InfoPacket{FLAG_NONE, p.Eid, DTYPE_UINT32, mask}
+		}
+		ep := d.endpoint(p.Eid)
+		if ep == nil {
+			return ErrorPacket{FLAG_NONE, HXB_ERR_UNKNOWNEID}
+		}
+		data, err := ep.Read()
+		if err != nil {
+			return errorReply(err)
+		}
+		return InfoPacket{FLAG_NONE, ep.Eid, ep.Dtype, data}
+	case *EpQueryPacket:
+		if p.Eid == 0 {
+			return EpInfoPacket{FLAG_NONE, p.Eid, DTYPE_UINT32, d.name()}
+		}
+		if _, ok := d.descriptor(p.Eid); ok && p.Eid%32 == 0 {
+			return EpInfoPacket{FLAG_NONE, p.Eid, DTYPE_UINT32, "Device Descriptor"}
+		}
+		ep := d.endpoint(p.Eid)
+		if ep == nil {
+			return ErrorPacket{FLAG_NONE, HXB_ERR_UNKNOWNEID}
+		}
+		return EpInfoPacket{FLAG_NONE, ep.Eid, ep.Dtype, ep.Desc}
+	case *WritePacket:
+		if _, ok := d.descriptor(p.Eid); ok && p.Eid%32 == 0 {
+			return ErrorPacket{FLAG_NONE, HXB_ERR_WRITEREADONLY}
+		}
+		ep := d.endpoint(p.Eid)
+		if ep == nil {
+			return ErrorPacket{FLAG_NONE, HXB_ERR_UNKNOWNEID}
+		}
+		if ep.Write == nil {
+			return ErrorPacket{FLAG_NONE, HXB_ERR_WRITEREADONLY}
+		}
+		if p.Dtype != ep.Dtype {
+			return ErrorPacket{FLAG_NONE, HXB_ERR_DATATYPE}
+		}
+		err := ep.Write(p.Data)
+		if err != nil {
+			return errorReply(err)
+		}
+	case *EpPropQueryPacket:
+		data, err := d.property(p.Eid, p.PropId)
+		if err != nil {
+			return errorReply(err)
+		}
+		return EpPropReportPacket{FLAG_NONE, p.Eid, DTYPE_UNDEFINED, p.PropId, data}
+	case *EpPropWritePacket:
+		err := d.setProperty(p.Eid, p.PropId, p.Data)
+		if err != nil {
+			return errorReply(err)
+		}
+	}
+	return nil
+}
+
+// look up a registered endpoint, returns a copy
+func (d *Device) endpoint(eid uint32) *Endpoint {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	ep, ok := d.endpoints[eid]
+	if !ok {
+		return nil
+	}
+	c := *ep
+	return &c
+}
+
+// name of the device
+func (d *Device) name() string {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.Name
+}
+
+// value of an endpoint property
+func (d *Device) property(eid uint32, prop uint32) (interface{}, error) {
+	if _, ok := d.descriptor(eid); ok && eid%32 == 0 {
+		switch {
+		case prop == EP_PROP_WRITABLE:
+			return false, nil
+		case prop == EP_PROP_DEVICE_NAME && eid == 0:
+			return d.name(), nil
+		}
+		return nil, Error(HXB_ERR_INVALID_VALUE)
+	}
+	ep := d.endpoint(eid)
+	if ep == nil {
+		return nil, Error(HXB_ERR_UNKNOWNEID)
+	}
+	switch prop {
+	case EP_PROP_NAME:
+		return ep.Desc, nil
+	case EP_PROP_WRITABLE:
+		return ep.Write != nil, nil
+	}
+	return nil, Error(HXB_ERR_INVALID_VALUE)
+}
+
+// change an endpoint property, only the names can be written
+func (d *Device) setProperty(eid uint32, prop uint32, data interface{}) error {
+	name, ok := data.(string)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if eid == 0 && prop == EP_PROP_DEVICE_NAME {
+		if !ok {
+			return Error(HXB_ERR_DATATYPE)
+		}
+		d.Name = name
+		return nil
+	}
+	ep := d.endpoints[eid]
+	if ep == nil {
+		if eid%32 == 0 {
+			return Error(HXB_ERR_WRITEREADONLY)
+		}
+		return Error(HXB_ERR_UNKNOWNEID)
+	}
+	if prop != EP_PROP_NAME {
+		return Error(HXB_ERR_WRITEREADONLY)
+	}
+	if !ok {
+		return Error(HXB_ERR_DATATYPE)
+	}
+	ep.Desc = name
+	return nil
+}
+
+// bitmask of the available EID's from descriptor to descriptor+31, LSB is
+// the descriptor itself. Descriptors exist up to the highest registered EID,
+// EID 0 always exists.
+func (d *Device) descriptor(descriptor uint32) (uint32, bool) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	mask := uint32(1)
+	ok := descriptor == 0
+	for eid := range d.endpoints {
+		if eid >= descriptor && eid < descriptor+32 {
+			mask |= 1 << (eid - descriptor)
+		}
+		if eid > descriptor {
+			ok = true
+		}
+	}
+	return mask, ok
+}
+
+// Error Packet for a failed handler
+func errorReply(err error) Packet {
+	var e Error
+	if errors.As(err, &e) && e <= HXB_ERR_INVALID_VALUE && e != HXB_ERR_SUCCESS {
+		return ErrorPacket{FLAG_NONE, byte(e)}
+	}
+	return ErrorPacket{FLAG_NONE, HXB_ERR_INVALID_VALUE}
+}
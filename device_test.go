@@ -0,0 +1,401 @@
+package hexabus
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// virtual plug with a relay on EID 1 and a power meter on EID 2
+func test_device(t *testing.T) (*Device, string) {
+	var mu sync.Mutex
+	relay := false
+
+	d := NewDevice("Test Plug")
+	err := d.Register(Endpoint{
+		Eid:   1,
+		Dtype: DTYPE_BOOL,
+		Desc:  "Main Switch",
+		Read: func() (interface{}, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			return relay, nil
+		},
+		Write: func(data interface{}) error {
+			mu.Lock()
+			defer mu.Unlock()
+			relay = data.(bool)
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	err = d.Register(Endpoint{
+		Eid:   2,
+		Dtype: DTYPE_UINT32,
+		Desc:  "Power Meter",
+		Read:  func() (interface{}, error) { return uint32(230), nil },
+	})
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	err = d.Register(Endpoint{
+		Eid:   35,
+		Dtype: DTYPE_UINT8,
+		Desc:  "Dimmer",
+		Read:  func() (interface{}, error) { return uint8(0), nil },
+		Write: func(data interface{}) error { return Error(HXB_ERR_INVALID_VALUE) },
+	})
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	conn, err := net.ListenUDP("udp6", &net.UDPAddr{IP: net.IPv6loopback})
+	if err != nil {
+		t.Skipf("no udp6 loopback: %s", err)
+	}
+	go d.Serve(conn)
+	return d, conn.LocalAddr().String()
+}
+
+func Test_DeviceRegister(t *testing.T) {
+	d := NewDevice("Test")
+	read := func() (interface{}, error) { return true, nil }
+	tests := []struct {
+		ep  Endpoint
+		err string
+	}{
+		{Endpoint{Eid: 32, Dtype: DTYPE_BOOL, Read: read}, "eid 32 is reserved for a descriptor"},
+		{Endpoint{Eid: 1, Dtype: DTYPE_BOOL}, "endpoint eid 1 has no Read"},
+		{Endpoint{Eid: 1, Dtype: DTYPE_BOOL, Read: read}, ""},
+		{Endpoint{Eid: 1, Dtype: DTYPE_BOOL, Read: read}, "duplicate endpoint eid 1"},
+	}
+	for _, test := range tests {
+		err := d.Register(test.ep)
+		if (err == nil && test.err != "") || (err != nil && err.Error() != test.err) {
+			t.Errorf("Register of EID %d returned %v, expected %q", test.ep.Eid, err, test.err)
+		}
+	}
+}
+
+func Test_DeviceRequests(t *testing.T) {
+	d, address := test_device(t)
+	defer d.Close()
+
+	c := &Client{Timeout: 200 * time.Millisecond}
+	defer c.Close()
+
+	failures := []struct {
+		name string
+		err  error
+		code Error
+	}{
+		{"write unknown EID", c.Write(address, 7, true), HXB_ERR_UNKNOWNEID},
+		{"write read only EID", c.Write(address, 2, uint32(1)), HXB_ERR_WRITEREADONLY},
+		{"write wrong data type", c.Write(address, 1, uint8(1)), HXB_ERR_DATATYPE},
+		{"write invalid value", c.Write(address, 35, uint8(1)), HXB_ERR_INVALID_VALUE},
+	}
+	for _, v := range failures {
+		if !errors.Is(v.err, v.code) {
+			t.Errorf("%s returned %v, expected %v", v.name, v.err, v.code)
+		}
+	}
+	_, err := c.Query(address, 7)
+	if !errors.Is(err, Error(HXB_ERR_UNKNOWNEID)) {
+		t.Errorf("query unknown EID returned %v", err)
+	}
+
+	err = c.Write(address, 1, true)
+	if err != nil {
+		t.Fatalf("write relay failed: %s", err)
+	}
+	pi, err := c.Query(address, 1)
+	if err != nil || pi.Data != true {
+		t.Errorf("query relay returned %+v, %v", pi, err)
+	}
+
+	pi, err = c.Query(address, 0)
+	if err != nil || pi.Data != uint32(1<<0|1<<1|1<<2) {
+		t.Errorf("query descriptor 0 returned %+v, %v", pi, err)
+	}
+	pi, err = c.Query(address, 32)
+	if err != nil || pi.Data != uint32(1<<0|1<<3) {
+		t.Errorf("query descriptor 32 returned %+v, %v", pi, err)
+	}
+
+	_, err = c.Query(address, 64)
+	if !errors.Is(err, Error(HXB_ERR_UNKNOWNEID)) {
+		t.Errorf("query descriptor 64 returned %v", err)
+	}
+
+	pei, err := c.EpQuery(address, 0)
+	if err != nil || pei.Data != "Test Plug" {
+		t.Errorf("endpoint query EID 0 returned %+v, %v", pei, err)
+	}
+
+	packet, _ := QueryPacket{FLAG_NONE, 1}.Bytes()
+	packet[len(packet)-1] ^= 0xff
+	reply := d.handlePacket(packet)
+	if reply != (ErrorPacket{FLAG_NONE, HXB_ERR_CRCFAILED}) {
+		t.Errorf("packet with wrong crc answered with %+v", reply)
+	}
+}
+
+func Test_DeviceProperties(t *testing.T) {
+	d, address := test_device(t)
+	defer d.Close()
+
+	c := &Client{Timeout: 200 * time.Millisecond}
+	defer c.Close()
+
+	err := c.SetProperty(address, 0, EP_PROP_DEVICE_NAME, "Kitchen Plug")
+	if err != nil {
+		t.Fatalf("rename device failed: %s", err)
+	}
+	pr, err := c.GetProperty(address, 0, EP_PROP_DEVICE_NAME)
+	if err != nil || pr.Data != "Kitchen Plug" || pr.Dtype != DTYPE_128STRING {
+		t.Errorf("device name returned %+v, %v", pr, err)
+	}
+	pei, err := c.EpQuery(address, 0)
+	if err != nil || pei.Data != "Kitchen Plug" {
+		t.Errorf("endpoint query EID 0 after rename returned %+v, %v", pei, err)
+	}
+
+	err = c.SetProperty(address, 1, EP_PROP_NAME, "Relay")
+	if err != nil {
+		t.Fatalf("rename endpoint failed: %s", err)
+	}
+	pr, err = c.GetProperty(address, 1, EP_PROP_NAME)
+	if err != nil || pr.Data != "Relay" {
+		t.Errorf("endpoint name returned %+v, %v", pr, err)
+	}
+
+	failures := []struct {
+		name string
+		err  error
+		code Error
+	}{
+		{"set unit", c.SetProperty(address, 1, EP_PROP_UNIT, "W"), HXB_ERR_WRITEREADONLY},
+		{"set name of unknown EID", c.SetProperty(address, 7, EP_PROP_NAME, "Nothing"), HXB_ERR_UNKNOWNEID},
+		{"set name with wrong data type", c.SetProperty(address, 1, EP_PROP_NAME, uint8(1)), HXB_ERR_DATATYPE},
+	}
+	for _, v := range failures {
+		if !errors.Is(v.err, v.code) {
+			t.Errorf("%s returned %v, expected %v", v.name, v.err, v.code)
+		}
+	}
+	_, err = c.GetProperty(address, 1, EP_PROP_UNIT)
+	if !errors.Is(err, Error(HXB_ERR_INVALID_VALUE)) {
+		t.Errorf("query of unsupported property returned %v", err)
+	}
+}
+
+func Test_ClientSet(t *testing.T) {
+	d, address := test_device(t)
+	defer d.Close()
+
+	c := &Client{Timeout: 200 * time.Millisecond}
+	defer c.Close()
+
+	err := c.Set(address, 1, "on")
+	if err != nil {
+		t.Fatalf("Set relay failed: %s", err)
+	}
+	pi, err := c.Query(address, 1)
+	if err != nil || pi.Data != true {
+		t.Errorf("query relay after Set returned %+v, %v", pi, err)
+	}
+	dtype, ok := c.dtypes[c.dtypeKey(context.Background(), address, 1)]
+	if !ok || dtype != DTYPE_BOOL {
+		t.Errorf("data type of EID 1 was not cached")
+	}
+
+	// the dimmer is UInt8 and rejects every value
+	err = c.Set(address, 35, 1.0)
+	if !errors.Is(err, Error(HXB_ERR_INVALID_VALUE)) {
+		t.Errorf("Set dimmer returned %v", err)
+	}
+	invalid := []struct {
+		data interface{}
+		err  error
+	}{
+		{300, Error(ERR_VALUERANGE)},
+		{"-1", Error(ERR_VALUERANGE)},
+		{0.5, Error(HXB_ERR_DATATYPE)},
+		{true, Error(HXB_ERR_DATATYPE)},
+	}
+	for _, v := range invalid {
+		err := c.Set(address, 35, v.data)
+		eid_err, ok := err.(*EidError)
+		if !ok || eid_err.Eid != 35 || eid_err.Err != v.err {
+			t.Errorf("Set dimmer to %#v returned %v, expected %v", v.data, err, v.err)
+		}
+	}
+
+	err = c.Set(address, 7, 1)
+	if !errors.Is(err, Error(HXB_ERR_UNKNOWNEID)) {
+		t.Errorf("Set unknown EID returned %v", err)
+	}
+}
+
+func Test_DeviceQueryEids(t *testing.T) {
+	d, address := test_device(t)
+	defer d.Close()
+
+	c := &Client{Timeout: 200 * time.Millisecond}
+	defer c.Close()
+
+	eids, err := c.QueryEids(address, 256)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	expected := []EID{
+		{0, DTYPE_UINT32, "Test Plug", false},
+		{1, DTYPE_BOOL, "Main Switch", true},
+		{2, DTYPE_UINT32, "Power Meter", false},
+		{32, DTYPE_UINT32, "Device Descriptor", false},
+		{35, DTYPE_UINT8, "Dimmer", true},
+	}
+	if len(eids) != len(expected) {
+		t.Fatalf("QueryEids returned %+v, expected %+v", eids, expected)
+	}
+	for i := range eids {
+		if eids[i] != expected[i] {
+			t.Errorf("QueryEids returned %+v, expected %+v", eids[i], expected[i])
+		}
+	}
+}
+
+// device whose Write handlers fail the test
+func probe_device(t *testing.T) *Device {
+	d := NewDevice("Probe Plug")
+	write := func(data interface{}) error {
+		t.Errorf("Write handler called with %v", data)
+		return nil
+	}
+	d.Register(Endpoint{Eid: 1, Dtype: DTYPE_BOOL, Desc: "Main Switch", Read: func() (interface{}, error) { return true, nil }, Write: write})
+	d.Register(Endpoint{Eid: 2, Dtype: DTYPE_UINT32, Desc: "Power Meter", Read: func() (interface{}, error) { return uint32(1), nil }})
+	d.Register(Endpoint{Eid: 9, Dtype: DTYPE_UINT8, Desc: "Dimmer", Read: func() (interface{}, error) { return uint8(0), nil }, Write: write})
+	return d
+}
+
+func Test_QueryEidsProperty(t *testing.T) {
+	d := probe_device(t)
+	conn, err := net.ListenUDP("udp6", &net.UDPAddr{IP: net.IPv6loopback})
+	if err != nil {
+		t.Skipf("no udp6 loopback: %s", err)
+	}
+	go d.Serve(conn)
+	defer d.Close()
+
+	// the probe of the call overrides the one of the client
+	c := &Client{Timeout: 200 * time.Millisecond, Probe: PROBE_WRITE}
+	defer c.Close()
+
+	eids, err := c.QueryEidsProbe(context.Background(), conn.LocalAddr().String(), 32, PROBE_PROPERTY)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	writable := map[uint32]bool{0: false, 1: true, 2: false, 9: true}
+	if len(eids) != len(writable) {
+		t.Fatalf("QueryEids returned %+v", eids)
+	}
+	for _, eid := range eids {
+		if eid.Writable != writable[eid.Eid] {
+			t.Errorf("EID %d reported writable %t", eid.Eid, eid.Writable)
+		}
+	}
+}
+
+// serve d on a loopback socket, dropping the property queries for which
+// ignore returns true
+func ignoring_device(t *testing.T, d *Device, ignore func(eid uint32) bool) *net.UDPConn {
+	conn, err := net.ListenUDP("udp6", &net.UDPAddr{IP: net.IPv6loopback})
+	if err != nil {
+		t.Skipf("no udp6 loopback: %s", err)
+	}
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, raddr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if p, err := Decode(buf[:n]); err == nil {
+				if q, ok := p.(*EpPropQueryPacket); ok && ignore(q.Eid) {
+					continue
+				}
+			}
+			if reply := d.handlePacket(buf[:n]); reply != nil {
+				packet, _ := reply.Bytes()
+				conn.WriteTo(packet, raddr)
+			}
+		}
+	}()
+	return conn
+}
+
+func Test_QueryEidsCatalog(t *testing.T) {
+	// old firmware ignores endpoint property queries
+	conn := ignoring_device(t, probe_device(t), func(uint32) bool { return true })
+	defer conn.Close()
+
+	c := &Client{Timeout: 200 * time.Millisecond, Probe: PROBE_PROPERTY, Catalog: map[uint32]EID{1: {1, DTYPE_BOOL, "Main Switch", true}, 9: {9, DTYPE_UINT8, "Dimmer", true}}}
+	defer c.Close()
+
+	start := time.Now()
+	eids, err := c.QueryEids(conn.LocalAddr().String(), 32)
+	var eid_errors EidErrors
+	if !errors.As(err, &eid_errors) {
+		t.Fatalf("%s", err)
+	}
+	// the power meter isn't in the catalog and returned read only
+	writable := map[uint32]bool{0: false, 1: true, 2: false, 9: true}
+	if len(eids) != len(writable) {
+		t.Fatalf("QueryEids returned %+v", eids)
+	}
+	for _, eid := range eids {
+		if eid.Writable != writable[eid.Eid] {
+			t.Errorf("EID %d reported writable %t", eid.Eid, eid.Writable)
+		}
+	}
+	var eid_err *EidError
+	if len(eid_errors) != 1 || !errors.As(err, &eid_err) || eid_err.Eid != 2 || !errors.Is(err, Error(ERR_UNCATALOGED)) {
+		t.Errorf("QueryEids failed with %v", err)
+	}
+	if time.Since(start) > time.Duration(PROPERTY_TIMEOUTS+1)*200*time.Millisecond {
+		t.Errorf("property query was retried after the device showed no support")
+	}
+}
+
+func Test_QueryEidsPropertyTimeout(t *testing.T) {
+	// the property query of the power meter gets lost
+	conn := ignoring_device(t, probe_device(t), func(eid uint32) bool { return eid == 2 })
+	defer conn.Close()
+
+	// a catalog fallback would report the dimmer read only
+	c := &Client{Timeout: 200 * time.Millisecond, Probe: PROBE_PROPERTY, Catalog: map[uint32]EID{9: {9, DTYPE_UINT8, "Dimmer", false}}}
+	defer c.Close()
+
+	eids, eid_errors, err := c.scanEids(context.Background(), conn.LocalAddr().String(), 32, c.Probe)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	writable := map[uint32]bool{0: false, 1: true, 2: false, 9: true}
+	if len(eids) != len(writable) {
+		t.Fatalf("QueryEids returned %+v", eids)
+	}
+	for _, eid := range eids {
+		if eid.Writable != writable[eid.Eid] {
+			t.Errorf("EID %d reported writable %t", eid.Eid, eid.Writable)
+		}
+	}
+	var opErr *OpError
+	if len(eid_errors) != 1 || eid_errors[0].Eid != 2 || !errors.As(eid_errors[0].Err, &opErr) || !opErr.Timeout() {
+		t.Errorf("QueryEids failed with %v", eid_errors)
+	}
+}
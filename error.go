@@ -1,6 +1,10 @@
 package hexabus
 
-import "strconv"
+import (
+	"errors"
+	"net"
+	"strconv"
+)
 
 // Error type structure to hold err.id. err.msg and optional err.err.
 type Error int
@@ -18,6 +22,83 @@ func (e Error) Error() string {
 	return str
 }
 
+// LengthError is returned for packets that are truncated or longer than
+// their packet type and payload data type allow. errors.Is reports it as
+// Error(ERR_PKTLENGTH).
+type LengthError struct {
+	Ptype    byte // packet type, only valid if the packet is longer than 4 bytes
+	Dtype    byte // data type of the payload, DTYPE_UNDEFINED if there is none or it is unknown
+	Length   int  // length of the received packet
+	Expected int  // expected length, the minimum if the data type is unknown
+}
+
+func (e *LengthError) Error() string {
+	str := "packet"
+	if e.Length > 4 {
+		str = PtypeName(e.Ptype) + " packet"
+	}
+	if e.Dtype != DTYPE_UNDEFINED {
+		str += " with " + DtypeName(e.Dtype) + " payload"
+	}
+	return str + " has " + strconv.Itoa(e.Length) + " bytes, expected " + strconv.Itoa(e.Expected)
+}
+
+func (e *LengthError) Is(target error) bool {
+	return target == Error(ERR_PKTLENGTH)
+}
+
+// RemoteError is an Error Packet a device answered a request with.
+// errors.Is and errors.As see the HXB_ERR_* code as Error.
+type RemoteError struct {
+	Addr  string // address of the device
+	Eid   uint32 // EID of the request
+	Ptype byte   // packet type of the request
+	Code  Error  // error code of the Error Packet
+}
+
+func (e *RemoteError) Error() string {
+	return requestString(e.Addr, e.Eid, e.Ptype) + ": " + e.Code.Error()
+}
+
+func (e *RemoteError) Unwrap() error {
+	return e.Code
+}
+
+// OpError is a request that failed on the local side, because the packet
+// could not be encoded or sent, the address could not be resolved or the
+// device didn't answer in time. Err is the underlying error, an Error for
+// encoder failures and ERR_NOACK or a net.Error otherwise.
+type OpError struct {
+	Addr  string // address of the device
+	Eid   uint32 // EID of the request
+	Ptype byte   // packet type of the request
+	Err   error  // underlying error
+}
+
+func (e *OpError) Error() string {
+	return requestString(e.Addr, e.Eid, e.Ptype) + ": " + e.Err.Error()
+}
+
+func (e *OpError) Unwrap() error {
+	return e.Err
+}
+
+// Timeout reports if the device didn't answer in time.
+func (e *OpError) Timeout() bool {
+	var netErr net.Error
+	return errors.As(e.Err, &netErr) && netErr.Timeout()
+}
+
+// Temporary is only there to implement net.Error.
+func (e *OpError) Temporary() bool {
+	return e.Timeout()
+}
+
+// prefix of request errors: address, packet type and EID
+func requestString(addr string, eid uint32, ptype byte) string {
+	return addr + ": " + PtypeName(ptype) + " eid " + strconv.FormatUint(uint64(eid), 10)
+}
+
 var error_message = map[Error]string{
 	// Hexanus packet errors
 	HXB_ERR_SUCCESS:       "hexabus packet error success",
@@ -28,31 +109,43 @@ var error_message = map[Error]string{
 	HXB_ERR_INVALID_VALUE: "hexabus packet value can not be interpreted",
 
 	// internal errors
-	ERR_STRBUFF:   "strings must be 127 bytes",
-	ERR_STRNOTERM: "string is not 0 terminated",
-	ERR_BYTESIZE:  "only bytes with 16 or 65 bit length are allowed",
-	ERR_HXBDTYPE:  "unsuported hexbus data type",
-	ERR_BOOLTYPE:  "bool can only be 0x00 or 0x01",
-	ERR_CRCFAILED: "checksum mismatch",
+	ERR_STRBUFF:    "strings must be 127 bytes",
+	ERR_STRNOTERM:  "string is not 0 terminated",
+	ERR_BYTESIZE:   "only bytes with 16 or 65 bit length are allowed",
+	ERR_HXBDTYPE:   "unsuported hexbus data type",
+	ERR_BOOLTYPE:   "bool can only be 0x00 or 0x01",
+	ERR_CRCFAILED:  "checksum mismatch",
+	ERR_VALUERANGE: "value out of range for data type",
 
 	// internal network errors
 	ERR_WRONGHEADER:  "wrong packet header",
 	ERR_UNKNOWNPTYPE: "unknown packet type",
 	ERR_ERRPACKET:    "received error packet with value",
+	ERR_PKTLENGTH:    "packet length does not match packet type",
+	ERR_PREFIXSIZE:   "prefix too large to sweep",
+	ERR_NOACK:        "packet was not acknowledged",
+	ERR_NAK:          "device rejected the data",
+	ERR_UNCATALOGED:  "writability unknown, no property support and not in catalog",
 }
 
 // Internal error codes.
 const (
 	// encoder/decoder errors
-	ERR_STRBUFF   = 0xa0
-	ERR_STRNOTERM = 0xa1
-	ERR_BYTESIZE  = 0xa2
-	ERR_HXBDTYPE  = 0xa3
-	ERR_BOOLTYPE  = 0xa4
-	ERR_CRCFAILED = 0xa5
+	ERR_STRBUFF    = 0xa0
+	ERR_STRNOTERM  = 0xa1
+	ERR_BYTESIZE   = 0xa2
+	ERR_HXBDTYPE   = 0xa3
+	ERR_BOOLTYPE   = 0xa4
+	ERR_CRCFAILED  = 0xa5
+	ERR_VALUERANGE = 0xa6
 
 	// network errors
 	ERR_WRONGHEADER  = 0xb0
 	ERR_UNKNOWNPTYPE = 0xb1
 	ERR_ERRPACKET    = 0xb2
+	ERR_PKTLENGTH    = 0xb3
+	ERR_PREFIXSIZE   = 0xb4
+	ERR_NOACK        = 0xb5
+	ERR_NAK          = 0xb6
+	ERR_UNCATALOGED  = 0xb7
 )
@@ -0,0 +1,239 @@
+// Package exporter exposes the values of Hexabus endpoints as Prometheus
+// metrics.
+//
+// Every numeric value received in an Info Packet, or polled with a Query
+// Packet, is exported as gauge
+//
+//	hexabus_value{device="fd00::1",eid="2",description="Power Meter"} 42
+//
+// in the Prometheus text format. Bool values are exported as 0 and 1,
+// Timestamps as seconds, other data types are skipped. The description is
+// queried from the device with an Endpoint Query once per endpoint, a
+// series is exported after the device answered it, with an empty
+// description if it answered with an Error Packet. A query that failed
+// otherwise, like by timeout, is repeated with the next update of the
+// series. Series that weren't updated for the expiry time are removed.
+package exporter
+
+import (
+	"context"
+	"errors"
+	"github.com/morriswinkler/hexabus"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Defaults used by the Exporter.
+const (
+	// name of the gauge
+	METRIC_NAME = "hexabus_value"
+
+	// series without update for this long are removed
+	EXPORTER_EXPIRY = 5 * time.Minute
+
+	// time between two polls of the Poll endpoints
+	EXPORTER_INTERVAL = 60 * time.Second
+)
+
+// Exporter collects endpoint values and serves them as Prometheus metrics.
+type Exporter struct {
+	// client for the polls and description queries, hexabus.DefaultClient
+	// if nil
+	Client *hexabus.Client
+
+	// EID's queried every Interval, keyed by device address
+	Poll map[string][]uint32
+
+	// time between two polls, EXPORTER_INTERVAL if zero
+	Interval time.Duration
+
+	// silence after which a series is removed, EXPORTER_EXPIRY if zero
+	Expiry time.Duration
+
+	mu     sync.Mutex
+	series map[series]*sample
+}
+
+// identity of a series
+type series struct {
+	device string
+	eid    uint32
+}
+
+// last value of a series
+type sample struct {
+	value     float64
+	updated   time.Time
+	desc      string
+	described bool // the device answered the description query
+	querying  bool // the description query is running
+}
+
+// Run records the Info Packets received by l and polls the Poll endpoints
+// until ctx is done, which is returned as ctx.Err(), or l is closed.
+func (e *Exporter) Run(ctx context.Context, l *hexabus.Listener) error {
+	ctx, cancel := context.WithCancel(ctx)
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	defer cancel()
+
+	if len(e.Poll) > 0 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			e.poll(ctx, &wg)
+		}()
+	}
+
+	for {
+		select {
+		case ev, ok := <-l.Events():
+			if !ok {
+				return nil
+			}
+			if p, ok := ev.Packet.(*hexabus.InfoPacket); ok {
+				e.record(ctx, &wg, hexabus.DeviceAddress(ev.Addr), p)
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// query the Poll endpoints right away and then every interval
+func (e *Exporter) poll(ctx context.Context, wg *sync.WaitGroup) {
+	interval := e.Interval
+	if interval <= 0 {
+		interval = EXPORTER_INTERVAL
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		for address, eids := range e.Poll {
+			for _, eid := range eids {
+				p, err := e.client().QueryContext(ctx, address, eid)
+				if err == nil {
+					e.record(ctx, wg, hexabus.NormalizeAddress(address), p)
+				}
+			}
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// store the value of an Info Packet and query the description of new series
+func (e *Exporter) record(ctx context.Context, wg *sync.WaitGroup, device string, p *hexabus.InfoPacket) {
+	value, ok := float(p.Data)
+	if !ok {
+		return
+	}
+	key := series{device, p.Eid}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.series == nil {
+		e.series = make(map[series]*sample)
+	}
+	s, ok := e.series[key]
+	if !ok {
+		s = &sample{}
+		e.series[key] = s
+	}
+	s.value, s.updated = value, time.Now()
+	if s.described || s.querying {
+		return
+	}
+	s.querying = true
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		info, err := e.client().EpQueryContext(ctx, device, key.eid)
+		var remote *hexabus.RemoteError
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		if e.series[key] != s {
+			// expired meanwhile
+			return
+		}
+		s.querying = false
+		if err == nil {
+			s.desc, _ = info.Data.(string)
+			s.described = true
+		} else if errors.As(err, &remote) {
+			s.described = true
+		}
+	}()
+}
+
+// ServeHTTP writes the current values in the Prometheus text format.
+func (e *Exporter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	expiry := e.Expiry
+	if expiry <= 0 {
+		expiry = EXPORTER_EXPIRY
+	}
+
+	var lines []string
+	e.mu.Lock()
+	for key, s := range e.series {
+		if time.Since(s.updated) > expiry {
+			delete(e.series, key)
+			continue
+		}
+		if !s.described {
+			continue
+		}
+		lines = append(lines, METRIC_NAME+"{device="+label(key.device)+",eid=\""+strconv.FormatUint(uint64(key.eid), 10)+"\",description="+label(s.desc)+"} "+strconv.FormatFloat(s.value, 'g', -1, 64))
+	}
+	e.mu.Unlock()
+	sort.Strings(lines)
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write([]byte("# HELP " + METRIC_NAME + " Last value of a Hexabus endpoint.\n# TYPE " + METRIC_NAME + " gauge\n"))
+	for _, line := range lines {
+		w.Write([]byte(line + "\n"))
+	}
+}
+
+func (e *Exporter) client() *hexabus.Client {
+	if e.Client == nil {
+		return hexabus.DefaultClient
+	}
+	return e.Client
+}
+
+// numeric value of the data of an Info Packet, Bools are 0 and 1. 64 bit
+// integers are rounded to the nearest float64.
+func float(data interface{}) (float64, bool) {
+	if b, ok := data.(bool); ok {
+		if b {
+			return 1, true
+		}
+		return 0, true
+	}
+	v, err := hexabus.NewValue(hexabus.DTYPE_DOUBLE, data)
+	if err == nil {
+		return v.Data.(float64), true
+	}
+	if i, err := hexabus.NewValue(hexabus.DTYPE_INT64, data); err == nil {
+		return float64(i.Data.(int64)), true
+	}
+	if u, err := hexabus.NewValue(hexabus.DTYPE_UINT64, data); err == nil {
+		return float64(u.Data.(uint64)), true
+	}
+	return 0, false
+}
+
+// quoted label value
+func label(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, "\n", `\n`)
+	return `"` + strings.ReplaceAll(s, `"`, `\"`) + `"`
+}
@@ -0,0 +1,139 @@
+package exporter
+
+import (
+	"context"
+	"github.com/morriswinkler/hexabus"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func Test_Exporter(t *testing.T) {
+	conn, err := net.ListenUDP("udp6", &net.UDPAddr{IP: net.IPv6loopback})
+	if err != nil {
+		t.Skipf("no udp6 loopback: %s", err)
+	}
+	d := hexabus.NewDevice("Plug")
+	for _, ep := range []hexabus.Endpoint{
+		{Eid: 1, Dtype: hexabus.DTYPE_BOOL, Desc: "Main Switch", Read: func() (interface{}, error) { return true, nil }},
+		{Eid: 2, Dtype: hexabus.DTYPE_UINT32, Desc: "Power \"Meter\"", Read: func() (interface{}, error) { return uint32(42), nil }},
+		{Eid: 3, Dtype: hexabus.DTYPE_FLOAT, Desc: "Temperature", Read: func() (interface{}, error) { return float32(21.5), nil }},
+		{Eid: 4, Dtype: hexabus.DTYPE_128STRING, Desc: "Name", Read: func() (interface{}, error) { return "plug", nil }},
+		{Eid: 5, Dtype: hexabus.DTYPE_UINT64, Desc: "Energy", Read: func() (interface{}, error) { return uint64(1<<63 + 1), nil }},
+	} {
+		d.Register(ep)
+	}
+	go d.Serve(conn)
+	defer d.Close()
+	address := conn.LocalAddr().String()
+
+	lconn, err := net.ListenUDP("udp6", &net.UDPAddr{IP: net.IPv6loopback})
+	if err != nil {
+		t.Fatalf("ListenUDP failed: %s", err)
+	}
+	l := hexabus.NewListener(lconn)
+	defer l.Close()
+
+	client := &hexabus.Client{Timeout: 100 * time.Millisecond}
+	defer client.Close()
+	e := &Exporter{
+		Client:   client,
+		Poll:     map[string][]uint32{address: {3}},
+		Interval: time.Hour,
+		Expiry:   500 * time.Millisecond,
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- e.Run(ctx, l) }()
+
+	for _, p := range []hexabus.InfoPacket{
+		{Eid: 1, Dtype: hexabus.DTYPE_BOOL, Data: true},
+		{Eid: 2, Dtype: hexabus.DTYPE_UINT32, Data: uint32(42)},
+		{Eid: 4, Dtype: hexabus.DTYPE_128STRING, Data: "plug"},
+		{Eid: 5, Dtype: hexabus.DTYPE_UINT64, Data: uint64(1<<63 + 1)},
+	} {
+		packet, _ := p.Bytes()
+		conn.WriteTo(packet, lconn.LocalAddr())
+	}
+
+	scrape := func() string {
+		w := httptest.NewRecorder()
+		e.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+		if w.Header().Get("Content-Type") != "text/plain; version=0.0.4; charset=utf-8" {
+			t.Errorf("metrics have content type %q", w.Header().Get("Content-Type"))
+		}
+		return w.Body.String()
+	}
+	header := "# HELP hexabus_value Last value of a Hexabus endpoint.\n# TYPE hexabus_value gauge\n"
+	expected := header +
+		`hexabus_value{device="` + address + `",eid="1",description="Main Switch"} 1` + "\n" +
+		`hexabus_value{device="` + address + `",eid="2",description="Power \"Meter\""} 42` + "\n" +
+		`hexabus_value{device="` + address + `",eid="3",description="Temperature"} 21.5` + "\n" +
+		`hexabus_value{device="` + address + `",eid="5",description="Energy"} 9.223372036854776e+18` + "\n"
+	var metrics string
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if metrics = scrape(); metrics == expected {
+			break
+		}
+	}
+	if metrics != expected {
+		t.Errorf("metrics are\n%s\nexpected\n%s", metrics, expected)
+	}
+
+	time.Sleep(600 * time.Millisecond)
+	if metrics = scrape(); metrics != header {
+		t.Errorf("expired metrics are\n%s", metrics)
+	}
+
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Errorf("Run returned %v", err)
+	}
+}
+
+func Test_ExporterDescribe(t *testing.T) {
+	conn, err := net.ListenUDP("udp6", &net.UDPAddr{IP: net.IPv6loopback})
+	if err != nil {
+		t.Skipf("no udp6 loopback: %s", err)
+	}
+	address := conn.LocalAddr().String()
+	client := &hexabus.Client{Timeout: 100 * time.Millisecond}
+	defer client.Close()
+	e := &Exporter{Client: client}
+	var wg sync.WaitGroup
+	p := &hexabus.InfoPacket{Eid: 2, Dtype: hexabus.DTYPE_UINT32, Data: uint32(42)}
+
+	// the device doesn't answer yet, the series waits for its description
+	e.record(context.Background(), &wg, address, p)
+	wg.Wait()
+	w := httptest.NewRecorder()
+	e.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if strings.Contains(w.Body.String(), "eid=") {
+		t.Errorf("undescribed series exported:\n%s", w.Body.String())
+	}
+
+	// the next update queries the description again
+	d := hexabus.NewDevice("Plug")
+	d.Register(hexabus.Endpoint{Eid: 2, Dtype: hexabus.DTYPE_UINT32, Desc: "Power Meter", Read: func() (interface{}, error) { return uint32(42), nil }})
+	go d.Serve(conn)
+	defer d.Close()
+	e.record(context.Background(), &wg, address, p)
+	wg.Wait()
+	w = httptest.NewRecorder()
+	e.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if !strings.Contains(w.Body.String(), `hexabus_value{device="`+address+`",eid="2",description="Power Meter"} 42`) {
+		t.Errorf("metrics after the retry are\n%s", w.Body.String())
+	}
+
+	// an Error Packet is an answer, the series is exported without description
+	e.record(context.Background(), &wg, address, &hexabus.InfoPacket{Eid: 3, Dtype: hexabus.DTYPE_UINT32, Data: uint32(7)})
+	wg.Wait()
+	w = httptest.NewRecorder()
+	e.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if !strings.Contains(w.Body.String(), `hexabus_value{device="`+address+`",eid="3",description=""} 7`) {
+		t.Errorf("metrics of an unknown endpoint are\n%s", w.Body.String())
+	}
+}
@@ -0,0 +1,372 @@
+// Package gateway exposes Hexabus devices and their endpoints over HTTP.
+//
+//	GET /devices                  configured devices and devices heard on multicast
+//	GET /devices/{addr}/eids      endpoints of a device, see hexabus.QueryEids
+//	GET /devices/{addr}/eids/{eid}  value of an endpoint
+//	PUT /devices/{addr}/eids/{eid}  write a value to an endpoint
+//	GET /events                   server-sent events of received Info Packets
+//
+// Values are JSON encoded hexabus.Value like {"datatype":"Bool","value":true}.
+// A PUT body in this encoding is written with its data type, any other body
+// like on, 1 or 21.5 is converted to the data type of the endpoint, see
+// hexabus.Client.Set. Every event is an Info Packet in the JSON encoding of
+// hexabus.InfoPacket with the sender added as "source".
+//
+// The endpoint list leaves out EID's that failed and lists EID's whose
+// writability is unknown read only, see hexabus.QueryEids. It is queried
+// with hexabus.PROBE_PROPERTY whatever the Probe of the client is, a GET
+// must not write to the device.
+//
+// Errors are returned as {"error":"..."} with a status code for the cause,
+// see StatusCode.
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/morriswinkler/hexabus"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Defaults used by the Server.
+const (
+	// EID's queried for /devices/{addr}/eids
+	GATEWAY_EIDS = 256
+
+	// largest accepted PUT body
+	MAX_BODY = 1024
+
+	// buffered events per stream, a client that falls further behind misses
+	// events
+	EVENT_BUFFER = 64
+
+	// time after which devices that weren't heard again are forgotten
+	DEVICE_EXPIRY = 24 * time.Hour
+)
+
+// Server is an http.Handler for the Hexabus devices reachable by Client.
+// Run has to be called to learn about devices and stream events.
+type Server struct {
+	// client talking to the devices, hexabus.DefaultClient if nil
+	Client *hexabus.Client
+
+	// devices listed by /devices even if they weren't heard yet
+	Devices []string
+
+	// EID's queried for the endpoint list, GATEWAY_EIDS if zero
+	EidQty uint16
+
+	// devices not heard for longer are no longer listed, unless they are in
+	// Devices, DEVICE_EXPIRY if zero
+	Expiry time.Duration
+
+	mu      sync.Mutex
+	heard   map[string]time.Time
+	streams map[chan []byte]struct{}
+}
+
+// Device as listed by /devices.
+type Device struct {
+	Address string     `json:"address"`
+	Heard   *time.Time `json:"heard,omitempty"` // last packet received
+}
+
+// Run records the senders of the packets received by l and streams their
+// Info Packets to the /events clients until ctx is done, which is returned
+// as ctx.Err(), or l is closed.
+func (s *Server) Run(ctx context.Context, l *hexabus.Listener) error {
+	for {
+		select {
+		case ev, ok := <-l.Events():
+			if !ok {
+				return nil
+			}
+			if ev.Err != nil {
+				continue
+			}
+			source := hexabus.DeviceAddress(ev.Addr)
+			s.hear(source)
+			if p, ok := ev.Packet.(*hexabus.InfoPacket); ok {
+				s.broadcast(source, p)
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// record that source was heard, expired devices are dropped whenever a new
+// one shows up
+func (s *Server) hear(source string) {
+	expiry := s.Expiry
+	if expiry <= 0 {
+		expiry = DEVICE_EXPIRY
+	}
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.heard == nil {
+		s.heard = make(map[string]time.Time)
+	}
+	if _, ok := s.heard[source]; !ok {
+		for address, heard := range s.heard {
+			if now.Sub(heard) > expiry {
+				delete(s.heard, address)
+			}
+		}
+	}
+	s.heard[source] = now
+}
+
+// hand an Info Packet to every event stream
+func (s *Server) broadcast(source string, p *hexabus.InfoPacket) {
+	b, err := json.Marshal(p)
+	if err != nil {
+		return
+	}
+	obj := map[string]json.RawMessage{}
+	err = json.Unmarshal(b, &obj)
+	if err != nil {
+		return
+	}
+	obj["source"], _ = json.Marshal(source)
+	b, _ = json.Marshal(obj)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for stream := range s.streams {
+		select {
+		case stream <- b:
+		default:
+		}
+	}
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case len(path) == 1 && path[0] == "devices":
+		if allow(w, r, http.MethodGet) {
+			s.devices(w)
+		}
+	case len(path) == 1 && path[0] == "events":
+		if allow(w, r, http.MethodGet) {
+			s.events(w, r)
+		}
+	case len(path) == 3 && path[0] == "devices" && path[2] == "eids":
+		if allow(w, r, http.MethodGet) {
+			s.eids(w, r, path[1])
+		}
+	case len(path) == 4 && path[0] == "devices" && path[2] == "eids":
+		eid, err := strconv.ParseUint(path[3], 10, 32)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid eid "+path[3])
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			s.get(w, r, path[1], uint32(eid))
+		case http.MethodPut:
+			s.put(w, r, path[1], uint32(eid))
+		default:
+			allow(w, r, http.MethodGet, http.MethodPut)
+		}
+	default:
+		writeError(w, http.StatusNotFound, "not found")
+	}
+}
+
+// GET /devices, configured devices are listed the way packets are received
+// from them
+func (s *Server) devices(w http.ResponseWriter) {
+	expiry := s.Expiry
+	if expiry <= 0 {
+		expiry = DEVICE_EXPIRY
+	}
+	devices := map[string]*Device{}
+	for _, address := range s.Devices {
+		address = hexabus.NormalizeAddress(address)
+		devices[address] = &Device{Address: address}
+	}
+	s.mu.Lock()
+	for address, heard := range s.heard {
+		if time.Since(heard) > expiry {
+			continue
+		}
+		heard := heard
+		devices[address] = &Device{Address: address, Heard: &heard}
+	}
+	s.mu.Unlock()
+
+	list := []*Device{}
+	for _, d := range devices {
+		list = append(list, d)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Address < list[j].Address })
+	writeJSON(w, http.StatusOK, list)
+}
+
+// GET /devices/{addr}/eids
+func (s *Server) eids(w http.ResponseWriter, r *http.Request, address string) {
+	qty := s.EidQty
+	if qty == 0 {
+		qty = GATEWAY_EIDS
+	}
+	eids, err := s.client().QueryEidsProbe(r.Context(), address, qty, hexabus.PROBE_PROPERTY)
+	var eid_errors hexabus.EidErrors
+	if err != nil && !errors.As(err, &eid_errors) {
+		writeDeviceError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, eids)
+}
+
+// GET /devices/{addr}/eids/{eid}
+func (s *Server) get(w http.ResponseWriter, r *http.Request, address string, eid uint32) {
+	p, err := s.client().QueryContext(r.Context(), address, eid)
+	if err != nil {
+		writeDeviceError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, hexabus.Value{Dtype: p.Dtype, Data: p.Data})
+}
+
+// PUT /devices/{addr}/eids/{eid}
+func (s *Server) put(w http.ResponseWriter, r *http.Request, address string, eid uint32) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, MAX_BODY+1))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if len(body) > MAX_BODY {
+		writeError(w, http.StatusRequestEntityTooLarge, "body larger than "+strconv.Itoa(MAX_BODY)+" bytes")
+		return
+	}
+
+	var v hexabus.Value
+	if json.Unmarshal(body, &v) == nil {
+		err = s.client().WriteContext(r.Context(), address, eid, v)
+	} else {
+		err = s.client().SetContext(r.Context(), address, eid, strings.TrimSpace(string(body)))
+	}
+	if err != nil {
+		writeDeviceError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GET /events
+func (s *Server) events(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, "streaming not supported")
+		return
+	}
+	stream := make(chan []byte, EVENT_BUFFER)
+	s.mu.Lock()
+	if s.streams == nil {
+		s.streams = make(map[chan []byte]struct{})
+	}
+	s.streams[stream] = struct{}{}
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.streams, stream)
+		s.mu.Unlock()
+	}()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	for {
+		select {
+		case b := <-stream:
+			_, err := w.Write([]byte("event: info\ndata: " + string(b) + "\n\n"))
+			if err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func (s *Server) client() *hexabus.Client {
+	if s.Client == nil {
+		return hexabus.DefaultClient
+	}
+	return s.Client
+}
+
+// check the request method, 405 is written if it isn't allowed
+func allow(w http.ResponseWriter, r *http.Request, methods ...string) bool {
+	for _, m := range methods {
+		if r.Method == m {
+			return true
+		}
+	}
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	writeError(w, http.StatusMethodNotAllowed, "method "+r.Method+" not allowed")
+	return false
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(append(b, '\n'))
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	b, _ := json.Marshal(map[string]string{"error": msg})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(append(b, '\n'))
+}
+
+// write the failure of a request to a device with the status code of its
+// cause
+func writeDeviceError(w http.ResponseWriter, err error) {
+	writeError(w, StatusCode(err), err.Error())
+}
+
+// StatusCode maps the errors of hexabus.Client requests to HTTP status codes:
+// 404 for HXB_ERR_UNKNOWNEID, 403 for HXB_ERR_WRITEREADONLY, 422 for
+// HXB_ERR_DATATYPE and values that don't fit the endpoint, 400 for
+// HXB_ERR_INVALID_VALUE, 504 if the device didn't answer and 502 for
+// anything else.
+func StatusCode(err error) int {
+	var eidErr *hexabus.EidError
+	var netErr net.Error
+	switch {
+	case errors.Is(err, hexabus.Error(hexabus.HXB_ERR_UNKNOWNEID)):
+		return http.StatusNotFound
+	case errors.Is(err, hexabus.Error(hexabus.HXB_ERR_WRITEREADONLY)):
+		return http.StatusForbidden
+	case errors.Is(err, hexabus.Error(hexabus.HXB_ERR_DATATYPE)), errors.As(err, &eidErr):
+		return http.StatusUnprocessableEntity
+	case errors.Is(err, hexabus.Error(hexabus.HXB_ERR_INVALID_VALUE)):
+		return http.StatusBadRequest
+	case errors.Is(err, context.Canceled):
+		// the client went away, nobody reads the status
+		return http.StatusServiceUnavailable
+	case errors.As(err, &netErr) && netErr.Timeout(), errors.Is(err, hexabus.Error(hexabus.ERR_NOACK)):
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusBadGateway
+}
@@ -0,0 +1,185 @@
+package gateway
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"github.com/morriswinkler/hexabus"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func Test_Gateway(t *testing.T) {
+	// hexabus device with a relay and a temperature sensor
+	conn, err := net.ListenUDP("udp6", &net.UDPAddr{IP: net.IPv6loopback})
+	if err != nil {
+		t.Skipf("no udp6 loopback: %s", err)
+	}
+	d := hexabus.NewDevice("Gateway")
+	relay := false
+	d.Register(hexabus.Endpoint{Eid: 1, Dtype: hexabus.DTYPE_BOOL, Desc: "Relay",
+		Read:  func() (interface{}, error) { return relay, nil },
+		Write: func(v interface{}) error { relay = v.(bool); return nil }})
+	d.Register(hexabus.Endpoint{Eid: 3, Dtype: hexabus.DTYPE_FLOAT, Desc: "Temperature",
+		Read: func() (interface{}, error) { return float32(21.5), nil }})
+	var writes int32
+	go d.Serve(counting{conn, &writes})
+	defer d.Close()
+	address := conn.LocalAddr().String()
+
+	lconn, err := net.ListenUDP("udp6", &net.UDPAddr{IP: net.IPv6loopback})
+	if err != nil {
+		t.Fatalf("ListenUDP failed: %s", err)
+	}
+	l := hexabus.NewListener(lconn)
+	defer l.Close()
+
+	client := &hexabus.Client{Timeout: 100 * time.Millisecond}
+	defer client.Close()
+	// other notations of the same devices are listed once
+	s := &Server{Client: client, Devices: []string{"fd00::1", "[fd00:0::1]:61616", "[0:0" + address[1:]}, EidQty: 8}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.Run(ctx, l)
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	request := func(method, path, body string) (int, string) {
+		t.Helper()
+		req, _ := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s failed: %s", method, path, err)
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, strings.TrimSpace(string(b))
+	}
+
+	// the stream is subscribed once the headers arrived
+	resp, err := http.Get(ts.URL + "/events")
+	if err != nil {
+		t.Fatalf("GET /events failed: %s", err)
+	}
+	defer resp.Body.Close()
+	if resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Errorf("events have content type %q", resp.Header.Get("Content-Type"))
+	}
+	packet, _ := hexabus.InfoPacket{Eid: 3, Dtype: hexabus.DTYPE_FLOAT, Data: float32(21.5)}.Bytes()
+	conn.WriteTo(packet, lconn.LocalAddr())
+
+	events := bufio.NewReader(resp.Body)
+	lines := []string{}
+	for len(lines) < 3 {
+		line, err := events.ReadString('\n')
+		if err != nil {
+			t.Fatalf("reading events failed: %s", err)
+		}
+		lines = append(lines, strings.TrimSuffix(line, "\n"))
+	}
+	var ev map[string]interface{}
+	if lines[0] != "event: info" || json.Unmarshal([]byte(strings.TrimPrefix(lines[1], "data: ")), &ev) != nil || lines[2] != "" {
+		t.Fatalf("event %q", lines)
+	}
+	if ev["source"] != address || ev["eid"] != float64(3) || ev["value"] != 21.5 {
+		t.Errorf("event %v", ev)
+	}
+
+	status, body := request("GET", "/devices", "")
+	var devices []Device
+	if status != http.StatusOK || json.Unmarshal([]byte(body), &devices) != nil || len(devices) != 2 {
+		t.Fatalf("GET /devices returned %d %s", status, body)
+	}
+	if devices[0].Address != address || devices[0].Heard == nil || devices[1].Address != "fd00::1" || devices[1].Heard != nil {
+		t.Errorf("GET /devices returned %s", body)
+	}
+
+	// the endpoint list asks for the writable property instead of writing
+	status, body = request("GET", "/devices/"+address+"/eids", "")
+	expected := `[{"eid":0,"datatype":"UInt32","description":"Gateway","writable":false},{"eid":1,"datatype":"Bool","description":"Relay","writable":true},{"eid":3,"datatype":"Float","description":"Temperature","writable":false}]`
+	if status != http.StatusOK || body != expected {
+		t.Errorf("GET /devices/%s/eids returned %d %s, expected %s", address, status, body, expected)
+	}
+	if n := atomic.LoadInt32(&writes); n != 0 {
+		t.Errorf("GET /devices/%s/eids wrote %d times", address, n)
+	}
+
+	tests := []struct {
+		method string
+		path   string
+		body   string
+		status int
+		result string
+	}{
+		{"GET", "/devices/" + address + "/eids/3", "", 200, `{"datatype":"Float","value":21.5}`},
+		{"PUT", "/devices/" + address + "/eids/1", "on", 204, ""},
+		{"GET", "/devices/" + address + "/eids/1", "", 200, `{"datatype":"Bool","value":true}`},
+		{"PUT", "/devices/" + address + "/eids/1", `{"datatype":"Bool","value":false}`, 204, ""},
+		{"GET", "/devices/" + address + "/eids/1", "", 200, `{"datatype":"Bool","value":false}`},
+		{"GET", "/devices/" + address + "/eids/7", "", 404, ""},
+		{"PUT", "/devices/" + address + "/eids/3", "20", 403, ""},
+		{"PUT", "/devices/" + address + "/eids/1", `{"datatype":"UInt8","value":1}`, 422, ""},
+		{"PUT", "/devices/" + address + "/eids/1", "maybe", 422, ""},
+		{"PUT", "/devices/" + address + "/eids/1", strings.Repeat("1", MAX_BODY+1), 413, ""},
+		{"GET", "/devices/" + address + "/eids/x", "", 400, ""},
+		{"POST", "/devices/" + address + "/eids/1", "on", 405, ""},
+		{"GET", "/devices/" + address, "", 404, ""},
+	}
+	for _, test := range tests {
+		status, body := request(test.method, test.path, test.body)
+		if status != test.status || (test.result != "" && body != test.result) {
+			t.Errorf("%s %s returned %d %s, expected %d %s", test.method, test.path, status, body, test.status, test.result)
+		}
+		if status >= 400 && !strings.HasPrefix(body, `{"error":`) {
+			t.Errorf("%s %s returned error %s", test.method, test.path, body)
+		}
+	}
+}
+
+// connection counting the received Write Packets
+type counting struct {
+	net.PacketConn
+	writes *int32
+}
+
+func (c counting) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, addr, err := c.PacketConn.ReadFrom(b)
+	if p, e := hexabus.Decode(b[:n]); e == nil && p.PacketType() == hexabus.PTYPE_WRITE {
+		atomic.AddInt32(c.writes, 1)
+	}
+	return n, addr, err
+}
+
+func Test_DeviceExpiry(t *testing.T) {
+	s := &Server{Expiry: time.Minute}
+	s.heard = map[string]time.Time{"fd00::2": time.Now().Add(-2 * time.Minute), "fd00::3": time.Now()}
+	s.hear("fd00::4")
+	if _, ok := s.heard["fd00::2"]; ok || len(s.heard) != 2 {
+		t.Errorf("heard devices %v", s.heard)
+	}
+}
+
+func Test_StatusCode(t *testing.T) {
+	tests := []struct {
+		err    error
+		status int
+	}{
+		{&hexabus.RemoteError{Addr: "::1", Eid: 1, Ptype: hexabus.PTYPE_WRITE, Code: hexabus.Error(hexabus.HXB_ERR_UNKNOWNEID)}, 404},
+		{&hexabus.RemoteError{Addr: "::1", Eid: 1, Ptype: hexabus.PTYPE_WRITE, Code: hexabus.Error(hexabus.HXB_ERR_WRITEREADONLY)}, 403},
+		{&hexabus.RemoteError{Addr: "::1", Eid: 1, Ptype: hexabus.PTYPE_WRITE, Code: hexabus.Error(hexabus.HXB_ERR_DATATYPE)}, 422},
+		{&hexabus.RemoteError{Addr: "::1", Eid: 1, Ptype: hexabus.PTYPE_WRITE, Code: hexabus.Error(hexabus.HXB_ERR_INVALID_VALUE)}, 400},
+		{&hexabus.RemoteError{Addr: "::1", Eid: 1, Ptype: hexabus.PTYPE_WRITE, Code: hexabus.Error(hexabus.HXB_ERR_CRCFAILED)}, 502},
+		{&hexabus.OpError{Addr: "::1", Eid: 1, Ptype: hexabus.PTYPE_QUERY, Err: hexabus.Error(hexabus.ERR_NOACK)}, 504},
+	}
+	for _, test := range tests {
+		if status := StatusCode(test.err); status != test.status {
+			t.Errorf("%v mapped to %d, expected %d", test.err, status, test.status)
+		}
+	}
+}
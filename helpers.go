@@ -3,6 +3,8 @@ package hexabus
 import (
 	"bytes"
 	"encoding/binary"
+	"strconv"
+	"time"
 )
 
 // add Hexabus packet header
@@ -12,15 +14,34 @@ func addHeader(packet []byte) {
 
 // check if a received packet contains a valid Hexabus header
 func checkHeader(packet []byte) error {
+	if len(packet) < min_packet_length {
+		return &LengthError{Length: len(packet), Expected: min_packet_length}
+	}
 	if packet[0] == HEADER0 && packet[1] == HEADER1 && packet[2] == HEADER2 && packet[3] == HEADER3 {
 		return nil
 	}
 	return Error(0xb0)
 }
 
+// write the 4 byte endpoint id into packet[6:10]
+func encEid(packet []byte, eid uint32) {
+	binary.BigEndian.PutUint32(packet[6:10], eid)
+}
+
+// read the 4 byte endpoint id from packet[6:10]
+func decEid(packet []byte) uint32 {
+	return binary.BigEndian.Uint32(packet[6:10])
+}
+
 // set datatype and encode payload in bytes
 func encData(packet []byte, data interface{}) ([]byte, error) {
 	switch data := data.(type) {
+	case Value:
+		v, err := NewValue(data.Dtype, data.Data)
+		if err != nil {
+			return nil, err
+		}
+		return encData(packet, v.Data)
 	case bool:
 		packet[10] = DTYPE_BOOL
 		if data == true {
@@ -39,10 +60,14 @@ func encData(packet []byte, data interface{}) ([]byte, error) {
 		}
 		packet[10] = DTYPE_UINT32
 		packet = append(packet, buf.Bytes()...)
-	// DateTime: holds DTYPE_DATETIME data ; needs testing
+	// DateTime: holds DTYPE_DATETIME data
 	case DateTime:
+		err := data.Check()
+		if err != nil {
+			return nil, err
+		}
 		buf := new(bytes.Buffer)
-		err := binary.Write(buf, binary.BigEndian, data)
+		err = binary.Write(buf, binary.BigEndian, data)
 		if err != nil {
 			return nil, err
 		}
@@ -64,14 +89,15 @@ func encData(packet []byte, data interface{}) ([]byte, error) {
 		} else {
 			// TODO: check if 0 termination in string is right that way
 			packet[10] = DTYPE_128STRING
+			start := len(packet)
 			packet = append(packet, data...)
 			packet = append(packet, byte(0))
 
-			for len(packet[11:]) < 128 {
+			for len(packet[start:]) < 128 {
 				packet = append(packet, byte(0))
 			}
 		}
-		// TIMESTAMP: intended for type syscall.Sysinfo_t.Uptime not working
+		// TIMESTAMP: seconds since boot, see TimestampSince
 	case Timestamp:
 		buf := new(bytes.Buffer)
 		err := binary.Write(buf, binary.BigEndian, data)
@@ -80,6 +106,32 @@ func encData(packet []byte, data interface{}) ([]byte, error) {
 		}
 		packet[10] = DTYPE_TIMESTAMP
 		packet = append(packet, buf.Bytes()...)
+	case uint16:
+		return encFixed(packet, DTYPE_UINT16, data)
+	case uint64:
+		return encFixed(packet, DTYPE_UINT64, data)
+	case int8:
+		return encFixed(packet, DTYPE_INT8, data)
+	case int16:
+		return encFixed(packet, DTYPE_INT16, data)
+	case int32:
+		return encFixed(packet, DTYPE_INT32, data)
+	case int64:
+		return encFixed(packet, DTYPE_INT64, data)
+	case float64:
+		return encFixed(packet, DTYPE_DOUBLE, data)
+	case time.Time:
+		d, err := DateTimeFromTime(data)
+		if err != nil {
+			return nil, err
+		}
+		return encData(packet, d)
+	case time.Duration:
+		t, err := NewTimestamp(data)
+		if err != nil {
+			return nil, err
+		}
+		return encData(packet, t)
 	case []byte:
 		// there are only 16, 66 bytes long byte packets, they where both added to
 		// serve a uniq purpos, bytes with variable length is planned in the next protokoll version or so
@@ -101,6 +153,123 @@ func encData(packet []byte, data interface{}) ([]byte, error) {
 
 }
 
+// encode data as dtype, data is converted if dtype is set and the Go type
+// of data belongs to another data type
+func encTyped(packet []byte, dtype byte, data interface{}) ([]byte, error) {
+	data, err := typedData(dtype, data)
+	if err != nil {
+		return nil, err
+	}
+	return encData(packet, data)
+}
+
+// data converted to the Go type of dtype, unchanged if dtype is not set
+func typedData(dtype byte, data interface{}) (interface{}, error) {
+	if dtype == DTYPE_UNDEFINED {
+		return data, nil
+	}
+	v, err := NewValue(dtype, data)
+	if err != nil {
+		return nil, err
+	}
+	return v.Data, nil
+}
+
+// set datatype and append a fixed size payload in network byte order
+func encFixed(packet []byte, dtype byte, data interface{}) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	err := binary.Write(buf, binary.BigEndian, data)
+	if err != nil {
+		return nil, err
+	}
+	packet[10] = dtype
+	return append(packet, buf.Bytes()...), nil
+}
+
+// decode a fixed size payload in network byte order into v
+func decFixed(data []byte, v interface{}) error {
+	return binary.Read(bytes.NewBuffer(data), binary.BigEndian, v)
+}
+
+// payload size of the data types
+var dtype_sizes = map[byte]int{
+	DTYPE_BOOL:      1,
+	DTYPE_UINT8:     1,
+	DTYPE_UINT16:    2,
+	DTYPE_UINT32:    4,
+	DTYPE_UINT64:    8,
+	DTYPE_INT8:      1,
+	DTYPE_INT16:     2,
+	DTYPE_INT32:     4,
+	DTYPE_INT64:     8,
+	DTYPE_FLOAT:     4,
+	DTYPE_DOUBLE:    8,
+	DTYPE_DATETIME:  8,
+	DTYPE_TIMESTAMP: 4,
+	DTYPE_128STRING: 128,
+	DTYPE_16BYTES:   16,
+	DTYPE_66BYTES:   65,
+}
+
+// layout of a packet type
+type layout struct {
+	size    int  // length without payload and crc
+	payload bool // a payload follows, its data type is in packet[10]
+	dtype   byte // data type of the payload if it doesn't depend on packet[10]
+}
+
+var packet_layouts = map[byte]layout{
+	PTYPE_ERROR:        {7, false, DTYPE_UNDEFINED},
+	PTYPE_INFO:         {11, true, DTYPE_UNDEFINED},
+	PTYPE_QUERY:        {10, false, DTYPE_UNDEFINED},
+	PTYPE_WRITE:        {11, true, DTYPE_UNDEFINED},
+	PTYPE_EPINFO:       {11, true, DTYPE_128STRING},
+	PTYPE_EPQUERY:      {10, false, DTYPE_UNDEFINED},
+	PTYPE_EPPROPQUERY:  {14, false, DTYPE_UNDEFINED},
+	PTYPE_EPPROPWRITE:  {15, true, DTYPE_UNDEFINED},
+	PTYPE_PINFO:        {27, true, DTYPE_UNDEFINED},
+	PTYPE_ACK:          {8, false, DTYPE_UNDEFINED},
+	PTYPE_REPORT:       {13, true, DTYPE_UNDEFINED},
+	PTYPE_EPREPORT:     {13, true, DTYPE_128STRING},
+	PTYPE_EPPROPREPORT: {15, true, DTYPE_UNDEFINED},
+}
+
+// validate header, packet type, exact length and crc of a received packet
+func checkPacket(packet []byte, ptype byte) error {
+	l := packet_layouts[ptype]
+	dtype := byte(DTYPE_UNDEFINED)
+	expected := l.size + 2
+	if l.payload {
+		// at least one byte of payload
+		expected++
+	}
+	if len(packet) < min_packet_length {
+		return &LengthError{ptype, dtype, len(packet), expected}
+	}
+	err := checkHeader(packet)
+	if err != nil {
+		return err
+	}
+	if packet[4] != ptype {
+		return Error(ERR_UNKNOWNPTYPE)
+	}
+	if l.payload && len(packet) > l.size {
+		dtype = l.dtype
+		if dtype == DTYPE_UNDEFINED {
+			dtype = packet[10]
+		}
+		size, ok := dtype_sizes[dtype]
+		if !ok {
+			return Error(ERR_HXBDTYPE)
+		}
+		expected = l.size + size + 2
+	}
+	if len(packet) != expected {
+		return &LengthError{ptype, dtype, len(packet), expected}
+	}
+	return checkCRC(packet)
+}
+
 // decode received Data payload
 func decData(data []byte, dtype byte) (interface{}, error) {
 	var ret_data interface{}
@@ -125,8 +294,7 @@ func decData(data []byte, dtype byte) (interface{}, error) {
 		ret_data = v
 	case DTYPE_DATETIME:
 		var v DateTime
-		buf := bytes.NewBuffer(data)
-		err := binary.Read(buf, binary.BigEndian, &v)
+		err := v.Decode(data)
 		if err != nil {
 			return nil, err
 		}
@@ -151,8 +319,7 @@ func decData(data []byte, dtype byte) (interface{}, error) {
 		}
 	case DTYPE_TIMESTAMP:
 		var v Timestamp
-		buf := bytes.NewBuffer(data)
-		err := binary.Read(buf, binary.BigEndian, &v)
+		err := v.Decode(data)
 		if err != nil {
 			return nil, err
 		}
@@ -167,6 +334,48 @@ func decData(data []byte, dtype byte) (interface{}, error) {
 			return nil, Error(0xa2)
 		}
 		ret_data = data
+	case DTYPE_UINT16:
+		var v uint16
+		if err := decFixed(data, &v); err != nil {
+			return nil, err
+		}
+		ret_data = v
+	case DTYPE_UINT64:
+		var v uint64
+		if err := decFixed(data, &v); err != nil {
+			return nil, err
+		}
+		ret_data = v
+	case DTYPE_INT8:
+		var v int8
+		if err := decFixed(data, &v); err != nil {
+			return nil, err
+		}
+		ret_data = v
+	case DTYPE_INT16:
+		var v int16
+		if err := decFixed(data, &v); err != nil {
+			return nil, err
+		}
+		ret_data = v
+	case DTYPE_INT32:
+		var v int32
+		if err := decFixed(data, &v); err != nil {
+			return nil, err
+		}
+		ret_data = v
+	case DTYPE_INT64:
+		var v int64
+		if err := decFixed(data, &v); err != nil {
+			return nil, err
+		}
+		ret_data = v
+	case DTYPE_DOUBLE:
+		var v float64
+		if err := decFixed(data, &v); err != nil {
+			return nil, err
+		}
+		ret_data = v
 	default:
 		return nil, Error(0xa3)
 	}
@@ -174,7 +383,11 @@ func decData(data []byte, dtype byte) (interface{}, error) {
 	return ret_data, nil
 }
 
+// PacketType returns the packet type of an encoded packet.
 func PacketType(packet []byte) (ptype byte, err error) {
+	if len(packet) < 5 {
+		return 0xff, &LengthError{Length: len(packet), Expected: min_packet_length}
+	}
 	switch packet[4] {
 	case PTYPE_ERROR:
 		ptype = PTYPE_ERROR
@@ -188,9 +401,85 @@ func PacketType(packet []byte) (ptype byte, err error) {
 		ptype = PTYPE_EPINFO
 	case PTYPE_EPQUERY:
 		ptype = PTYPE_EPQUERY
+	case PTYPE_EPPROPQUERY:
+		ptype = PTYPE_EPPROPQUERY
+	case PTYPE_EPPROPREPORT:
+		ptype = PTYPE_EPPROPREPORT
+	case PTYPE_EPPROPWRITE:
+		ptype = PTYPE_EPPROPWRITE
+	case PTYPE_PINFO:
+		ptype = PTYPE_PINFO
+	case PTYPE_ACK:
+		ptype = PTYPE_ACK
+	case PTYPE_REPORT:
+		ptype = PTYPE_REPORT
+	case PTYPE_EPREPORT:
+		ptype = PTYPE_EPREPORT
 	default:
 		return 0xff, Error(0xb1)
 	}
 
 	return ptype, nil
 }
+
+// names of the hexabus data types as used by libhexabus
+var dtype_names = map[byte]string{
+	DTYPE_UNDEFINED: "Undefined",
+	DTYPE_BOOL:      "Bool",
+	DTYPE_UINT8:     "UInt8",
+	DTYPE_UINT32:    "UInt32",
+	DTYPE_DATETIME:  "DateTime",
+	DTYPE_FLOAT:     "Float",
+	DTYPE_128STRING: "String",
+	DTYPE_TIMESTAMP: "Timestamp",
+	DTYPE_16BYTES:   "16Bytes",
+	DTYPE_66BYTES:   "66Bytes",
+	DTYPE_UINT16:    "UInt16",
+	DTYPE_UINT64:    "UInt64",
+	DTYPE_INT8:      "Int8",
+	DTYPE_INT16:     "Int16",
+	DTYPE_INT32:     "Int32",
+	DTYPE_INT64:     "Int64",
+	DTYPE_DOUBLE:    "Double",
+}
+
+// DtypeName returns the name of a hexabus data type.
+func DtypeName(dtype byte) string {
+	name, ok := dtype_names[dtype]
+	if !ok {
+		return "Unknown(" + strconv.Itoa(int(dtype)) + ")"
+	}
+	return name
+}
+
+// DtypeSize returns the payload size of a hexabus data type in bytes, 0 if
+// the data type is unknown.
+func DtypeSize(dtype byte) int {
+	return dtype_sizes[dtype]
+}
+
+// names of the hexabus packet types as used by libhexabus
+var ptype_names = map[byte]string{
+	PTYPE_ERROR:        "Error",
+	PTYPE_INFO:         "Info",
+	PTYPE_QUERY:        "Query",
+	PTYPE_WRITE:        "Write",
+	PTYPE_EPINFO:       "EndpointInfo",
+	PTYPE_EPQUERY:      "EndpointQuery",
+	PTYPE_EPPROPQUERY:  "EndpointPropertyQuery",
+	PTYPE_EPPROPREPORT: "EndpointPropertyReport",
+	PTYPE_EPPROPWRITE:  "EndpointPropertyWrite",
+	PTYPE_PINFO:        "ProxyInfo",
+	PTYPE_ACK:          "Ack",
+	PTYPE_REPORT:       "Report",
+	PTYPE_EPREPORT:     "EndpointReport",
+}
+
+// PtypeName returns the name of a hexabus packet type.
+func PtypeName(ptype byte) string {
+	name, ok := ptype_names[ptype]
+	if !ok {
+		return "Unknown(" + strconv.Itoa(int(ptype)) + ")"
+	}
+	return name
+}
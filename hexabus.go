@@ -2,6 +2,11 @@
 // For more info see https://github.com/mysmartgrid/hexabus.
 package hexabus
 
+import (
+	"encoding/binary"
+	"net"
+)
+
 // Hexabus Error Packet
 // if a packet os malformed or doesn't the EID is not properly used it will return
 // a error of type ERR_UNKNOWNEID, ERR_WRITEREADONLY, ERR_CRCFAILED, ERR_DATATYPE
@@ -26,11 +31,7 @@ func (p *ErrorPacket) Encode() []byte {
 
 // decoder for Error Packet
 func (p *ErrorPacket) Decode(packet []byte) (err error) {
-	err = checkHeader(packet)
-	if err != nil {
-		return err
-	}
-	err = checkCRC(packet)
+	err = checkPacket(packet, PTYPE_ERROR)
 	if err != nil {
 		return err
 	}
@@ -40,7 +41,9 @@ func (p *ErrorPacket) Decode(packet []byte) (err error) {
 }
 
 // Hexabus Info Packet
-// Info Packets are send after a Query Packet or Broadcasted every n seconds
+// Info Packets are send after a Query Packet or Broadcasted every n seconds.
+// If Dtype is set Data is converted to it, otherwise the data type follows
+// the Go type of Data, see Value.
 type InfoPacket struct {
 	// 4 bytes header
 	// 1 byte packet type
@@ -56,9 +59,8 @@ func (p *InfoPacket) Encode() (packet []byte, err error) {
 	addHeader(packet)
 	packet[4] = PTYPE_INFO
 	packet[5] = p.Flags
-	packet[6], packet[7], packet[8], packet[9] = uint8(p.Eid>>24), uint8(p.Eid>>16), uint8(p.Eid>>8), uint8(p.Eid&0xff)
-	packet[10] = p.Dtype
-	packet, err = encData(packet, p.Data)
+	encEid(packet, p.Eid)
+	packet, err = encTyped(packet, p.Dtype, p.Data)
 	if err != nil {
 		return nil, err
 	}
@@ -68,16 +70,12 @@ func (p *InfoPacket) Encode() (packet []byte, err error) {
 
 // decoder for Info Packet
 func (p *InfoPacket) Decode(packet []byte) (err error) {
-	err = checkHeader(packet)
-	if err != nil {
-		return err
-	}
-	err = checkCRC(packet)
+	err = checkPacket(packet, PTYPE_INFO)
 	if err != nil {
 		return err
 	}
 	p.Flags = packet[5]
-	p.Eid = uint32(uint8(packet[6])>>24 + uint8(packet[7])>>16 + uint8(packet[8])>>8 + uint8(packet[9])&0xff)
+	p.Eid = decEid(packet)
 	p.Dtype = packet[10]
 	p.Data, err = decData(packet[11:len(packet)-2], packet[10])
 	if err != nil {
@@ -101,29 +99,26 @@ func (p *QueryPacket) Encode() []byte {
 	addHeader(packet)
 	packet[4] = PTYPE_QUERY
 	packet[5] = p.Flags
-	packet[6], packet[7], packet[8], packet[9] = uint8(p.Eid>>24), uint8(p.Eid>>16), uint8(p.Eid>>8), uint8(p.Eid&0xff)
+	encEid(packet, p.Eid)
 	packet = addCRC(packet)
 	return packet
 }
 
 // decoder for Query Packet
 func (p *QueryPacket) Decode(packet []byte) (err error) {
-	err = checkHeader(packet)
-	if err != nil {
-		return err
-	}
-	err = checkCRC(packet)
+	err = checkPacket(packet, PTYPE_QUERY)
 	if err != nil {
 		return err
 	}
 	p.Flags = packet[5]
-	p.Eid = uint32(uint8(packet[6])>>24 + uint8(packet[7])>>16 + uint8(packet[8])>>8 + uint8(packet[9])&0xff)
+	p.Eid = decEid(packet)
 	return nil
 }
 
 // Hexabus Write Packet
 // used to set a writeable entpoint id to a certain value, there is no response for that o
-// other than an Error Packet on fail
+// other than an Error Packet on fail. Dtype and Data are handled like in the
+// Info Packet.
 type WritePacket struct {
 	// 4 bytes header
 	// 1 byte packet type
@@ -139,8 +134,8 @@ func (p *WritePacket) Encode() (packet []byte, err error) {
 	addHeader(packet)
 	packet[4] = PTYPE_WRITE
 	packet[5] = p.Flags
-	packet[6], packet[7], packet[8], packet[9] = uint8(p.Eid>>24), uint8(p.Eid>>16), uint8(p.Eid>>8), uint8(p.Eid&0xff)
-	packet, err = encData(packet, p.Data)
+	encEid(packet, p.Eid)
+	packet, err = encTyped(packet, p.Dtype, p.Data)
 	if err != nil {
 		return nil, err
 	}
@@ -150,16 +145,12 @@ func (p *WritePacket) Encode() (packet []byte, err error) {
 
 // decoder for Write Packet
 func (p *WritePacket) Decode(packet []byte) (err error) {
-	err = checkHeader(packet)
-	if err != nil {
-		return err
-	}
-	err = checkCRC(packet)
+	err = checkPacket(packet, PTYPE_WRITE)
 	if err != nil {
 		return err
 	}
 	p.Flags = packet[5]
-	p.Eid = uint32(uint8(packet[6])>>24 + uint8(packet[7])>>16 + uint8(packet[8])>>8 + uint8(packet[9])&0xff)
+	p.Eid = decEid(packet)
 	p.Dtype = packet[10]
 	p.Data, err = decData(packet[11:len(packet)-2], packet[10])
 	if err != nil {
@@ -186,28 +177,26 @@ func (p *EpInfoPacket) Encode() (packet []byte, err error) {
 	addHeader(packet)
 	packet[4] = PTYPE_EPINFO
 	packet[5] = p.Flags
-	packet[6], packet[7], packet[8], packet[9] = uint8(p.Eid>>24), uint8(p.Eid>>16), uint8(p.Eid>>8), uint8(p.Eid&0xff)
-	packet[10] = p.Dtype
+	encEid(packet, p.Eid)
 	packet, err = encData(packet, p.Data)
 	if err != nil {
 		return nil, err
 	}
+	// the payload is allways a DTYPE_128STRING description, the data type
+	// field holds the data type of the endpoint
+	packet[10] = p.Dtype
 	packet = addCRC(packet)
 	return packet, nil
 }
 
 // decoder for Endpoint Info Packet
 func (p *EpInfoPacket) Decode(packet []byte) (err error) {
-	err = checkHeader(packet)
-	if err != nil {
-		return err
-	}
-	err = checkCRC(packet)
+	err = checkPacket(packet, PTYPE_EPINFO)
 	if err != nil {
 		return err
 	}
 	p.Flags = packet[5]
-	p.Eid = uint32(uint8(packet[6])>>24 + uint8(packet[7])>>16 + uint8(packet[8])>>8 + uint8(packet[9])&0xff)
+	p.Eid = decEid(packet)
 	// Endpoin Info Packets have the datatype of the endpoint that was queried
 	// with Endpoint Query, so for example a Relay will anther with type Bool
 	// to turn it on and off
@@ -237,22 +226,320 @@ func (p *EpQueryPacket) Encode() []byte {
 	addHeader(packet)
 	packet[4] = PTYPE_EPQUERY
 	packet[5] = p.Flags
-	packet[6], packet[7], packet[8], packet[9] = uint8(p.Eid>>24), uint8(p.Eid>>16), uint8(p.Eid>>8), uint8(p.Eid&0xff)
+	encEid(packet, p.Eid)
 	packet = addCRC(packet)
 	return packet
 }
 
 // decoder for Endpoint Query Packet
 func (p *EpQueryPacket) Decode(packet []byte) (err error) {
-	err = checkHeader(packet)
+	err = checkPacket(packet, PTYPE_EPQUERY)
+	if err != nil {
+		return err
+	}
+	p.Flags = packet[5]
+	p.Eid = decEid(packet)
+	return nil
+}
+
+// Hexabus Endpoint Property Query Packet
+// used to query a single property of an endpoint, answered with an Endpoint
+// Property Report Packet
+type EpPropQueryPacket struct {
+	// 4 bytes header
+	// 1 byte packet type
+	Flags  byte   // flags
+	Eid    uint32 // endpoint id
+	PropId uint32 // property id
+}
+
+// encoder for Endpoint Property Query Packet
+func (p *EpPropQueryPacket) Encode() []byte {
+	packet := make([]byte, 14)
+	addHeader(packet)
+	packet[4] = PTYPE_EPPROPQUERY
+	packet[5] = p.Flags
+	encEid(packet, p.Eid)
+	binary.BigEndian.PutUint32(packet[10:14], p.PropId)
+	packet = addCRC(packet)
+	return packet
+}
+
+// decoder for Endpoint Property Query Packet
+func (p *EpPropQueryPacket) Decode(packet []byte) (err error) {
+	err = checkPacket(packet, PTYPE_EPPROPQUERY)
+	if err != nil {
+		return err
+	}
+	p.Flags = packet[5]
+	p.Eid = decEid(packet)
+	p.PropId = binary.BigEndian.Uint32(packet[10:14])
+	return nil
+}
+
+// Hexabus Endpoint Property Report Packet
+// holds the value of an endpoint property
+type EpPropReportPacket struct {
+	// 4 bytes header
+	// 1 byte packet type
+	Flags  byte        // flags
+	Eid    uint32      // endpoint id
+	Dtype  byte        // data type
+	PropId uint32      // property id
+	Data   interface{} // payload, size depending on datatype
+}
+
+// encoder for Endpoint Property Report Packet
+func (p *EpPropReportPacket) Encode() (packet []byte, err error) {
+	packet = make([]byte, 15)
+	addHeader(packet)
+	packet[4] = PTYPE_EPPROPREPORT
+	packet[5] = p.Flags
+	encEid(packet, p.Eid)
+	binary.BigEndian.PutUint32(packet[11:15], p.PropId)
+	packet, err = encTyped(packet, p.Dtype, p.Data)
+	if err != nil {
+		return nil, err
+	}
+	packet = addCRC(packet)
+	return packet, nil
+}
+
+// decoder for Endpoint Property Report Packet
+func (p *EpPropReportPacket) Decode(packet []byte) (err error) {
+	err = checkPacket(packet, PTYPE_EPPROPREPORT)
+	if err != nil {
+		return err
+	}
+	p.Flags = packet[5]
+	p.Eid = decEid(packet)
+	p.Dtype = packet[10]
+	p.PropId = binary.BigEndian.Uint32(packet[11:15])
+	p.Data, err = decData(packet[15:len(packet)-2], packet[10])
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// Hexabus Endpoint Property Write Packet
+// used to set a property of an endpoint, like the name of a device, there is
+// no response other than an Error Packet on fail
+type EpPropWritePacket struct {
+	// 4 bytes header
+	// 1 byte packet type
+	Flags  byte        // flags
+	Eid    uint32      // endpoint id
+	Dtype  byte        // data type
+	PropId uint32      // property id
+	Data   interface{} // payload, size depending on datatype
+}
+
+// encoder for Endpoint Property Write Packet
+func (p *EpPropWritePacket) Encode() (packet []byte, err error) {
+	packet = make([]byte, 15)
+	addHeader(packet)
+	packet[4] = PTYPE_EPPROPWRITE
+	packet[5] = p.Flags
+	encEid(packet, p.Eid)
+	binary.BigEndian.PutUint32(packet[11:15], p.PropId)
+	packet, err = encTyped(packet, p.Dtype, p.Data)
+	if err != nil {
+		return nil, err
+	}
+	packet = addCRC(packet)
+	return packet, nil
+}
+
+// decoder for Endpoint Property Write Packet
+func (p *EpPropWritePacket) Decode(packet []byte) (err error) {
+	err = checkPacket(packet, PTYPE_EPPROPWRITE)
+	if err != nil {
+		return err
+	}
+	p.Flags = packet[5]
+	p.Eid = decEid(packet)
+	p.Dtype = packet[10]
+	p.PropId = binary.BigEndian.Uint32(packet[11:15])
+	p.Data, err = decData(packet[15:len(packet)-2], packet[10])
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// Hexabus Report Packet
+// an Info Packet sent in response to a Query Packet, Cause holds the sequence
+// number of the query
+type ReportPacket struct {
+	// 4 bytes header
+	// 1 byte packet type
+	Flags byte        // flags
+	Eid   uint32      // endpoint id
+	Dtype byte        // data type
+	Cause uint16      // sequence number of the query
+	Data  interface{} // payload, size depending on datatype
+}
+
+// encoder for Report Packet
+func (p *ReportPacket) Encode() (packet []byte, err error) {
+	packet = make([]byte, 13)
+	addHeader(packet)
+	packet[4] = PTYPE_REPORT
+	packet[5] = p.Flags
+	encEid(packet, p.Eid)
+	binary.BigEndian.PutUint16(packet[11:13], p.Cause)
+	packet, err = encTyped(packet, p.Dtype, p.Data)
+	if err != nil {
+		return nil, err
+	}
+	packet = addCRC(packet)
+	return packet, nil
+}
+
+// decoder for Report Packet
+func (p *ReportPacket) Decode(packet []byte) (err error) {
+	err = checkPacket(packet, PTYPE_REPORT)
+	if err != nil {
+		return err
+	}
+	p.Flags = packet[5]
+	p.Eid = decEid(packet)
+	p.Dtype = packet[10]
+	p.Cause = binary.BigEndian.Uint16(packet[11:13])
+	p.Data, err = decData(packet[13:len(packet)-2], packet[10])
 	if err != nil {
 		return err
 	}
-	err = checkCRC(packet)
+	return nil
+}
+
+// Hexabus Endpoint Report Packet
+// an Endpoint Info Packet sent in response to an Endpoint Query Packet, Cause
+// holds the sequence number of the query
+type EpReportPacket struct {
+	// 4 bytes header
+	// 1 byte packet type
+	Flags byte        // flags
+	Eid   uint32      // endpoint id
+	Dtype byte        // data type of the endpoint
+	Cause uint16      // sequence number of the query
+	Data  interface{} // description of the endpoint
+}
+
+// encoder for Endpoint Report Packet
+func (p *EpReportPacket) Encode() (packet []byte, err error) {
+	packet = make([]byte, 13)
+	addHeader(packet)
+	packet[4] = PTYPE_EPREPORT
+	packet[5] = p.Flags
+	encEid(packet, p.Eid)
+	binary.BigEndian.PutUint16(packet[11:13], p.Cause)
+	packet, err = encData(packet, p.Data)
+	if err != nil {
+		return nil, err
+	}
+	// like in Endpoint Info Packets the data type field holds the data type
+	// of the endpoint, not the one of the description
+	packet[10] = p.Dtype
+	packet = addCRC(packet)
+	return packet, nil
+}
+
+// decoder for Endpoint Report Packet
+func (p *EpReportPacket) Decode(packet []byte) (err error) {
+	err = checkPacket(packet, PTYPE_EPREPORT)
+	if err != nil {
+		return err
+	}
+	p.Flags = packet[5]
+	p.Eid = decEid(packet)
+	p.Dtype = packet[10]
+	p.Cause = binary.BigEndian.Uint16(packet[11:13])
+	p.Data, err = decData(packet[13:len(packet)-2], DTYPE_128STRING)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// Hexabus Proxy Info Packet
+// an Info Packet sent by a gateway on behalf of the device with the address
+// Origin
+type PInfoPacket struct {
+	// 4 bytes header
+	// 1 byte packet type
+	Flags  byte        // flags
+	Eid    uint32      // endpoint id
+	Dtype  byte        // data type
+	Origin net.IP      // 16 bytes address of the device the info is from
+	Data   interface{} // payload, size depending on datatype
+}
+
+// encoder for Proxy Info Packet
+func (p *PInfoPacket) Encode() (packet []byte, err error) {
+	origin := p.Origin.To16()
+	if origin == nil {
+		return nil, Error(HXB_ERR_INVALID_VALUE)
+	}
+	packet = make([]byte, 27)
+	addHeader(packet)
+	packet[4] = PTYPE_PINFO
+	packet[5] = p.Flags
+	encEid(packet, p.Eid)
+	copy(packet[11:27], origin)
+	packet, err = encTyped(packet, p.Dtype, p.Data)
+	if err != nil {
+		return nil, err
+	}
+	packet = addCRC(packet)
+	return packet, nil
+}
+
+// decoder for Proxy Info Packet
+func (p *PInfoPacket) Decode(packet []byte) (err error) {
+	err = checkPacket(packet, PTYPE_PINFO)
+	if err != nil {
+		return err
+	}
+	p.Flags = packet[5]
+	p.Eid = decEid(packet)
+	p.Dtype = packet[10]
+	p.Origin = append(net.IP(nil), packet[11:27]...)
+	p.Data, err = decData(packet[27:len(packet)-2], packet[10])
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// Hexabus Ack Packet
+// acknowledges the reception of a packet sent with FLAG_RELIABLE
+type AckPacket struct {
+	// 4 bytes header
+	// 1 byte packet type
+	Flags byte   // flags
+	Cause uint16 // sequence number of the acknowledged packet
+}
+
+// encoder for Ack Packet
+func (p *AckPacket) Encode() []byte {
+	packet := make([]byte, 8)
+	addHeader(packet)
+	packet[4] = PTYPE_ACK
+	packet[5] = p.Flags
+	binary.BigEndian.PutUint16(packet[6:8], p.Cause)
+	packet = addCRC(packet)
+	return packet
+}
+
+// decoder for Ack Packet
+func (p *AckPacket) Decode(packet []byte) (err error) {
+	err = checkPacket(packet, PTYPE_ACK)
 	if err != nil {
 		return err
 	}
 	p.Flags = packet[5]
-	p.Eid = uint32(uint8(packet[6])>>24 + uint8(packet[7])>>16 + uint8(packet[8])>>8 + uint8(packet[9])&0xff)
+	p.Cause = binary.BigEndian.Uint16(packet[6:8])
 	return nil
 }
@@ -35,6 +35,27 @@ var data_types = map[byte]payload{
 	DTYPE_66BYTES: payload{
 		make_byte_slice(65),
 	},
+	DTYPE_UINT16: payload{
+		uint16(54321),
+	},
+	DTYPE_UINT64: payload{
+		uint64(18446744073709551000),
+	},
+	DTYPE_INT8: payload{
+		int8(-100),
+	},
+	DTYPE_INT16: payload{
+		int16(-30000),
+	},
+	DTYPE_INT32: payload{
+		int32(-2000000000),
+	},
+	DTYPE_INT64: payload{
+		int64(-9000000000000000000),
+	},
+	DTYPE_DOUBLE: payload{
+		float64(-3.141592653589793),
+	},
 }
 
 var error_t = []byte{HXB_ERR_SUCCESS, HXB_ERR_UNKNOWNEID, HXB_ERR_WRITEREADONLY, HXB_ERR_CRCFAILED, HXB_ERR_DATATYPE, HXB_ERR_INVALID_VALUE}
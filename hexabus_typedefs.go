@@ -45,11 +45,65 @@ const (
 	// Request endpoint metadata
 	PTYPE_EPQUERY = 0x0a
 
+	// Hexabus EpPropQuery Packet
+	// Request an endpoint property
+	PTYPE_EPPROPQUERY = 0x0b
+
+	// Hexabus EpPropWrite Packet
+	// Endpoint is requested to set a property
+	PTYPE_EPPROPWRITE = 0x0c
+
+	// Hexabus PInfo Packet
+	// Endpoint information sent by a gateway on behalf of another device
+	PTYPE_PINFO = 0x0d
+
+	// Hexabus Ack Packet
+	// Acknowledges a reliable packet, the cause field holds its sequence number
+	PTYPE_ACK = 0x10
+
+	// Hexabus Report Packet
+	// Endpoint provides information in response to a Query
+	PTYPE_REPORT = 0x11
+
+	// Hexabus EpReport Packet
+	// Endpoint metadata in response to an EpQuery
+	PTYPE_EPREPORT = 0x12
+
+	// Hexabus EpPropReport Packet
+	// Endpoint property in response to an EpPropQuery
+	PTYPE_EPPROPREPORT = 0x13
+
+	/* Endpoint properties */
+
+	// String, name of the endpoint
+	EP_PROP_NAME = 0x01
+
+	// String, unit of the endpoint value
+	EP_PROP_UNIT = 0x02
+
+	// smallest value of the endpoint, same data type as the endpoint
+	EP_PROP_MIN = 0x03
+
+	// largest value of the endpoint, same data type as the endpoint
+	EP_PROP_MAX = 0x04
+
+	// Bool, true if the endpoint accepts Write Packets
+	EP_PROP_WRITABLE = 0x05
+
+	// String, name of the device, property of EID 0
+	EP_PROP_DEVICE_NAME = 0x06
+
 	/* Flags */
 
 	// Hexabus Flag "No Flag set"
 	FLAG_NONE = 0x00
 
+	// Hexabus Flag "reliable"
+	// the packet carries a sequence number after the flags and has to be
+	// acknowledged with an Ack Packet. The flag is set and removed by the
+	// reliable send path, don't set it on packets yourself.
+	FLAG_RELIABLE = 0x01
+
 	/* Data types */
 
 	// Hexabus Data Type "No data at all"
@@ -93,6 +147,28 @@ const (
 	// used by the statemachine upload only, and that is 65 bytes
 	BYTES66_PACKET_MAX_BUFFER_LENGTH_ = 65
 
+	// Data type uint16
+	DTYPE_UINT16 = 0x0a
+
+	// Data type uint64
+	DTYPE_UINT64 = 0x0b
+
+	// Data type int8
+	DTYPE_INT8 = 0x0c
+
+	// Data type int16
+	DTYPE_INT16 = 0x0d
+
+	// Data type int32
+	DTYPE_INT32 = 0x0e
+
+	// Data type int64
+	DTYPE_INT64 = 0x0f
+
+	// Data type double
+	// 64 bit IEEE 754 floating point
+	DTYPE_DOUBLE = 0x10
+
 	/* Error codes */
 
 	// reserved: No error
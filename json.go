@@ -0,0 +1,517 @@
+package hexabus
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"math"
+	"net"
+	"strconv"
+)
+
+// JSON representation of all packet types, the value is encoded according
+// to the datatype so it can be decoded into the same Go type again
+type jsonPacket struct {
+	Type        string          `json:"type"`
+	Flags       byte            `json:"flags"`
+	Eid         *uint32         `json:"eid,omitempty"`
+	Datatype    string          `json:"datatype,omitempty"`
+	Value       json.RawMessage `json:"value,omitempty"`
+	Property    *uint32         `json:"property,omitempty"`
+	Cause       *uint16         `json:"cause,omitempty"`
+	Origin      string          `json:"origin,omitempty"`
+	Description *string         `json:"description,omitempty"`
+	Code        *byte           `json:"code,omitempty"`
+	Error       string          `json:"error,omitempty"`
+}
+
+// JSON representation of an EID
+type jsonEid struct {
+	Eid         uint32 `json:"eid"`
+	Datatype    string `json:"datatype"`
+	Description string `json:"description"`
+	Writable    bool   `json:"writable"`
+}
+
+// JSON representation of a Value
+type jsonValue struct {
+	Datatype string          `json:"datatype"`
+	Value    json.RawMessage `json:"value"`
+}
+
+// ParseDtype returns the data type for a name as returned by DtypeName.
+func ParseDtype(name string) (byte, error) {
+	for dtype, n := range dtype_names {
+		if n == name {
+			return dtype, nil
+		}
+	}
+	return DTYPE_UNDEFINED, Error(ERR_HXBDTYPE)
+}
+
+// data type data is encoded with
+func dtypeOf(data interface{}) (byte, error) {
+	packet, err := encData(make([]byte, 11), data)
+	if err != nil {
+		return DTYPE_UNDEFINED, err
+	}
+	return packet[10], nil
+}
+
+// encode a payload as JSON value, non-finite floats as the strings "NaN",
+// "Inf" and "-Inf" which JSON numbers can't represent
+func marshalData(data interface{}) (json.RawMessage, error) {
+	switch data := data.(type) {
+	case Value:
+		return marshalData(data.Data)
+	case float32:
+		if f := float64(data); math.IsNaN(f) || math.IsInf(f, 0) {
+			return json.Marshal(strconv.FormatFloat(f, 'g', -1, 32))
+		}
+		return json.RawMessage(strconv.FormatFloat(float64(data), 'g', -1, 32)), nil
+	case float64:
+		if math.IsNaN(data) || math.IsInf(data, 0) {
+			return json.Marshal(strconv.FormatFloat(data, 'g', -1, 64))
+		}
+	case Timestamp:
+		return json.Marshal(data.TotalSeconds)
+	case []byte:
+		return json.Marshal(hex.EncodeToString(data))
+	}
+	return json.Marshal(data)
+}
+
+// decode a JSON value into the Go type of dtype
+func unmarshalData(dtype byte, raw json.RawMessage) (interface{}, error) {
+	var err error
+	switch dtype {
+	case DTYPE_BOOL:
+		var v bool
+		err = json.Unmarshal(raw, &v)
+		return v, err
+	case DTYPE_UINT8, DTYPE_UINT32, DTYPE_TIMESTAMP:
+		var v uint64
+		err = json.Unmarshal(raw, &v)
+		if err != nil {
+			return nil, err
+		}
+		if dtype == DTYPE_UINT8 {
+			if v > math.MaxUint8 {
+				return nil, Error(ERR_VALUERANGE)
+			}
+			return uint8(v), nil
+		}
+		if v > math.MaxUint32 {
+			return nil, Error(ERR_VALUERANGE)
+		}
+		if dtype == DTYPE_TIMESTAMP {
+			return Timestamp{uint32(v)}, nil
+		}
+		return uint32(v), nil
+	case DTYPE_DATETIME:
+		var v DateTime
+		err = json.Unmarshal(raw, &v)
+		return v, err
+	case DTYPE_FLOAT:
+		v, err := unmarshalFloat(raw, 32)
+		return float32(v), err
+	case DTYPE_128STRING:
+		var v string
+		err = json.Unmarshal(raw, &v)
+		return v, err
+	case DTYPE_UINT16:
+		var v uint16
+		err = json.Unmarshal(raw, &v)
+		return v, err
+	case DTYPE_UINT64:
+		var v uint64
+		err = json.Unmarshal(raw, &v)
+		return v, err
+	case DTYPE_INT8:
+		var v int8
+		err = json.Unmarshal(raw, &v)
+		return v, err
+	case DTYPE_INT16:
+		var v int16
+		err = json.Unmarshal(raw, &v)
+		return v, err
+	case DTYPE_INT32:
+		var v int32
+		err = json.Unmarshal(raw, &v)
+		return v, err
+	case DTYPE_INT64:
+		var v int64
+		err = json.Unmarshal(raw, &v)
+		return v, err
+	case DTYPE_DOUBLE:
+		return unmarshalFloat(raw, 64)
+	case DTYPE_16BYTES, DTYPE_66BYTES:
+		var v string
+		err = json.Unmarshal(raw, &v)
+		if err != nil {
+			return nil, err
+		}
+		return hex.DecodeString(v)
+	}
+	return nil, Error(ERR_HXBDTYPE)
+}
+
+// decode a JSON number or one of the strings of a non-finite float
+func unmarshalFloat(raw json.RawMessage, bits int) (float64, error) {
+	var s string
+	if json.Unmarshal(raw, &s) == nil {
+		switch s {
+		case "NaN", "Inf", "+Inf", "-Inf":
+			return strconv.ParseFloat(s, bits)
+		}
+		return 0, Error(HXB_ERR_INVALID_VALUE)
+	}
+	var v float64
+	err := json.Unmarshal(raw, &v)
+	if err != nil {
+		return 0, err
+	}
+	if bits == 32 && math.Abs(v) > math.MaxFloat32 {
+		return 0, Error(ERR_VALUERANGE)
+	}
+	return v, nil
+}
+
+// JSON of a packet with eid and payload
+func payloadJSON(ptype byte, flags byte, eid uint32, dtype byte, data interface{}) (jsonPacket, error) {
+	data, err := typedData(dtype, data)
+	if err != nil {
+		return jsonPacket{}, err
+	}
+	dtype, err = dtypeOf(data)
+	if err != nil {
+		return jsonPacket{}, err
+	}
+	value, err := marshalData(data)
+	if err != nil {
+		return jsonPacket{}, err
+	}
+	return jsonPacket{Type: PtypeName(ptype), Flags: flags, Eid: &eid, Datatype: DtypeName(dtype), Value: value}, nil
+}
+
+// encode a packet with eid and payload
+func marshalPayload(ptype byte, flags byte, eid uint32, dtype byte, data interface{}) ([]byte, error) {
+	jp, err := payloadJSON(ptype, flags, eid, dtype, data)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(jp)
+}
+
+// decode the JSON of a packet and check the packet type
+func unmarshalPacket(ptype byte, b []byte) (jsonPacket, error) {
+	var jp jsonPacket
+	err := json.Unmarshal(b, &jp)
+	if err != nil {
+		return jp, err
+	}
+	if jp.Type != PtypeName(ptype) {
+		return jp, Error(ERR_UNKNOWNPTYPE)
+	}
+	if jp.Eid == nil {
+		jp.Eid = new(uint32)
+	}
+	return jp, nil
+}
+
+// decode the JSON of a packet with eid and payload
+func unmarshalPayload(ptype byte, b []byte) (jp jsonPacket, dtype byte, data interface{}, err error) {
+	jp, err = unmarshalPacket(ptype, b)
+	if err != nil {
+		return
+	}
+	dtype, err = ParseDtype(jp.Datatype)
+	if err != nil {
+		return
+	}
+	data, err = unmarshalData(dtype, jp.Value)
+	return
+}
+
+func (p ErrorPacket) MarshalJSON() ([]byte, error) {
+	return json.Marshal(jsonPacket{Type: PtypeName(PTYPE_ERROR), Flags: p.Flags, Code: &p.Error, Error: Error(p.Error).Error()})
+}
+
+func (p *ErrorPacket) UnmarshalJSON(b []byte) error {
+	jp, err := unmarshalPacket(PTYPE_ERROR, b)
+	if err != nil {
+		return err
+	}
+	if jp.Code == nil {
+		return Error(HXB_ERR_INVALID_VALUE)
+	}
+	p.Flags, p.Error = jp.Flags, *jp.Code
+	return nil
+}
+
+func (p InfoPacket) MarshalJSON() ([]byte, error) {
+	return marshalPayload(PTYPE_INFO, p.Flags, p.Eid, p.Dtype, p.Data)
+}
+
+func (p *InfoPacket) UnmarshalJSON(b []byte) error {
+	jp, dtype, data, err := unmarshalPayload(PTYPE_INFO, b)
+	if err != nil {
+		return err
+	}
+	p.Flags, p.Eid, p.Dtype, p.Data = jp.Flags, *jp.Eid, dtype, data
+	return nil
+}
+
+func (p QueryPacket) MarshalJSON() ([]byte, error) {
+	return json.Marshal(jsonPacket{Type: PtypeName(PTYPE_QUERY), Flags: p.Flags, Eid: &p.Eid})
+}
+
+func (p *QueryPacket) UnmarshalJSON(b []byte) error {
+	jp, err := unmarshalPacket(PTYPE_QUERY, b)
+	if err != nil {
+		return err
+	}
+	p.Flags, p.Eid = jp.Flags, *jp.Eid
+	return nil
+}
+
+func (p WritePacket) MarshalJSON() ([]byte, error) {
+	return marshalPayload(PTYPE_WRITE, p.Flags, p.Eid, p.Dtype, p.Data)
+}
+
+func (p *WritePacket) UnmarshalJSON(b []byte) error {
+	jp, dtype, data, err := unmarshalPayload(PTYPE_WRITE, b)
+	if err != nil {
+		return err
+	}
+	p.Flags, p.Eid, p.Dtype, p.Data = jp.Flags, *jp.Eid, dtype, data
+	return nil
+}
+
+func (p EpInfoPacket) MarshalJSON() ([]byte, error) {
+	desc, ok := p.Data.(string)
+	if !ok {
+		return nil, Error(ERR_HXBDTYPE)
+	}
+	return json.Marshal(jsonPacket{Type: PtypeName(PTYPE_EPINFO), Flags: p.Flags, Eid: &p.Eid, Datatype: DtypeName(p.Dtype), Description: &desc})
+}
+
+func (p *EpInfoPacket) UnmarshalJSON(b []byte) error {
+	jp, err := unmarshalPacket(PTYPE_EPINFO, b)
+	if err != nil {
+		return err
+	}
+	dtype, err := ParseDtype(jp.Datatype)
+	if err != nil {
+		return err
+	}
+	if jp.Description == nil {
+		jp.Description = new(string)
+	}
+	p.Flags, p.Eid, p.Dtype, p.Data = jp.Flags, *jp.Eid, dtype, *jp.Description
+	return nil
+}
+
+func (p EpQueryPacket) MarshalJSON() ([]byte, error) {
+	return json.Marshal(jsonPacket{Type: PtypeName(PTYPE_EPQUERY), Flags: p.Flags, Eid: &p.Eid})
+}
+
+func (p *EpQueryPacket) UnmarshalJSON(b []byte) error {
+	jp, err := unmarshalPacket(PTYPE_EPQUERY, b)
+	if err != nil {
+		return err
+	}
+	p.Flags, p.Eid = jp.Flags, *jp.Eid
+	return nil
+}
+
+func (v Value) MarshalJSON() ([]byte, error) {
+	v, err := NewValue(v.Dtype, v.Data)
+	if err != nil {
+		return nil, err
+	}
+	value, err := marshalData(v.Data)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(jsonValue{DtypeName(v.Dtype), value})
+}
+
+func (v *Value) UnmarshalJSON(b []byte) error {
+	var jv jsonValue
+	err := json.Unmarshal(b, &jv)
+	if err != nil {
+		return err
+	}
+	dtype, err := ParseDtype(jv.Datatype)
+	if err != nil {
+		return err
+	}
+	data, err := unmarshalData(dtype, jv.Value)
+	if err != nil {
+		return err
+	}
+	v.Dtype, v.Data = dtype, data
+	return nil
+}
+
+func (e EID) MarshalJSON() ([]byte, error) {
+	return json.Marshal(jsonEid{e.Eid, DtypeName(e.Dtype), e.Desc, e.Writable})
+}
+
+func (e *EID) UnmarshalJSON(b []byte) error {
+	var je jsonEid
+	err := json.Unmarshal(b, &je)
+	if err != nil {
+		return err
+	}
+	dtype, err := ParseDtype(je.Datatype)
+	if err != nil {
+		return err
+	}
+	e.Eid, e.Dtype, e.Desc, e.Writable = je.Eid, dtype, je.Description, je.Writable
+	return nil
+}
+
+func (p EpPropQueryPacket) MarshalJSON() ([]byte, error) {
+	return json.Marshal(jsonPacket{Type: PtypeName(PTYPE_EPPROPQUERY), Flags: p.Flags, Eid: &p.Eid, Property: &p.PropId})
+}
+
+func (p *EpPropQueryPacket) UnmarshalJSON(b []byte) error {
+	jp, err := unmarshalPacket(PTYPE_EPPROPQUERY, b)
+	if err != nil {
+		return err
+	}
+	if jp.Property == nil {
+		return Error(HXB_ERR_INVALID_VALUE)
+	}
+	p.Flags, p.Eid, p.PropId = jp.Flags, *jp.Eid, *jp.Property
+	return nil
+}
+
+func (p EpPropReportPacket) MarshalJSON() ([]byte, error) {
+	jp, err := payloadJSON(PTYPE_EPPROPREPORT, p.Flags, p.Eid, p.Dtype, p.Data)
+	if err != nil {
+		return nil, err
+	}
+	jp.Property = &p.PropId
+	return json.Marshal(jp)
+}
+
+func (p *EpPropReportPacket) UnmarshalJSON(b []byte) error {
+	jp, dtype, data, err := unmarshalPayload(PTYPE_EPPROPREPORT, b)
+	if err != nil {
+		return err
+	}
+	if jp.Property == nil {
+		return Error(HXB_ERR_INVALID_VALUE)
+	}
+	p.Flags, p.Eid, p.Dtype, p.PropId, p.Data = jp.Flags, *jp.Eid, dtype, *jp.Property, data
+	return nil
+}
+
+func (p EpPropWritePacket) MarshalJSON() ([]byte, error) {
+	jp, err := payloadJSON(PTYPE_EPPROPWRITE, p.Flags, p.Eid, p.Dtype, p.Data)
+	if err != nil {
+		return nil, err
+	}
+	jp.Property = &p.PropId
+	return json.Marshal(jp)
+}
+
+func (p *EpPropWritePacket) UnmarshalJSON(b []byte) error {
+	jp, dtype, data, err := unmarshalPayload(PTYPE_EPPROPWRITE, b)
+	if err != nil {
+		return err
+	}
+	if jp.Property == nil {
+		return Error(HXB_ERR_INVALID_VALUE)
+	}
+	p.Flags, p.Eid, p.Dtype, p.PropId, p.Data = jp.Flags, *jp.Eid, dtype, *jp.Property, data
+	return nil
+}
+
+func (p ReportPacket) MarshalJSON() ([]byte, error) {
+	jp, err := payloadJSON(PTYPE_REPORT, p.Flags, p.Eid, p.Dtype, p.Data)
+	if err != nil {
+		return nil, err
+	}
+	jp.Cause = &p.Cause
+	return json.Marshal(jp)
+}
+
+func (p *ReportPacket) UnmarshalJSON(b []byte) error {
+	jp, dtype, data, err := unmarshalPayload(PTYPE_REPORT, b)
+	if err != nil {
+		return err
+	}
+	if jp.Cause == nil {
+		jp.Cause = new(uint16)
+	}
+	p.Flags, p.Eid, p.Dtype, p.Cause, p.Data = jp.Flags, *jp.Eid, dtype, *jp.Cause, data
+	return nil
+}
+
+func (p EpReportPacket) MarshalJSON() ([]byte, error) {
+	desc, ok := p.Data.(string)
+	if !ok {
+		return nil, Error(ERR_HXBDTYPE)
+	}
+	return json.Marshal(jsonPacket{Type: PtypeName(PTYPE_EPREPORT), Flags: p.Flags, Eid: &p.Eid, Datatype: DtypeName(p.Dtype), Description: &desc, Cause: &p.Cause})
+}
+
+func (p *EpReportPacket) UnmarshalJSON(b []byte) error {
+	jp, err := unmarshalPacket(PTYPE_EPREPORT, b)
+	if err != nil {
+		return err
+	}
+	dtype, err := ParseDtype(jp.Datatype)
+	if err != nil {
+		return err
+	}
+	if jp.Description == nil {
+		jp.Description = new(string)
+	}
+	if jp.Cause == nil {
+		jp.Cause = new(uint16)
+	}
+	p.Flags, p.Eid, p.Dtype, p.Cause, p.Data = jp.Flags, *jp.Eid, dtype, *jp.Cause, *jp.Description
+	return nil
+}
+
+func (p PInfoPacket) MarshalJSON() ([]byte, error) {
+	jp, err := payloadJSON(PTYPE_PINFO, p.Flags, p.Eid, p.Dtype, p.Data)
+	if err != nil {
+		return nil, err
+	}
+	jp.Origin = p.Origin.String()
+	return json.Marshal(jp)
+}
+
+func (p *PInfoPacket) UnmarshalJSON(b []byte) error {
+	jp, dtype, data, err := unmarshalPayload(PTYPE_PINFO, b)
+	if err != nil {
+		return err
+	}
+	origin := net.ParseIP(jp.Origin)
+	if origin == nil {
+		return Error(HXB_ERR_INVALID_VALUE)
+	}
+	p.Flags, p.Eid, p.Dtype, p.Origin, p.Data = jp.Flags, *jp.Eid, dtype, origin, data
+	return nil
+}
+
+func (p AckPacket) MarshalJSON() ([]byte, error) {
+	return json.Marshal(jsonPacket{Type: PtypeName(PTYPE_ACK), Flags: p.Flags, Cause: &p.Cause})
+}
+
+func (p *AckPacket) UnmarshalJSON(b []byte) error {
+	jp, err := unmarshalPacket(PTYPE_ACK, b)
+	if err != nil {
+		return err
+	}
+	if jp.Cause == nil {
+		return Error(HXB_ERR_INVALID_VALUE)
+	}
+	p.Flags, p.Cause = jp.Flags, *jp.Cause
+	return nil
+}
@@ -0,0 +1,115 @@
+package hexabus
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"testing"
+)
+
+func Test_WritePacketJSON(t *testing.T) {
+	for k, v := range data_types {
+		p_write := WritePacket{FLAG_NONE, 7, k, v.data}
+
+		b, err := json.Marshal(p_write)
+		if err != nil {
+			t.Errorf("%s", err)
+			continue
+		}
+
+		p0_write := WritePacket{}
+		err = json.Unmarshal(b, &p0_write)
+		if err != nil {
+			t.Errorf("Unmarshal of %s failed: %s", b, err)
+			continue
+		}
+
+		match := false
+		if k == DTYPE_16BYTES || k == DTYPE_66BYTES {
+			match = p0_write.Dtype == k && bytes.Equal(p_write.Data.([]byte), p0_write.Data.([]byte))
+		} else {
+			match = p0_write == p_write
+		}
+		if !match {
+			t.Errorf("WritePacket with Data type %d did not match while testing: \n Marshal: %+v \n Unmarshal: %+v \n JSON: %s \n", k, p_write, p0_write, b)
+		} else {
+			t.Logf("WritePacket JSON with Data type %d passed test: %s", k, b)
+		}
+	}
+}
+
+func Test_PacketJSON(t *testing.T) {
+	packets := map[string]Packet{
+		`{"type":"Error","flags":0,"code":2,"error":"hexabus packet write on read only eid"}`:             ErrorPacket{FLAG_NONE, HXB_ERR_WRITEREADONLY},
+		`{"type":"Info","flags":0,"eid":2,"datatype":"Float","value":10.10293}`:                           InfoPacket{FLAG_NONE, 2, DTYPE_FLOAT, float32(10.10293)},
+		`{"type":"Query","flags":0,"eid":0}`:                                                              QueryPacket{FLAG_NONE, 0},
+		`{"type":"EndpointInfo","flags":0,"eid":1,"datatype":"Bool","description":"Switch"}`:              EpInfoPacket{FLAG_NONE, 1, DTYPE_BOOL, "Switch"},
+		`{"type":"EndpointQuery","flags":0,"eid":1}`:                                                      EpQueryPacket{FLAG_NONE, 1},
+		`{"type":"EndpointPropertyReport","flags":0,"eid":1,"datatype":"Bool","value":true,"property":5}`: EpPropReportPacket{FLAG_NONE, 1, DTYPE_BOOL, EP_PROP_WRITABLE, true},
+		`{"type":"Report","flags":0,"eid":2,"datatype":"UInt32","value":230,"cause":17}`:                  ReportPacket{FLAG_NONE, 2, DTYPE_UINT32, 17, uint32(230)},
+	}
+	for expected, p := range packets {
+		b, err := json.Marshal(p)
+		if err != nil {
+			t.Errorf("%s", err)
+			continue
+		}
+		if string(b) != expected {
+			t.Errorf("Marshal of %+v returned %s, expected %s", p, b, expected)
+		}
+	}
+
+	var p_info InfoPacket
+	err := json.Unmarshal([]byte(`{"type":"Info","eid":2,"datatype":"UInt8","value":256}`), &p_info)
+	if err != Error(ERR_VALUERANGE) {
+		t.Errorf("Unmarshal of out of range value returned %v", err)
+	}
+	var p_write WritePacket
+	err = json.Unmarshal([]byte(`{"type":"Info","eid":2,"datatype":"UInt8","value":1}`), &p_write)
+	if err != Error(ERR_UNKNOWNPTYPE) {
+		t.Errorf("Unmarshal of Info into WritePacket returned %v", err)
+	}
+}
+
+func Test_EIDJSON(t *testing.T) {
+	eid := EID{1, DTYPE_BOOL, "Main Switch", true}
+	b, err := json.Marshal(eid)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	var eid0 EID
+	err = json.Unmarshal(b, &eid0)
+	if err != nil || eid0 != eid {
+		t.Errorf("EID JSON %s did not match: %+v, %v", b, eid0, err)
+	}
+}
+
+func Test_NonFiniteJSON(t *testing.T) {
+	values := map[string]Value{
+		`{"datatype":"Float","value":"NaN"}`:   {DTYPE_FLOAT, float32(math.NaN())},
+		`{"datatype":"Float","value":"+Inf"}`:  {DTYPE_FLOAT, float32(math.Inf(1))},
+		`{"datatype":"Double","value":"-Inf"}`: {DTYPE_DOUBLE, math.Inf(-1)},
+	}
+	for expected, v := range values {
+		b, err := json.Marshal(v)
+		if err != nil || string(b) != expected {
+			t.Errorf("Marshal of %v returned %s, %v, expected %s", v, b, err, expected)
+			continue
+		}
+		var v0 Value
+		err = json.Unmarshal(b, &v0)
+		if err != nil || v0.String() != v.String() {
+			t.Errorf("Unmarshal of %s returned %v, %v", b, v0, err)
+		}
+	}
+
+	b, err := json.Marshal(InfoPacket{FLAG_NONE, 3, DTYPE_FLOAT, float32(math.NaN())})
+	if err != nil || string(b) != `{"type":"Info","flags":0,"eid":3,"datatype":"Float","value":"NaN"}` {
+		t.Errorf("Marshal of NaN Info Packet returned %s, %v", b, err)
+	}
+	var v Value
+	err = json.Unmarshal([]byte(`{"datatype":"Float","value":"warm"}`), &v)
+	if err != Error(HXB_ERR_INVALID_VALUE) {
+		t.Errorf("Unmarshal of invalid float returned %v", err)
+	}
+}
@@ -0,0 +1,150 @@
+package hexabus
+
+import (
+	"net"
+	"strconv"
+	"sync"
+)
+
+// Event is a datagram received by a Listener.
+type Event struct {
+	Addr   *net.UDPAddr // source address
+	Packet Packet       // decoded packet, nil if Err is set
+	Err    error        // decode error of a malformed datagram
+}
+
+// DeviceAddress returns the address of the sender of a packet the way
+// Client methods take it, the port is only included if it isn't PORT.
+func DeviceAddress(addr *net.UDPAddr) string {
+	host := addr.IP.String()
+	if addr.Zone != "" {
+		host += "%" + addr.Zone
+	}
+	if strconv.Itoa(addr.Port) == PORT {
+		return host
+	}
+	return net.JoinHostPort(host, strconv.Itoa(addr.Port))
+}
+
+// NormalizeAddress returns a device address the way DeviceAddress returns
+// the sender of packets from it, so configured addresses match the ones
+// packets are received from. Addresses that can't be resolved are returned
+// unchanged.
+func NormalizeAddress(address string) string {
+	if ip := net.ParseIP(address); ip != nil {
+		return ip.String()
+	}
+	addr, err := net.ResolveUDPAddr("udp6", address)
+	if err != nil {
+		return address
+	}
+	return DeviceAddress(addr)
+}
+
+// Listener receives the packets Hexabus devices broadcast to the multicast
+// group and delivers them as Events.
+type Listener struct {
+	conn   *net.UDPConn
+	events chan Event
+	done   chan struct{}
+	once   sync.Once
+	seen   seqWindow
+}
+
+// Listen joins the Hexabus multicast group on the interface iface, or on the
+// system default interface if iface is empty, and starts receiving.
+func Listen(iface string) (*Listener, error) {
+	var ifi *net.Interface
+	if iface != "" {
+		var err error
+		ifi, err = net.InterfaceByName(iface)
+		if err != nil {
+			return nil, err
+		}
+	}
+	group, err := net.ResolveUDPAddr("udp6", net.JoinHostPort(MULTICAST_GROUP, PORT))
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenMulticastUDP("udp6", ifi, group)
+	if err != nil {
+		return nil, err
+	}
+	return NewListener(conn), nil
+}
+
+// NewListener starts receiving on an already opened socket, this allows to
+// listen for unicast packets as well.
+func NewListener(conn *net.UDPConn) *Listener {
+	l := &Listener{
+		conn:   conn,
+		events: make(chan Event, 64),
+		done:   make(chan struct{}),
+	}
+	go l.receive()
+	return l
+}
+
+// Events returns the channel received packets are delivered on, it is
+// closed when the Listener is closed.
+func (l *Listener) Events() <-chan Event {
+	return l.events
+}
+
+// Addr returns the local address of the Listener.
+func (l *Listener) Addr() net.Addr {
+	return l.conn.LocalAddr()
+}
+
+// Close leaves the multicast group and stops receiving.
+func (l *Listener) Close() error {
+	var err error
+	l.once.Do(func() {
+		close(l.done)
+		err = l.conn.Close()
+	})
+	return err
+}
+
+// decode every received datagram, malformed ones are delivered with Err set.
+// Reliable packets are acknowledged and delivered once.
+func (l *Listener) receive() {
+	defer close(l.events)
+	buf := make([]byte, 1500)
+	for {
+		n, raddr, err := l.conn.ReadFromUDP(buf)
+		if err != nil {
+			select {
+			case <-l.done:
+				return
+			default:
+			}
+			if opErr, ok := err.(net.Error); ok && opErr.Timeout() {
+				continue
+			}
+			l.deliver(Event{Addr: raddr, Err: err})
+			return
+		}
+		packet := append([]byte(nil), buf[:n]...)
+		p, err := Decode(packet)
+		if err != nil {
+			l.deliver(Event{Addr: raddr, Err: err})
+			continue
+		}
+		if seq, ok := Sequence(packet); ok {
+			sendAck(l.conn, raddr, seq)
+			if l.seen.duplicate(raddr, seq) {
+				continue
+			}
+		}
+		l.deliver(Event{Addr: raddr, Packet: p})
+	}
+}
+
+// hand an event to the consumer unless the Listener is closed
+func (l *Listener) deliver(ev Event) {
+	select {
+	case l.events <- ev:
+	case <-l.done:
+	}
+}
@@ -0,0 +1,90 @@
+package hexabus
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func Test_Listener(t *testing.T) {
+	conn, err := net.ListenUDP("udp6", &net.UDPAddr{IP: net.IPv6loopback})
+	if err != nil {
+		t.Skipf("no udp6 loopback: %s", err)
+	}
+	l := NewListener(conn)
+	defer l.Close()
+
+	sender, err := net.DialUDP("udp6", nil, l.Addr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer sender.Close()
+
+	info, _ := InfoPacket{FLAG_NONE, 2, DTYPE_UINT32, uint32(42)}.Bytes()
+	sender.Write([]byte{0x48, 0x58, 0x30})
+	sender.Write(info)
+
+	timeout := time.After(time.Second)
+	select {
+	case ev := <-l.Events():
+		if !errors.Is(ev.Err, Error(ERR_PKTLENGTH)) || ev.Packet != nil {
+			t.Errorf("malformed datagram delivered as %+v", ev)
+		}
+	case <-timeout:
+		t.Fatalf("no event for malformed datagram")
+	}
+	select {
+	case ev := <-l.Events():
+		if ev.Err != nil {
+			t.Fatalf("%s", ev.Err)
+		}
+		p, ok := ev.Packet.(*InfoPacket)
+		if !ok || p.Eid != 2 || p.Data != uint32(42) {
+			t.Errorf("received %+v, expected Info Packet for EID 2", ev.Packet)
+		}
+		if ev.Addr.String() != sender.LocalAddr().String() {
+			t.Errorf("source address %s, expected %s", ev.Addr, sender.LocalAddr())
+		}
+	case <-timeout:
+		t.Fatalf("no event for Info Packet")
+	}
+
+	l.Close()
+	for range l.Events() {
+	}
+}
+
+func Test_DeviceAddress(t *testing.T) {
+	tests := []struct {
+		addr     *net.UDPAddr
+		expected string
+	}{
+		{&net.UDPAddr{IP: net.ParseIP("fd00::1"), Port: 61616}, "fd00::1"},
+		{&net.UDPAddr{IP: net.ParseIP("fd00::1"), Port: 4000}, "[fd00::1]:4000"},
+		{&net.UDPAddr{IP: net.ParseIP("fe80::1"), Port: 61616, Zone: "eth0"}, "fe80::1%eth0"},
+	}
+	for _, test := range tests {
+		if address := DeviceAddress(test.addr); address != test.expected {
+			t.Errorf("DeviceAddress(%s) returned %s, expected %s", test.addr, address, test.expected)
+		}
+	}
+}
+
+func Test_NormalizeAddress(t *testing.T) {
+	tests := []struct {
+		address  string
+		expected string
+	}{
+		{"fd00:0::1", "fd00::1"},
+		{"[fd00:0::1]:61616", "fd00::1"},
+		{"[fd00::1]:4000", "[fd00::1]:4000"},
+		{"fd00::1:4000", "fd00::1:4000"},
+		{"not an address", "not an address"},
+	}
+	for _, test := range tests {
+		if address := NormalizeAddress(test.address); address != test.expected {
+			t.Errorf("NormalizeAddress(%s) returned %s, expected %s", test.address, address, test.expected)
+		}
+	}
+}
@@ -0,0 +1,199 @@
+// Package mqtt bridges Hexabus devices to an MQTT broker.
+//
+// Every Info Packet received by a hexabus.Listener is published as
+//
+//	<prefix>/<device>/<eid>         {"datatype":"Float","value":21.5}
+//
+// with the value in the JSON encoding of hexabus.Value. The device is the
+// address of the sender, followed by the port in brackets notation like
+// [fd00::1]:4000 if it doesn't use hexabus.PORT. Messages on
+//
+//	<prefix>/<device>/<eid>/set
+//
+// are written to the endpoint: a JSON encoded hexabus.Value is written with
+// its data type, any other payload like on, 1 or 21.5 is converted to the
+// data type of the endpoint, see hexabus.Client.Set. Failed writes are
+// published as text on <prefix>/<device>/<eid>/error.
+//
+// The endpoints of known devices, as returned by hexabus.QueryEids, are
+// published as retained JSON array on <prefix>/<device>/eids, so MQTT
+// clients can discover them.
+package mqtt
+
+import (
+	"context"
+	"encoding/json"
+	paho "github.com/eclipse/paho.mqtt.golang"
+	"github.com/morriswinkler/hexabus"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Topics used by the Bridge.
+const (
+	// first topic level, if no other prefix is set
+	TOPIC_PREFIX = "hexabus"
+
+	// last topic level of writes to an endpoint
+	TOPIC_SET = "set"
+
+	// last topic level of failed writes
+	TOPIC_ERROR = "error"
+
+	// last topic level of the retained endpoint list of a device
+	TOPIC_EIDS = "eids"
+)
+
+// Bridge publishes the values Hexabus devices send and writes the values
+// published on the set topics to the devices.
+type Bridge struct {
+	// connected MQTT client
+	MQTT paho.Client
+
+	// client writing to the devices, hexabus.DefaultClient if nil
+	Client *hexabus.Client
+
+	// first topic level, TOPIC_PREFIX if empty
+	Prefix string
+
+	// endpoints announced on the eids topic, keyed by device address
+	Devices map[string][]hexabus.EID
+
+	// quality of service of published messages and subscriptions
+	QoS byte
+
+	// retain the published values, so new subscribers get the last one
+	Retain bool
+
+	// called with every failed publish of a value or write error
+	Failed func(error)
+}
+
+// Run publishes the endpoints of the Devices, subscribes to the set topics
+// and publishes the Info Packets of l until ctx is done, which is returned
+// as ctx.Err(), or l is closed. Pending writes are finished or aborted
+// before Run returns. A value that can't be published, like while the
+// broker is unreachable, doesn't stop the bridge, it is passed to Failed.
+func (b *Bridge) Run(ctx context.Context, l *hexabus.Listener) error {
+	ctx, cancel := context.WithCancel(ctx)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	closed := false
+	defer func() {
+		// messages may still arrive after Unsubscribe, don't start writes
+		// once Run waits for them
+		mu.Lock()
+		closed = true
+		mu.Unlock()
+		wg.Wait()
+	}()
+	defer cancel()
+
+	for address, eids := range b.Devices {
+		payload, err := json.Marshal(eids)
+		if err != nil {
+			return err
+		}
+		err = wait(ctx, b.MQTT.Publish(b.topic(hexabus.NormalizeAddress(address), TOPIC_EIDS), b.QoS, true, payload))
+		if err != nil {
+			return err
+		}
+	}
+
+	filter := b.prefix() + "/+/+/" + TOPIC_SET
+	err := wait(ctx, b.MQTT.Subscribe(filter, b.QoS, func(_ paho.Client, msg paho.Message) {
+		// writes wait for the answer of the device, don't block the MQTT client
+		mu.Lock()
+		defer mu.Unlock()
+		if closed {
+			return
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			b.set(ctx, msg.Topic(), msg.Payload())
+		}()
+	}))
+	if err != nil {
+		return err
+	}
+	defer b.MQTT.Unsubscribe(filter)
+
+	for {
+		select {
+		case ev, ok := <-l.Events():
+			if !ok {
+				return nil
+			}
+			p, ok := ev.Packet.(*hexabus.InfoPacket)
+			if !ok {
+				continue
+			}
+			payload, err := json.Marshal(hexabus.Value{Dtype: p.Dtype, Data: p.Data})
+			if err != nil {
+				continue
+			}
+			b.publish(ctx, b.topic(hexabus.DeviceAddress(ev.Addr), strconv.FormatUint(uint64(p.Eid), 10)), b.Retain, payload)
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// write the payload of a set topic to the endpoint
+func (b *Bridge) set(ctx context.Context, topic string, payload []byte) {
+	levels := strings.Split(strings.TrimPrefix(topic, b.prefix()+"/"), "/")
+	if len(levels) != 3 {
+		return
+	}
+	address := levels[0]
+
+	c := b.Client
+	if c == nil {
+		c = hexabus.DefaultClient
+	}
+
+	eid, err := strconv.ParseUint(levels[1], 10, 32)
+	if err == nil {
+		var v hexabus.Value
+		if json.Unmarshal(payload, &v) == nil {
+			err = c.WriteContext(ctx, address, uint32(eid), v)
+		} else {
+			err = c.SetContext(ctx, address, uint32(eid), string(payload))
+		}
+	}
+	if err != nil && ctx.Err() == nil {
+		b.publish(ctx, b.topic(address, levels[1], TOPIC_ERROR), false, err.Error())
+	}
+}
+
+// publish a message and pass a failure to Failed
+func (b *Bridge) publish(ctx context.Context, topic string, retained bool, payload interface{}) {
+	err := wait(ctx, b.MQTT.Publish(topic, b.QoS, retained, payload))
+	if err != nil && ctx.Err() == nil && b.Failed != nil {
+		b.Failed(err)
+	}
+}
+
+func (b *Bridge) prefix() string {
+	if b.Prefix == "" {
+		return TOPIC_PREFIX
+	}
+	return b.Prefix
+}
+
+// topic of the levels below the prefix
+func (b *Bridge) topic(levels ...string) string {
+	return b.prefix() + "/" + strings.Join(levels, "/")
+}
+
+// wait for an MQTT operation to complete
+func wait(ctx context.Context, t paho.Token) error {
+	select {
+	case <-t.Done():
+		return t.Error()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,313 @@
+package mqtt
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	paho "github.com/eclipse/paho.mqtt.golang"
+	"github.com/morriswinkler/hexabus"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// in-process MQTT 3.1.1 broker, just enough for the bridge: QoS 0 delivery,
+// retained messages and wildcard subscriptions
+type broker struct {
+	ln       net.Listener
+	mu       sync.Mutex
+	subs     map[net.Conn][]string
+	retained map[string][]byte
+}
+
+func startBroker(t *testing.T) *broker {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %s", err)
+	}
+	b := &broker{ln: ln, subs: map[net.Conn][]string{}, retained: map[string][]byte{}}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go b.serve(conn)
+		}
+	}()
+	return b
+}
+
+func (b *broker) url() string {
+	return "tcp://" + b.ln.Addr().String()
+}
+
+func (b *broker) close() {
+	b.ln.Close()
+	b.mu.Lock()
+	for conn := range b.subs {
+		conn.Close()
+	}
+	b.mu.Unlock()
+}
+
+func (b *broker) serve(conn net.Conn) {
+	b.mu.Lock()
+	b.subs[conn] = nil
+	b.mu.Unlock()
+	defer func() {
+		b.mu.Lock()
+		delete(b.subs, conn)
+		b.mu.Unlock()
+		conn.Close()
+	}()
+
+	r := bufio.NewReader(conn)
+	for {
+		header, err := r.ReadByte()
+		if err != nil {
+			return
+		}
+		length, err := binary.ReadUvarint(r)
+		if err != nil {
+			return
+		}
+		body := make([]byte, length)
+		if _, err := io.ReadFull(r, body); err != nil {
+			return
+		}
+
+		switch header >> 4 {
+		case 1: // CONNECT
+			b.send(conn, 0x20, []byte{0, 0})
+		case 3: // PUBLISH
+			topic, rest := str(body)
+			if qos := header >> 1 & 3; qos > 0 {
+				b.send(conn, 0x40, rest[:2])
+				rest = rest[2:]
+			}
+			b.publish(topic, rest, header&1 == 1)
+		case 8: // SUBSCRIBE
+			id, rest := body[:2], body[2:]
+			granted := []byte{}
+			for len(rest) > 0 {
+				var filter string
+				filter, rest = str(rest)
+				rest = rest[1:]
+				granted = append(granted, 0)
+				b.mu.Lock()
+				b.subs[conn] = append(b.subs[conn], filter)
+				b.mu.Unlock()
+			}
+			b.send(conn, 0x90, append(id, granted...))
+			b.mu.Lock()
+			for topic, payload := range b.retained {
+				if b.matches(conn, topic) {
+					b.send(conn, 0x31, message(topic, payload))
+				}
+			}
+			b.mu.Unlock()
+		case 10: // UNSUBSCRIBE
+			b.send(conn, 0xb0, body[:2])
+		case 12: // PINGREQ
+			b.send(conn, 0xd0, nil)
+		case 14: // DISCONNECT
+			return
+		}
+	}
+}
+
+func (b *broker) publish(topic string, payload []byte, retain bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if retain {
+		b.retained[topic] = payload
+	}
+	for conn := range b.subs {
+		if b.matches(conn, topic) {
+			b.send(conn, 0x30, message(topic, payload))
+		}
+	}
+}
+
+func (b *broker) matches(conn net.Conn, topic string) bool {
+	for _, filter := range b.subs[conn] {
+		if match(filter, topic) {
+			return true
+		}
+	}
+	return false
+}
+
+func (b *broker) send(conn net.Conn, header byte, body []byte) {
+	packet := binary.AppendUvarint([]byte{header}, uint64(len(body)))
+	conn.Write(append(packet, body...))
+}
+
+// length prefixed string at the start of b
+func str(b []byte) (string, []byte) {
+	n := int(binary.BigEndian.Uint16(b))
+	return string(b[2 : 2+n]), b[2+n:]
+}
+
+// body of a QoS 0 PUBLISH
+func message(topic string, payload []byte) []byte {
+	body := binary.BigEndian.AppendUint16(nil, uint16(len(topic)))
+	return append(append(body, topic...), payload...)
+}
+
+func match(filter, topic string) bool {
+	f, t := strings.Split(filter, "/"), strings.Split(topic, "/")
+	for i := range f {
+		if f[i] == "#" {
+			return true
+		}
+		if i >= len(t) || (f[i] != "+" && f[i] != t[i]) {
+			return false
+		}
+	}
+	return len(f) == len(t)
+}
+
+type received struct {
+	topic   string
+	payload string
+}
+
+func connect(t *testing.T, url string, id string) paho.Client {
+	c := paho.NewClient(paho.NewClientOptions().AddBroker(url).SetClientID(id))
+	token := c.Connect()
+	if !token.WaitTimeout(2*time.Second) || token.Error() != nil {
+		t.Fatalf("connecting to %s failed: %v", url, token.Error())
+	}
+	return c
+}
+
+func Test_Bridge(t *testing.T) {
+	mb := startBroker(t)
+	defer mb.close()
+
+	// hexabus device with a relay and a temperature sensor
+	conn, err := net.ListenUDP("udp6", &net.UDPAddr{IP: net.IPv6loopback})
+	if err != nil {
+		t.Skipf("no udp6 loopback: %s", err)
+	}
+	d := hexabus.NewDevice("Bridged")
+	relay := make(chan interface{}, 4)
+	d.Register(hexabus.Endpoint{Eid: 1, Dtype: hexabus.DTYPE_BOOL, Desc: "Relay",
+		Read:  func() (interface{}, error) { return false, nil },
+		Write: func(v interface{}) error { relay <- v; return nil }})
+	d.Register(hexabus.Endpoint{Eid: 3, Dtype: hexabus.DTYPE_FLOAT, Desc: "Temperature",
+		Read: func() (interface{}, error) { return float32(21.5), nil }})
+	go d.Serve(conn)
+	defer d.Close()
+	address := conn.LocalAddr().String()
+
+	lconn, err := net.ListenUDP("udp6", &net.UDPAddr{IP: net.IPv6loopback})
+	if err != nil {
+		t.Fatalf("ListenUDP failed: %s", err)
+	}
+	l := hexabus.NewListener(lconn)
+	defer l.Close()
+
+	// everything the bridge publishes
+	observer := connect(t, mb.url(), "observer")
+	defer observer.Disconnect(0)
+	messages := make(chan received, 16)
+	observer.Subscribe("hexabus/#", 0, func(_ paho.Client, msg paho.Message) {
+		messages <- received{msg.Topic(), string(msg.Payload())}
+	}).Wait()
+	next := func() received {
+		select {
+		case m := <-messages:
+			return m
+		case <-time.After(2 * time.Second):
+			t.Fatalf("no message published")
+		}
+		return received{}
+	}
+
+	client := &hexabus.Client{Timeout: 100 * time.Millisecond}
+	defer client.Close()
+	eids, err := client.QueryEids(address, 8)
+	if err != nil {
+		t.Fatalf("QueryEids failed: %s", err)
+	}
+	failed := make(chan error, 4)
+	b := &Bridge{
+		MQTT:    connect(t, mb.url(), "bridge"),
+		Client:  client,
+		Devices: map[string][]hexabus.EID{address: eids},
+		Failed:  func(err error) { failed <- err },
+	}
+	defer b.MQTT.Disconnect(0)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- b.Run(ctx, l) }()
+
+	m := next()
+	expected := `[{"eid":0,"datatype":"UInt32","description":"Bridged","writable":false},{"eid":1,"datatype":"Bool","description":"Relay","writable":true},{"eid":3,"datatype":"Float","description":"Temperature","writable":false}]`
+	if m.topic != "hexabus/"+address+"/eids" || m.payload != expected {
+		t.Errorf("discovery published %+v", m)
+	}
+	mb.mu.Lock()
+	if string(mb.retained[m.topic]) != expected {
+		t.Errorf("discovery wasn't retained")
+	}
+	mb.mu.Unlock()
+
+	// the device broadcasts its temperature
+	packet, _ := hexabus.InfoPacket{Eid: 3, Dtype: hexabus.DTYPE_FLOAT, Data: float32(21.5)}.Bytes()
+	conn.WriteTo(packet, lconn.LocalAddr())
+	m = next()
+	if m.topic != "hexabus/"+address+"/3" || m.payload != `{"datatype":"Float","value":21.5}` {
+		t.Errorf("Info Packet published %+v", m)
+	}
+
+	set := func(eid string, payload string) {
+		t.Helper()
+		token := observer.Publish("hexabus/"+address+"/"+eid+"/set", 0, false, payload)
+		token.Wait()
+		if m := next(); m.topic != "hexabus/"+address+"/"+eid+"/set" {
+			t.Errorf("published %+v instead of the write", m)
+		}
+	}
+	set("1", "on")
+	set("1", `{"datatype":"Bool","value":false}`)
+	for _, expected := range []bool{true, false} {
+		select {
+		case v := <-relay:
+			if v != expected {
+				t.Errorf("relay was set to %v, expected %v", v, expected)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("relay was not written")
+		}
+	}
+
+	set("3", "20")
+	m = next()
+	if m.topic != "hexabus/"+address+"/3/error" || !strings.Contains(m.payload, "read only") {
+		t.Errorf("write of read only endpoint published %+v", m)
+	}
+
+	// values that can't be published are reported, the bridge keeps running
+	b.MQTT.Disconnect(0)
+	conn.WriteTo(packet, lconn.LocalAddr())
+	select {
+	case err := <-failed:
+		if err == nil {
+			t.Errorf("Failed was called without error")
+		}
+	case <-time.After(2 * time.Second):
+		t.Errorf("failed publish was not reported")
+	}
+
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Errorf("Run returned %v", err)
+	}
+}
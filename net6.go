@@ -1,9 +1,9 @@
 package hexabus
 
 import (
+	"context"
+	"errors"
 	"net"
-	"regexp"
-	"time"
 )
 
 // Defaults used by the network communication.
@@ -11,6 +11,9 @@ const (
 	// hexabus default port
 	PORT = "61616"
 
+	// multicast group hexabus devices broadcast their Info Packets to
+	MULTICAST_GROUP = "ff02::1"
+
 	// package transmit timeout
 	NET_TIMEOUT = 3
 )
@@ -23,10 +26,76 @@ type EID struct {
 	Writable bool   // writeable
 }
 
+// Writability detection used by QueryEids.
+const (
+	// write a value with a mismatching data type and interpret the error,
+	// this changes the state of devices that accept the value
+	PROBE_WRITE = 0
+
+	// query the EP_PROP_WRITABLE property, if the device doesn't support
+	// endpoint properties the catalog of known EID's is used. EID's missing
+	// from the catalog are returned read only and reported as *EidError with
+	// ERR_UNCATALOGED.
+	PROBE_PROPERTY = 1
+)
+
+// property queries that have to time out, without the device ever answering
+// one, before QueryEids considers it to lack property support
+const PROPERTY_TIMEOUTS = 2
+
+// DefaultCatalog holds the well known EID's of hexabus devices.
+var DefaultCatalog = map[uint32]EID{
+	1: {1, DTYPE_BOOL, "Main Switch", true},
+	2: {2, DTYPE_UINT32, "Power Meter", false},
+	3: {3, DTYPE_FLOAT, "Temperature Sensor", false},
+	4: {4, DTYPE_BOOL, "Internal Button", false},
+	5: {5, DTYPE_FLOAT, "Humidity Sensor", false},
+}
+
+// QueryEids queries all EID's below eid_qty of the device at address, using
+// the DefaultClient.
 func QueryEids(address string, eid_qty uint16) ([]EID, error) {
+	return DefaultClient.QueryEidsContext(context.Background(), address, eid_qty)
+}
+
+// QueryEidsContext is like QueryEids but aborts when ctx is done.
+func QueryEidsContext(ctx context.Context, address string, eid_qty uint16) ([]EID, error) {
+	return DefaultClient.QueryEidsContext(ctx, address, eid_qty)
+}
+
+// QueryEids queries all EID's below eid_qty of the device at address and
+// returns their data type, description and if they are writable. EID's that
+// failed are returned as EidErrors along with the others, an EID whose
+// writability couldn't be found out is returned read only and in EidErrors.
+func (c *Client) QueryEids(address string, eid_qty uint16) ([]EID, error) {
+	return c.QueryEidsContext(context.Background(), address, eid_qty)
+}
+
+// QueryEidsContext is like QueryEids but aborts when ctx is done.
+func (c *Client) QueryEidsContext(ctx context.Context, address string, eid_qty uint16) ([]EID, error) {
+	return c.QueryEidsProbe(ctx, address, eid_qty, c.Probe)
+}
+
+// QueryEidsProbe is like QueryEidsContext but finds out if the EID's are
+// writable with probe, PROBE_*, instead of the Probe of the client.
+func (c *Client) QueryEidsProbe(ctx context.Context, address string, eid_qty uint16, probe int) ([]EID, error) {
+	eid_map, eid_errors, err := c.scanEids(ctx, address, eid_qty, probe)
+	if err != nil {
+		return nil, err
+	}
+	if len(eid_errors) > 0 {
+		return eid_map, EidErrors(eid_errors)
+	}
+	return eid_map, nil
+}
+
+// query all EID's below eid_qty, a failure of a single EID doesn't abort
+// the scan and is returned as *EidError, EID's with unknown writability are
+// returned read only as well. err is set if the device didn't
+// answer the first descriptor or ctx is done
+func (c *Client) scanEids(ctx context.Context, address string, eid_qty uint16, probe int) (eid_map []EID, eid_errors []*EidError, err error) {
 	eid_mask := []uint16{}
 	eid_descriptors := []uint16{}
-	eid_map := []EID{}
 
 	// find all EID's in eid_qty that are 0 or can be multiplyed by 32
 	for i := uint16(0); i < eid_qty; i = i + 32 {
@@ -35,181 +104,207 @@ func QueryEids(address string, eid_qty uint16) ([]EID, error) {
 
 	// build eid_mask to check what EID's are available
 	for _, descriptor := range eid_descriptors {
-		pq := QueryPacket{FLAG_NONE, uint32(descriptor)}
-		result, err := pq.Send(address)
+		pi, err := c.QueryContext(ctx, address, uint32(descriptor))
+		if errors.Is(err, Error(HXB_ERR_UNKNOWNEID)) && descriptor > 0 {
+			// the device has no EID's beyond this descriptor
+			break
+		}
+		if err != nil && (descriptor == 0 || ctx.Err() != nil) {
+			return nil, nil, err
+		}
+		var mask uint32
+		if err == nil {
+			// the descriptor is a bitmask, LSB is the descriptor EID itself
+			var ok bool
+			mask, ok = pi.Data.(uint32)
+			if !ok {
+				err = Error(HXB_ERR_DATATYPE)
+			}
+		}
 		if err != nil {
-			return nil, err
+			eid_errors = append(eid_errors, &EidError{uint32(descriptor), err})
 		}
-		// change byte order to read LSB first
-		result = result[len(result)-6 : len(result)-2]
-		result = []byte{result[3], result[2], result[1], result[0]}
-
-		for _, bit := range result {
-			eid_mask = append(eid_mask, uint16((bit)&1))
-			eid_mask = append(eid_mask, uint16((bit>>1)&1))
-			eid_mask = append(eid_mask, uint16((bit>>2)&1))
-			eid_mask = append(eid_mask, uint16((bit>>3)&1))
-			eid_mask = append(eid_mask, uint16((bit>>4)&1))
-			eid_mask = append(eid_mask, uint16((bit>>5)&1))
-			eid_mask = append(eid_mask, uint16((bit>>6)&1))
-			eid_mask = append(eid_mask, uint16((bit>>7)&1))
+		for bit := uint(0); bit < 32; bit++ {
+			eid_mask = append(eid_mask, uint16((mask>>bit)&1))
 		}
 	}
 
 	// query all availabel EID's and build a map of struc EID
+	props := &propSupport{}
 	for eid, avlb := range eid_mask {
 		if avlb == 1 {
-			result, err := EpQueryPacket{0, uint32(eid)}.Send(address)
-			if err != nil {
-				return nil, err
+			pei, err := c.EpQueryContext(ctx, address, uint32(eid))
+			if ctx.Err() != nil {
+				return eid_map, eid_errors, ctx.Err()
 			}
-			pei := EpInfoPacket{}
-			err = pei.Decode(result)
 			if err != nil {
-				return nil, err
-			}
-			var data interface{}
-			if pei.Dtype != DTYPE_UINT8 {
-				data = uint8(1)
-			} else {
-				data = uint32(1)
+				eid_errors = append(eid_errors, &EidError{uint32(eid), err})
+				continue
 			}
 
 			// check if endpoint is writable
-			err = WritePacket{FLAG_NONE, uint32(eid), DTYPE_UNDEFINED, data}.Send(address)
-			if err == Error(0x02) {
-				eid_map = append(eid_map, EID{uint32(eid), pei.Dtype, pei.Data.(string), false})
-			} else if err == Error(0x04) {
-				eid_map = append(eid_map, EID{uint32(eid), pei.Dtype, pei.Data.(string), true})
+			var writable bool
+			if probe == PROBE_PROPERTY {
+				writable, err = c.writableProperty(ctx, address, uint32(eid), props)
 			} else {
-				return nil, err
+				writable, err = c.writableProbe(ctx, address, uint32(eid), pei.Dtype)
+			}
+			if ctx.Err() != nil {
+				return eid_map, eid_errors, ctx.Err()
+			}
+			if err != nil {
+				eid_errors = append(eid_errors, &EidError{uint32(eid), err})
 			}
+			eid_map = append(eid_map, EID{uint32(eid), pei.Dtype, pei.Data.(string), writable})
 		}
 	}
 
-	return eid_map, nil
+	return eid_map, eid_errors, nil
 }
 
-func (p QueryPacket) Send(address string) ([]byte, error) {
+// check if an endpoint is writable by writing a value with a data type that
+// doesn't fit the endpoint
+func (c *Client) writableProbe(ctx context.Context, address string, eid uint32, dtype byte) (bool, error) {
+	var data interface{}
+	if dtype != DTYPE_UINT8 {
+		data = uint8(1)
+	} else {
+		data = uint32(1)
+	}
+	err := c.write(ctx, address, WritePacket{FLAG_NONE, eid, DTYPE_UNDEFINED, data}, eid)
+	if errors.Is(err, Error(HXB_ERR_WRITEREADONLY)) {
+		return false, nil
+	} else if errors.Is(err, Error(HXB_ERR_DATATYPE)) || err == nil {
+		// no error means the device accepted the value
+		return true, nil
+	}
+	return false, err
+}
 
-	packet := p.Encode()
+// property support of a device seen during a scan
+type propSupport struct {
+	answered bool // the device answered a property query
+	timeouts int  // property queries that timed out before the first answer
+}
 
-	// check if port is set otherwhise append default hexabus port
-	var validPort = regexp.MustCompile(`:[0-9]{1,5}$`)
-	if !validPort.MatchString(address) {
-		address += ":" + PORT
+// check if an endpoint is writable with the EP_PROP_WRITABLE property. The
+// catalog is only used once the device ignored PROPERTY_TIMEOUTS queries
+// without ever answering one, other failures are returned.
+func (c *Client) writableProperty(ctx context.Context, address string, eid uint32, props *propSupport) (bool, error) {
+	for props.answered || props.timeouts < PROPERTY_TIMEOUTS {
+		p, err := c.GetPropertyContext(ctx, address, eid, EP_PROP_WRITABLE)
+		if err == nil {
+			props.answered = true
+			writable, ok := p.Data.(bool)
+			if !ok {
+				return false, Error(HXB_ERR_DATATYPE)
+			}
+			return writable, nil
+		}
+		var remote *RemoteError
+		if errors.As(err, &remote) {
+			props.answered = true
+			return false, err
+		}
+		if opErr, ok := err.(net.Error); !ok || !opErr.Timeout() || props.answered {
+			return false, err
+		}
+		props.timeouts++
 	}
-	readbuf := make([]byte, 152)
-	conn, err := net.DialTimeout("udp6", address, time.Duration(NET_TIMEOUT)*time.Second)
-	if err != nil {
-		return nil, err
+	catalog := c.Catalog
+	if catalog == nil {
+		catalog = DefaultCatalog
 	}
-
-	err = conn.SetReadDeadline(time.Now().Add(time.Duration(NET_TIMEOUT * time.Second)))
-	if err != nil {
-		return nil, err
+	known, ok := catalog[eid]
+	if !ok {
+		if eid%32 == 0 {
+			// descriptors are read only
+			return false, nil
+		}
+		return false, Error(ERR_UNCATALOGED)
 	}
+	return known.Writable, nil
+}
 
-	_, err = conn.Write(packet)
-	if err != nil {
-		return nil, err
-	}
+// Send sends the Query Packet to address using the DefaultClient and returns
+// the raw Info, Report or Error Packet the device answered with, use Decode
+// to tell them apart.
+func (p QueryPacket) Send(address string) ([]byte, error) {
+	return p.SendContext(context.Background(), address)
+}
 
-	n, err := conn.Read(readbuf)
+// SendContext is like Send but aborts when ctx is done.
+func (p QueryPacket) SendContext(ctx context.Context, address string) ([]byte, error) {
+	resp, err := DefaultClient.exchange(ctx, address, p, p.Eid, PTYPE_INFO, PTYPE_REPORT, PTYPE_ERROR)
 	if err != nil {
 		return nil, err
 	}
-
-	return readbuf[:n], nil
+	return resp.packet, nil
 }
 
+// Send sends the Write Packet to address using the DefaultClient, an Error
+// Packet received in response is returned as *RemoteError.
 func (p WritePacket) Send(address string) error {
+	return p.SendContext(context.Background(), address)
+}
 
-	packet, err := p.Encode()
-	if err != nil {
-		return err
-	}
-
-	// check if port is set otherwhise append default hexabus port
-	var validPort = regexp.MustCompile(`:[0-9]{1,5}$`)
-	if !validPort.MatchString(address) {
-		address += ":" + PORT
-	}
-	readbuf := make([]byte, 152)
-	conn, err := net.DialTimeout("udp6", address, time.Duration(NET_TIMEOUT)*time.Second)
-	if err != nil {
-		return err
-	}
-
-	err = conn.SetReadDeadline(time.Now().Add(time.Duration(NET_TIMEOUT * time.Second)))
-	if err != nil {
-		return err
-	}
-
-	_, err = conn.Write(packet)
-	if err != nil {
-		return err
-	}
-
-	n, err := conn.Read(readbuf)
+// SendContext is like Send but aborts when ctx is done.
+func (p WritePacket) SendContext(ctx context.Context, address string) error {
+	return DefaultClient.write(ctx, address, p, p.Eid)
+}
 
-	if err != nil {
-		if opErr, ok := err.(net.Error); ok && !opErr.Timeout() {
-			return err
-		}
-	}
+// SendReliable sends the Write Packet to address using the DefaultClient and
+// retransmits it until the device acknowledges it, an *OpError wrapping
+// Error(ERR_NOACK) is returned if it never does.
+func (p WritePacket) SendReliable(address string) error {
+	return p.SendReliableContext(context.Background(), address)
+}
 
-	if n > 0 {
-		err = checkCRC(readbuf[:n])
-		if err != nil {
-			return err
-		}
-		err = checkHeader(readbuf[:n])
-		if err != nil {
-			return err
-		}
-		ptype, err := PacketType(readbuf[:n])
-		if err != nil {
-			return err
-		}
-		if ptype == PTYPE_ERROR {
-			ep := ErrorPacket{}
-			ep.Decode(readbuf[:n])
-			return Error(ep.Error)
-		}
-	}
-	return nil
+// SendReliableContext is like SendReliable but aborts when ctx is done.
+func (p WritePacket) SendReliableContext(ctx context.Context, address string) error {
+	return DefaultClient.SendReliableContext(ctx, address, p)
 }
 
+// Send sends the Endpoint Query Packet to address using the DefaultClient and
+// returns the raw Endpoint Info, Endpoint Report or Error Packet the device
+// answered with.
 func (p EpQueryPacket) Send(address string) ([]byte, error) {
+	return p.SendContext(context.Background(), address)
+}
 
-	packet := p.Encode()
-
-	// check if port is set otherwhise append default hexabus port
-	var validPort = regexp.MustCompile(`:[0-9]{1,5}$`)
-	if !validPort.MatchString(address) {
-		address += ":" + PORT
-	}
-	readbuf := make([]byte, 152)
-	conn, err := net.DialTimeout("udp6", address, time.Duration(NET_TIMEOUT)*time.Second)
+// SendContext is like Send but aborts when ctx is done.
+func (p EpQueryPacket) SendContext(ctx context.Context, address string) ([]byte, error) {
+	resp, err := DefaultClient.exchange(ctx, address, p, p.Eid, PTYPE_EPINFO, PTYPE_EPREPORT, PTYPE_ERROR)
 	if err != nil {
 		return nil, err
 	}
+	return resp.packet, nil
+}
 
-	err = conn.SetReadDeadline(time.Now().Add(time.Duration(NET_TIMEOUT * time.Second)))
-	if err != nil {
-		return nil, err
-	}
+// GetProperty queries the property prop of eid on address using the
+// DefaultClient and returns its value.
+func GetProperty(address string, eid uint32, prop uint32) (interface{}, error) {
+	return GetPropertyContext(context.Background(), address, eid, prop)
+}
 
-	_, err = conn.Write(packet)
+// GetPropertyContext is like GetProperty but aborts when ctx is done.
+func GetPropertyContext(ctx context.Context, address string, eid uint32, prop uint32) (interface{}, error) {
+	p, err := DefaultClient.GetPropertyContext(ctx, address, eid, prop)
 	if err != nil {
 		return nil, err
 	}
+	return p.Data, nil
+}
 
-	n, err := conn.Read(readbuf)
-	if err != nil {
-		return nil, err
-	}
+// SetProperty sets the property prop of eid on address to data using the
+// DefaultClient, an Error Packet received in response is returned as
+// *RemoteError.
+// Devices are renamed by setting EP_PROP_DEVICE_NAME of EID 0.
+func SetProperty(address string, eid uint32, prop uint32, data interface{}) error {
+	return SetPropertyContext(context.Background(), address, eid, prop, data)
+}
 
-	return readbuf[:n], nil
+// SetPropertyContext is like SetProperty but aborts when ctx is done.
+func SetPropertyContext(ctx context.Context, address string, eid uint32, prop uint32, data interface{}) error {
+	return DefaultClient.SetPropertyContext(ctx, address, eid, prop, data)
 }
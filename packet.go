@@ -0,0 +1,164 @@
+package hexabus
+
+// Packet is implemented by every Hexabus packet type.
+// It gives access to the packet type code and the flags and encodes the
+// packet into its wire format.
+type Packet interface {
+	PacketType() byte       // PTYPE_* code of the packet
+	PacketFlags() byte      // flags byte of the packet
+	Bytes() ([]byte, error) // encoded packet including header and crc
+}
+
+// decoder is implemented by the pointer of every packet type
+type decoder interface {
+	Packet
+	Decode(packet []byte) error
+}
+
+// eidPacket is implemented by every packet type that carries an EID
+type eidPacket interface {
+	Packet
+	eid() uint32
+}
+
+// shortest possible packet: header, packet type, flags and crc
+const min_packet_length = 8
+
+// Decode validates header, length and checksum of a received datagram and
+// returns the decoded packet. The concrete type of the returned Packet is
+// the pointer to the packet type, like *InfoPacket for PTYPE_INFO. The
+// sequence number of reliable packets is removed, use Sequence to read it.
+// The length has to match the packet type and the data type of the payload
+// exactly, otherwise a *LengthError is returned.
+func Decode(packet []byte) (Packet, error) {
+	if len(packet) < min_packet_length {
+		e := &LengthError{Length: len(packet), Expected: min_packet_length}
+		if len(packet) > 4 {
+			e.Ptype = packet[4]
+		}
+		return nil, e
+	}
+	err := checkHeader(packet)
+	if err != nil {
+		return nil, err
+	}
+	ptype, err := PacketType(packet)
+	if err != nil {
+		return nil, err
+	}
+	packet, err = stripSeq(packet)
+	if err != nil {
+		return nil, err
+	}
+
+	var p decoder
+	switch ptype {
+	case PTYPE_ERROR:
+		p = &ErrorPacket{}
+	case PTYPE_INFO:
+		p = &InfoPacket{}
+	case PTYPE_QUERY:
+		p = &QueryPacket{}
+	case PTYPE_WRITE:
+		p = &WritePacket{}
+	case PTYPE_EPINFO:
+		p = &EpInfoPacket{}
+	case PTYPE_EPQUERY:
+		p = &EpQueryPacket{}
+	case PTYPE_EPPROPQUERY:
+		p = &EpPropQueryPacket{}
+	case PTYPE_EPPROPREPORT:
+		p = &EpPropReportPacket{}
+	case PTYPE_EPPROPWRITE:
+		p = &EpPropWritePacket{}
+	case PTYPE_PINFO:
+		p = &PInfoPacket{}
+	case PTYPE_ACK:
+		p = &AckPacket{}
+	case PTYPE_REPORT:
+		p = &ReportPacket{}
+	case PTYPE_EPREPORT:
+		p = &EpReportPacket{}
+	}
+	err = p.Decode(packet)
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p ErrorPacket) PacketType() byte  { return PTYPE_ERROR }
+func (p ErrorPacket) PacketFlags() byte { return p.Flags }
+
+func (p ErrorPacket) Bytes() ([]byte, error) { return p.Encode(), nil }
+
+func (p InfoPacket) PacketType() byte  { return PTYPE_INFO }
+func (p InfoPacket) PacketFlags() byte { return p.Flags }
+
+func (p InfoPacket) Bytes() ([]byte, error) { return p.Encode() }
+func (p InfoPacket) eid() uint32            { return p.Eid }
+
+func (p QueryPacket) PacketType() byte  { return PTYPE_QUERY }
+func (p QueryPacket) PacketFlags() byte { return p.Flags }
+
+func (p QueryPacket) Bytes() ([]byte, error) { return p.Encode(), nil }
+func (p QueryPacket) eid() uint32            { return p.Eid }
+
+func (p WritePacket) PacketType() byte  { return PTYPE_WRITE }
+func (p WritePacket) PacketFlags() byte { return p.Flags }
+
+func (p WritePacket) Bytes() ([]byte, error) { return p.Encode() }
+func (p WritePacket) eid() uint32            { return p.Eid }
+
+func (p EpInfoPacket) PacketType() byte  { return PTYPE_EPINFO }
+func (p EpInfoPacket) PacketFlags() byte { return p.Flags }
+
+func (p EpInfoPacket) Bytes() ([]byte, error) { return p.Encode() }
+func (p EpInfoPacket) eid() uint32            { return p.Eid }
+
+func (p EpQueryPacket) PacketType() byte  { return PTYPE_EPQUERY }
+func (p EpQueryPacket) PacketFlags() byte { return p.Flags }
+
+func (p EpQueryPacket) Bytes() ([]byte, error) { return p.Encode(), nil }
+func (p EpQueryPacket) eid() uint32            { return p.Eid }
+
+func (p EpPropQueryPacket) PacketType() byte  { return PTYPE_EPPROPQUERY }
+func (p EpPropQueryPacket) PacketFlags() byte { return p.Flags }
+
+func (p EpPropQueryPacket) Bytes() ([]byte, error) { return p.Encode(), nil }
+func (p EpPropQueryPacket) eid() uint32            { return p.Eid }
+
+func (p EpPropReportPacket) PacketType() byte  { return PTYPE_EPPROPREPORT }
+func (p EpPropReportPacket) PacketFlags() byte { return p.Flags }
+
+func (p EpPropReportPacket) Bytes() ([]byte, error) { return p.Encode() }
+func (p EpPropReportPacket) eid() uint32            { return p.Eid }
+
+func (p EpPropWritePacket) PacketType() byte  { return PTYPE_EPPROPWRITE }
+func (p EpPropWritePacket) PacketFlags() byte { return p.Flags }
+
+func (p EpPropWritePacket) Bytes() ([]byte, error) { return p.Encode() }
+func (p EpPropWritePacket) eid() uint32            { return p.Eid }
+
+func (p PInfoPacket) PacketType() byte  { return PTYPE_PINFO }
+func (p PInfoPacket) PacketFlags() byte { return p.Flags }
+
+func (p PInfoPacket) Bytes() ([]byte, error) { return p.Encode() }
+func (p PInfoPacket) eid() uint32            { return p.Eid }
+
+func (p ReportPacket) PacketType() byte  { return PTYPE_REPORT }
+func (p ReportPacket) PacketFlags() byte { return p.Flags }
+
+func (p ReportPacket) Bytes() ([]byte, error) { return p.Encode() }
+func (p ReportPacket) eid() uint32            { return p.Eid }
+
+func (p EpReportPacket) PacketType() byte  { return PTYPE_EPREPORT }
+func (p EpReportPacket) PacketFlags() byte { return p.Flags }
+
+func (p EpReportPacket) Bytes() ([]byte, error) { return p.Encode() }
+func (p EpReportPacket) eid() uint32            { return p.Eid }
+
+func (p AckPacket) PacketType() byte  { return PTYPE_ACK }
+func (p AckPacket) PacketFlags() byte { return p.Flags }
+
+func (p AckPacket) Bytes() ([]byte, error) { return p.Encode(), nil }
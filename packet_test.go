@@ -0,0 +1,215 @@
+package hexabus
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+func Test_Decode(t *testing.T) {
+
+	packets := []Packet{
+		ErrorPacket{FLAG_NONE, HXB_ERR_UNKNOWNEID},
+		InfoPacket{FLAG_NONE, 0x01020304, DTYPE_UINT32, uint32(230)},
+		QueryPacket{FLAG_NONE, 0xdeadbeef},
+		WritePacket{FLAG_NONE, 1, DTYPE_BOOL, true},
+		EpInfoPacket{FLAG_NONE, 2, DTYPE_128STRING, "Power Meter"},
+		EpQueryPacket{FLAG_NONE, 70000},
+		EpPropQueryPacket{FLAG_NONE, 1, EP_PROP_WRITABLE},
+		EpPropReportPacket{FLAG_NONE, 1, DTYPE_BOOL, EP_PROP_WRITABLE, true},
+		EpPropWritePacket{FLAG_NONE, 0, DTYPE_128STRING, EP_PROP_DEVICE_NAME, "Kitchen Plug"},
+		ReportPacket{FLAG_NONE, 2, DTYPE_FLOAT, 0x1234, float32(21.5)},
+		EpReportPacket{FLAG_NONE, 1, DTYPE_BOOL, 7, "Main Switch"},
+		PInfoPacket{FLAG_NONE, 2, DTYPE_UINT32, net.ParseIP("fd00::50:c4ff:fe04:8390"), uint32(1200)},
+		AckPacket{FLAG_NONE, 0xbeef},
+	}
+
+	for _, p := range packets {
+		packet, err := p.Bytes()
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+
+		p0, err := Decode(packet)
+		if err != nil {
+			t.Errorf("Decode of packet type %d failed: %s", p.PacketType(), err)
+			continue
+		}
+		if p0.PacketType() != p.PacketType() || p0.PacketFlags() != p.PacketFlags() {
+			t.Errorf("Decode of packet type %d returned type %d", p.PacketType(), p0.PacketType())
+		}
+
+		var match bool
+		switch p0 := p0.(type) {
+		case *ErrorPacket:
+			match = *p0 == p.(ErrorPacket)
+		case *InfoPacket:
+			match = *p0 == p.(InfoPacket)
+		case *QueryPacket:
+			match = *p0 == p.(QueryPacket)
+		case *WritePacket:
+			match = *p0 == p.(WritePacket)
+		case *EpInfoPacket:
+			match = *p0 == p.(EpInfoPacket)
+		case *EpQueryPacket:
+			match = *p0 == p.(EpQueryPacket)
+		case *EpPropQueryPacket:
+			match = *p0 == p.(EpPropQueryPacket)
+		case *EpPropReportPacket:
+			match = *p0 == p.(EpPropReportPacket)
+		case *EpPropWritePacket:
+			match = *p0 == p.(EpPropWritePacket)
+		case *ReportPacket:
+			match = *p0 == p.(ReportPacket)
+		case *EpReportPacket:
+			match = *p0 == p.(EpReportPacket)
+		case *AckPacket:
+			match = *p0 == p.(AckPacket)
+		case *PInfoPacket:
+			p := p.(PInfoPacket)
+			match = p0.Origin.Equal(p.Origin) && p0.Eid == p.Eid && p0.Dtype == p.Dtype && p0.Data == p.Data
+		}
+		if !match {
+			t.Errorf("Decode did not match while testing: \n Encode: %+v \n Decode: %+v \n RAW: %x \n", p, p0, packet)
+		} else {
+			t.Logf("Decode of packet type %d passed test", p.PacketType())
+		}
+	}
+}
+
+func Test_DecodeInvalid(t *testing.T) {
+
+	query, _ := QueryPacket{FLAG_NONE, 1}.Bytes()
+
+	bad_crc := append([]byte{}, query...)
+	bad_crc[len(bad_crc)-1] ^= 0xff
+
+	bad_header := append([]byte{}, query...)
+	bad_header[0] = 'X'
+
+	bad_ptype := append([]byte{}, query...)
+	bad_ptype[4] = 0x7f
+	bad_ptype = addCRC(bad_ptype[:len(bad_ptype)-2])
+
+	short := addCRC([]byte{HEADER0, HEADER1, HEADER2, HEADER3, PTYPE_QUERY, FLAG_NONE})
+
+	info, _ := InfoPacket{FLAG_NONE, 2, DTYPE_UINT32, uint32(42)}.Bytes()
+	long := addCRC(append(append([]byte{}, info[:len(info)-2]...), 0x00))
+	truncated := addCRC(append([]byte{}, info[:len(info)-3]...))
+
+	ep_info, _ := EpInfoPacket{FLAG_NONE, 2, DTYPE_128STRING, "Power Meter"}.Bytes()
+	truncated_string := addCRC(append([]byte{}, ep_info[:20]...))
+
+	bad_dtype := append([]byte{}, info[:len(info)-2]...)
+	bad_dtype[10] = 0x7f
+	bad_dtype = addCRC(bad_dtype)
+
+	invalid := []struct {
+		name   string
+		packet []byte
+		err    error
+	}{
+		{"empty", []byte{}, Error(ERR_PKTLENGTH)},
+		{"stray", []byte{0x48, 0x58, 0x30}, Error(ERR_PKTLENGTH)},
+		{"short", short, Error(ERR_PKTLENGTH)},
+		{"crc", bad_crc, Error(ERR_CRCFAILED)},
+		{"header", bad_header, Error(ERR_WRONGHEADER)},
+		{"ptype", bad_ptype, Error(ERR_UNKNOWNPTYPE)},
+		{"long", long, Error(ERR_PKTLENGTH)},
+		{"truncated", truncated, Error(ERR_PKTLENGTH)},
+		{"truncated string", truncated_string, Error(ERR_PKTLENGTH)},
+		{"dtype", bad_dtype, Error(ERR_HXBDTYPE)},
+	}
+
+	for _, v := range invalid {
+		_, err := Decode(v.packet)
+		if !errors.Is(err, v.err) {
+			t.Errorf("Decode of %s packet returned %v, expected %v", v.name, err, v.err)
+		}
+	}
+
+	_, err := Decode(truncated)
+	if e, ok := err.(*LengthError); !ok || e.Ptype != PTYPE_INFO || e.Dtype != DTYPE_UINT32 || e.Length != 16 || e.Expected != 17 {
+		t.Errorf("Decode of truncated packet returned %#v", err)
+	}
+}
+
+// no input may panic a decoder, packets that decode have to encode again
+func FuzzDecode(f *testing.F) {
+	seeds := []Packet{
+		ErrorPacket{FLAG_NONE, HXB_ERR_UNKNOWNEID},
+		InfoPacket{FLAG_NONE, 1, DTYPE_BOOL, true},
+		InfoPacket{FLAG_NONE, 2, DTYPE_UINT64, uint64(1 << 40)},
+		InfoPacket{FLAG_NONE, 3, DTYPE_DATETIME, DateTime{12, 30, 0, 1, 5, 2014, 4}},
+		InfoPacket{FLAG_NONE, 4, DTYPE_TIMESTAMP, Timestamp{3600}},
+		InfoPacket{FLAG_NONE, 5, DTYPE_66BYTES, make([]byte, 65)},
+		QueryPacket{FLAG_NONE, 1},
+		WritePacket{FLAG_NONE, 1, DTYPE_DOUBLE, 0.5},
+		WritePacket{FLAG_NONE, 1, DTYPE_16BYTES, make([]byte, 16)},
+		EpInfoPacket{FLAG_NONE, 2, DTYPE_UINT32, "Power Meter"},
+		EpQueryPacket{FLAG_NONE, 2},
+		EpPropQueryPacket{FLAG_NONE, 1, EP_PROP_NAME},
+		EpPropReportPacket{FLAG_NONE, 1, DTYPE_128STRING, EP_PROP_NAME, "Main Switch"},
+		EpPropWritePacket{FLAG_NONE, 1, DTYPE_INT16, EP_PROP_MIN, int16(-40)},
+		ReportPacket{FLAG_NONE, 2, DTYPE_FLOAT, 7, float32(21.5)},
+		EpReportPacket{FLAG_NONE, 2, DTYPE_UINT32, 7, "Power Meter"},
+		PInfoPacket{FLAG_NONE, 2, DTYPE_INT8, net.ParseIP("fd00::1"), int8(-1)},
+		AckPacket{FLAG_NONE, 7},
+	}
+	for _, p := range seeds {
+		packet, err := p.Bytes()
+		if err != nil {
+			f.Fatalf("%s", err)
+		}
+		f.Add(packet)
+		f.Add(addSeq(packet, 0xffff))
+		f.Add(packet[:len(packet)/2])
+		f.Add(addCRC(append([]byte{}, packet[:len(packet)-3]...)))
+	}
+	f.Add([]byte{})
+	f.Add([]byte{HEADER0, HEADER1, HEADER2, HEADER3, PTYPE_INFO})
+
+	decoders := []func() decoder{
+		func() decoder { return &ErrorPacket{} },
+		func() decoder { return &InfoPacket{} },
+		func() decoder { return &QueryPacket{} },
+		func() decoder { return &WritePacket{} },
+		func() decoder { return &EpInfoPacket{} },
+		func() decoder { return &EpQueryPacket{} },
+		func() decoder { return &EpPropQueryPacket{} },
+		func() decoder { return &EpPropReportPacket{} },
+		func() decoder { return &EpPropWritePacket{} },
+		func() decoder { return &PInfoPacket{} },
+		func() decoder { return &AckPacket{} },
+		func() decoder { return &ReportPacket{} },
+		func() decoder { return &EpReportPacket{} },
+	}
+
+	f.Fuzz(func(t *testing.T, packet []byte) {
+		p, err := Decode(packet)
+		if err == nil {
+			if _, err := p.Bytes(); err != nil {
+				t.Errorf("Encode of decoded %x failed: %s", packet, err)
+			}
+		}
+		for _, d := range decoders {
+			d().Decode(packet)
+		}
+		Sequence(packet)
+		PacketType(packet)
+
+		// with a valid crc mutated packets get past the checksum
+		if len(packet) >= 2 {
+			fixed := addCRC(append([]byte{}, packet[:len(packet)-2]...))
+			p, err := Decode(fixed)
+			if err == nil {
+				if _, err := p.Bytes(); err != nil {
+					t.Errorf("Encode of decoded %x failed: %s", fixed, err)
+				}
+			}
+			for _, d := range decoders {
+				d().Decode(fixed)
+			}
+		}
+	})
+}
@@ -0,0 +1,85 @@
+package recorder
+
+import (
+	"encoding/csv"
+	"github.com/morriswinkler/hexabus"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// measurement of the InfluxDB line protocol
+const INFLUX_MEASUREMENT = "hexabus"
+
+// WriteCSV writes the records as CSV with a header line, the columns are
+// time in RFC 3339, device, eid, datatype and value as text, see
+// hexabus.Value.String.
+func WriteCSV(w io.Writer, records []Record) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"time", "device", "eid", "datatype", "value"})
+	for _, rec := range records {
+		cw.Write([]string{
+			rec.Time.Format(time.RFC3339Nano),
+			rec.Device,
+			strconv.FormatUint(uint64(rec.Eid), 10),
+			hexabus.DtypeName(rec.Value.Dtype),
+			rec.Value.String(),
+		})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// WriteLineProtocol writes the records in the InfluxDB line protocol as
+// INFLUX_MEASUREMENT with the tags device, eid and datatype, timestamps are
+// in nanoseconds. InfluxDB keeps one type per field, so numbers of every
+// data type and Timestamps in seconds are written as the float field value,
+// Bools as the boolean field value_bool and other data types as the string
+// field value_str.
+// Records with NaN or infinite values are skipped, the line protocol can't
+// express them.
+func WriteLineProtocol(w io.Writer, records []Record) error {
+	for _, rec := range records {
+		f, ok := field(rec.Value)
+		if !ok {
+			continue
+		}
+		line := INFLUX_MEASUREMENT +
+			",device=" + tag(rec.Device) +
+			",eid=" + strconv.FormatUint(uint64(rec.Eid), 10) +
+			",datatype=" + tag(hexabus.DtypeName(rec.Value.Dtype)) +
+			" " + f +
+			" " + strconv.FormatInt(rec.Time.UnixNano(), 10) + "\n"
+		_, err := io.WriteString(w, line)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// escaped tag value
+func tag(s string) string {
+	return strings.NewReplacer(`\`, `\\`, ",", `\,`, "=", `\=`, " ", `\ `).Replace(s)
+}
+
+// field of the line protocol, false for non-finite numbers
+func field(v hexabus.Value) (string, bool) {
+	if b, ok := v.Data.(bool); ok {
+		return "value_bool=" + strconv.FormatBool(b), true
+	}
+	f, ok := number(v)
+	if !ok {
+		return `value_str="` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(v.String()) + `"`, true
+	}
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return "", false
+	}
+	bits := 64
+	if _, ok := v.Data.(float32); ok {
+		bits = 32
+	}
+	return "value=" + strconv.FormatFloat(f, 'g', -1, bits), true
+}
@@ -0,0 +1,81 @@
+package recorder
+
+import (
+	"bytes"
+	"github.com/morriswinkler/hexabus"
+	"math"
+	"testing"
+	"time"
+)
+
+func Test_WriteCSV(t *testing.T) {
+	records := []Record{
+		{start, "fd00::1", 2, hexabus.Value{Dtype: hexabus.DTYPE_UINT32, Data: uint32(42)}},
+		{start.Add(1500 * time.Millisecond), "fd00::1", 4, hexabus.Value{Dtype: hexabus.DTYPE_128STRING, Data: "a, \"b\""}},
+	}
+	var buf bytes.Buffer
+	if err := WriteCSV(&buf, records); err != nil {
+		t.Fatalf("WriteCSV failed: %s", err)
+	}
+	expected := "time,device,eid,datatype,value\n" +
+		"2026-10-18T12:00:00Z,fd00::1,2,UInt32,42\n" +
+		"2026-10-18T12:00:01.5Z,fd00::1,4,String,\"a, \"\"b\"\"\"\n"
+	if buf.String() != expected {
+		t.Errorf("CSV is\n%s\nexpected\n%s", buf.String(), expected)
+	}
+}
+
+func Test_WriteLineProtocol(t *testing.T) {
+	records := []Record{
+		{start, "fd00::1", 2, hexabus.Value{Dtype: hexabus.DTYPE_UINT32, Data: uint32(42)}},
+		{start, "fd00::1", 3, hexabus.Value{Dtype: hexabus.DTYPE_FLOAT, Data: float32(21)}},
+		{start, "fd00::1", 1, hexabus.Value{Dtype: hexabus.DTYPE_BOOL, Data: true}},
+		{start, "[fd00::1]:4000", 4, hexabus.Value{Dtype: hexabus.DTYPE_128STRING, Data: `say "hi"`}},
+		{start, "fd00::1", 5, hexabus.Value{Dtype: hexabus.DTYPE_UINT64, Data: uint64(1 << 63)}},
+	}
+	var buf bytes.Buffer
+	if err := WriteLineProtocol(&buf, records); err != nil {
+		t.Fatalf("WriteLineProtocol failed: %s", err)
+	}
+	ns := " 1792324800000000000\n"
+	expected := "hexabus,device=fd00::1,eid=2,datatype=UInt32 value=42" + ns +
+		"hexabus,device=fd00::1,eid=3,datatype=Float value=21" + ns +
+		"hexabus,device=fd00::1,eid=1,datatype=Bool value_bool=true" + ns +
+		`hexabus,device=[fd00::1]:4000,eid=4,datatype=String value_str="say \"hi\""` + ns +
+		"hexabus,device=fd00::1,eid=5,datatype=UInt64 value=9.223372036854776e+18" + ns
+	if buf.String() != expected {
+		t.Errorf("line protocol is\n%s\nexpected\n%s", buf.String(), expected)
+	}
+}
+
+func Test_WriteLineProtocolMixed(t *testing.T) {
+	// an endpoint whose data type changed, numbers share one float field
+	records := []Record{
+		{start, "fd00::1", 2, hexabus.Value{Dtype: hexabus.DTYPE_UINT8, Data: uint8(7)}},
+		{start, "fd00::1", 2, hexabus.Value{Dtype: hexabus.DTYPE_INT64, Data: int64(-3)}},
+		{start, "fd00::1", 2, hexabus.Value{Dtype: hexabus.DTYPE_FLOAT, Data: float32(0.1)}},
+		{start, "fd00::1", 2, hexabus.Value{Dtype: hexabus.DTYPE_DOUBLE, Data: math.NaN()}},
+		{start, "fd00::1", 2, hexabus.Value{Dtype: hexabus.DTYPE_FLOAT, Data: float32(math.Inf(-1))}},
+		{start, "fd00::1", 2, hexabus.Value{Dtype: hexabus.DTYPE_DOUBLE, Data: 2.5}},
+		{start, "fd00::1", 2, hexabus.Value{Dtype: hexabus.DTYPE_BOOL, Data: false}},
+		{start, "fd00::1", 2, hexabus.Value{Dtype: hexabus.DTYPE_16BYTES, Data: make([]byte, 16)}},
+		{start, "fd00::1", 2, hexabus.Value{Dtype: hexabus.DTYPE_TIMESTAMP, Data: hexabus.Timestamp{TotalSeconds: 90}}},
+		{start, "fd00::1", 2, hexabus.Value{Dtype: hexabus.DTYPE_UINT64, Data: uint64(1<<63 + 1)}},
+	}
+	var buf bytes.Buffer
+	if err := WriteLineProtocol(&buf, records); err != nil {
+		t.Fatalf("WriteLineProtocol failed: %s", err)
+	}
+	ns := " 1792324800000000000\n"
+	expected := "hexabus,device=fd00::1,eid=2,datatype=UInt8 value=7" + ns +
+		"hexabus,device=fd00::1,eid=2,datatype=Int64 value=-3" + ns +
+		"hexabus,device=fd00::1,eid=2,datatype=Float value=0.1" + ns +
+		"hexabus,device=fd00::1,eid=2,datatype=Double value=2.5" + ns +
+		"hexabus,device=fd00::1,eid=2,datatype=Bool value_bool=false" + ns +
+		`hexabus,device=fd00::1,eid=2,datatype=16Bytes value_str="` + hexabus.Value{Dtype: hexabus.DTYPE_16BYTES, Data: make([]byte, 16)}.String() + `"` + ns +
+		"hexabus,device=fd00::1,eid=2,datatype=Timestamp value=90" + ns +
+		"hexabus,device=fd00::1,eid=2,datatype=UInt64 value=9.223372036854776e+18" + ns
+	if buf.String() != expected {
+		t.Errorf("line protocol is\n%s\nexpected\n%s", buf.String(), expected)
+	}
+}
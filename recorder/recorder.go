@@ -0,0 +1,266 @@
+// Package recorder keeps a history of endpoint values in a local file.
+//
+// The log is append-only, every received value is one line of JSON:
+//
+//	{"time":"2026-10-18T12:00:00.5Z","device":"fd00::1","eid":2,"value":{"datatype":"UInt32","value":42}}
+//
+// with the value in the JSON encoding of hexabus.Value. Lines that can't be
+// decoded, like the last one after a crash while writing, are skipped when
+// reading. The history can be queried by device, EID and time range,
+// downsampled and exported as CSV or InfluxDB line protocol.
+package recorder
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/morriswinkler/hexabus"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Record is a value received from an endpoint.
+type Record struct {
+	Time   time.Time     `json:"time"`
+	Device string        `json:"device"` // address of the device, see hexabus.DeviceAddress
+	Eid    uint32        `json:"eid"`
+	Value  hexabus.Value `json:"value"`
+}
+
+// Query selects records of the log.
+type Query struct {
+	Device string    // address of the device in any form, all devices if empty
+	Eids   []uint32  // all EID's if empty
+	From   time.Time // first time included, unbounded if zero
+	To     time.Time // first time excluded, unbounded if zero
+
+	// length of the intervals records are combined to, no downsampling if
+	// zero. The intervals are aligned to multiples of Step since the zero
+	// time, see time.Time.Truncate. Numbers, Timestamps and Bools are
+	// averaged to a Double, Bools as 0 and 1, of other data types the last
+	// value is kept. The record has the start time of its interval.
+	Step time.Duration
+}
+
+// Recorder appends values to a log file.
+type Recorder struct {
+	path string
+	mu   sync.Mutex
+	f    *os.File
+}
+
+// Open opens the log file at path for appending, it is created if it
+// doesn't exist.
+func Open(path string) (*Recorder, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	// terminate a line cut off by a crash, so it is skipped as a whole
+	info, err := f.Stat()
+	if err == nil && info.Size() > 0 {
+		last := make([]byte, 1)
+		_, err = f.ReadAt(last, info.Size()-1)
+		if err == nil && last[0] != '\n' {
+			_, err = f.Write([]byte{'\n'})
+		}
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &Recorder{path: path, f: f}, nil
+}
+
+// Close closes the log file.
+func (r *Recorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.f.Close()
+}
+
+// Append writes a record to the end of the log.
+func (r *Recorder) Append(rec Record) error {
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, err = r.f.Write(append(b, '\n'))
+	return err
+}
+
+// Run appends the Info Packets received by l with the time of arrival until
+// ctx is done, which is returned as ctx.Err(), or l is closed. A failed
+// write stops the recording and is returned.
+func (r *Recorder) Run(ctx context.Context, l *hexabus.Listener) error {
+	for {
+		select {
+		case ev, ok := <-l.Events():
+			if !ok {
+				return nil
+			}
+			p, ok := ev.Packet.(*hexabus.InfoPacket)
+			if !ok {
+				continue
+			}
+			err := r.Append(Record{time.Now(), hexabus.DeviceAddress(ev.Addr), p.Eid, hexabus.Value{Dtype: p.Dtype, Data: p.Data}})
+			if err != nil {
+				return err
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Query returns the records of the log selected by q. Records appended
+// while the log is read are left out.
+func (r *Recorder) Query(q Query) ([]Record, error) {
+	// every Append writes a whole line, so the log ends with a complete
+	// record as long as the lock is held
+	r.mu.Lock()
+	info, err := r.f.Stat()
+	r.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(r.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return Read(io.LimitReader(f, info.Size()), q)
+}
+
+// ReadFile returns the records of the log file at path selected by q, in the
+// order they were written or, if downsampled, sorted by time, device and EID.
+func ReadFile(path string, q Query) ([]Record, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return Read(f, q)
+}
+
+// Read is like ReadFile but reads the log from rd.
+func Read(rd io.Reader, q Query) ([]Record, error) {
+	device := q.Device
+	if device != "" {
+		device = hexabus.NormalizeAddress(device)
+	}
+	eids := map[uint32]bool{}
+	for _, eid := range q.Eids {
+		eids[eid] = true
+	}
+
+	var records []Record
+	s := bufio.NewScanner(rd)
+	for s.Scan() {
+		line := bytes.TrimSpace(s.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		var rec Record
+		if json.Unmarshal(line, &rec) != nil {
+			continue
+		}
+		if device != "" && rec.Device != device {
+			continue
+		}
+		if len(eids) > 0 && !eids[rec.Eid] {
+			continue
+		}
+		if (!q.From.IsZero() && rec.Time.Before(q.From)) || (!q.To.IsZero() && !rec.Time.Before(q.To)) {
+			continue
+		}
+		records = append(records, rec)
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	if q.Step > 0 {
+		records = downsample(records, q.Step)
+	}
+	return records, nil
+}
+
+// interval of a series
+type bucket struct {
+	start  time.Time
+	device string
+	eid    uint32
+}
+
+// running average of a bucket
+type average struct {
+	sum   float64
+	count int
+	last  hexabus.Value
+}
+
+// combine the records of every series in intervals of step
+func downsample(records []Record, step time.Duration) []Record {
+	buckets := map[bucket]*average{}
+	for _, rec := range records {
+		key := bucket{rec.Time.Truncate(step), rec.Device, rec.Eid}
+		a, ok := buckets[key]
+		if !ok {
+			a = &average{}
+			buckets[key] = a
+		}
+		a.last = rec.Value
+		if f, ok := number(rec.Value); ok {
+			a.sum += f
+			a.count++
+		}
+	}
+
+	result := make([]Record, 0, len(buckets))
+	for key, a := range buckets {
+		v := a.last
+		if a.count > 0 {
+			v = hexabus.Value{Dtype: hexabus.DTYPE_DOUBLE, Data: a.sum / float64(a.count)}
+		}
+		result = append(result, Record{key.start, key.device, key.eid, v})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		a, b := result[i], result[j]
+		if !a.Time.Equal(b.Time) {
+			return a.Time.Before(b.Time)
+		}
+		if a.Device != b.Device {
+			return a.Device < b.Device
+		}
+		return a.Eid < b.Eid
+	})
+	return result
+}
+
+// value of numbers, Timestamps and Bools as float64, 64 bit integers are
+// rounded to the nearest float64
+func number(v hexabus.Value) (float64, bool) {
+	if b, ok := v.Data.(bool); ok {
+		if b {
+			return 1, true
+		}
+		return 0, true
+	}
+	d, err := hexabus.NewValue(hexabus.DTYPE_DOUBLE, v)
+	if err == nil {
+		return d.Data.(float64), true
+	}
+	if i, err := hexabus.NewValue(hexabus.DTYPE_INT64, v); err == nil {
+		return float64(i.Data.(int64)), true
+	}
+	if u, err := hexabus.NewValue(hexabus.DTYPE_UINT64, v); err == nil {
+		return float64(u.Data.(uint64)), true
+	}
+	return 0, false
+}
@@ -0,0 +1,143 @@
+package recorder
+
+import (
+	"context"
+	"github.com/morriswinkler/hexabus"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var start = time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+
+func test_records() []Record {
+	return []Record{
+		{start, "fd00::1", 2, hexabus.Value{Dtype: hexabus.DTYPE_UINT32, Data: uint32(10)}},
+		{start.Add(20 * time.Second), "fd00::1", 2, hexabus.Value{Dtype: hexabus.DTYPE_UINT32, Data: uint32(20)}},
+		{start.Add(30 * time.Second), "fd00::1", 1, hexabus.Value{Dtype: hexabus.DTYPE_BOOL, Data: true}},
+		{start.Add(40 * time.Second), "fd00::1", 1, hexabus.Value{Dtype: hexabus.DTYPE_BOOL, Data: false}},
+		{start.Add(50 * time.Second), "fd00::2", 2, hexabus.Value{Dtype: hexabus.DTYPE_UINT32, Data: uint32(5)}},
+		{start.Add(70 * time.Second), "fd00::1", 2, hexabus.Value{Dtype: hexabus.DTYPE_UINT32, Data: uint32(60)}},
+		{start.Add(80 * time.Second), "fd00::1", 4, hexabus.Value{Dtype: hexabus.DTYPE_128STRING, Data: "a"}},
+		{start.Add(90 * time.Second), "fd00::1", 4, hexabus.Value{Dtype: hexabus.DTYPE_128STRING, Data: "b"}},
+	}
+}
+
+func Test_Recorder(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.log")
+	r, err := Open(path)
+	if err != nil {
+		t.Fatalf("Open failed: %s", err)
+	}
+	records := test_records()
+	for _, rec := range records {
+		if err := r.Append(rec); err != nil {
+			t.Fatalf("Append failed: %s", err)
+		}
+	}
+
+	tests := []struct {
+		name     string
+		q        Query
+		expected []Record
+	}{
+		{"all", Query{}, records},
+		{"device", Query{Device: "fd00::2"}, records[4:5]},
+		{"device with port", Query{Device: "[fd00:0::2]:61616"}, records[4:5]},
+		{"eids", Query{Eids: []uint32{1, 4}}, []Record{records[2], records[3], records[6], records[7]}},
+		{"range", Query{Device: "fd00::1", Eids: []uint32{2}, From: start.Add(20 * time.Second), To: start.Add(70 * time.Second)}, records[1:2]},
+		{"downsampled", Query{Device: "fd00::1", Step: time.Minute}, []Record{
+			{start, "fd00::1", 1, hexabus.Value{Dtype: hexabus.DTYPE_DOUBLE, Data: 0.5}},
+			{start, "fd00::1", 2, hexabus.Value{Dtype: hexabus.DTYPE_DOUBLE, Data: float64(15)}},
+			{start.Add(time.Minute), "fd00::1", 2, hexabus.Value{Dtype: hexabus.DTYPE_DOUBLE, Data: float64(60)}},
+			{start.Add(time.Minute), "fd00::1", 4, hexabus.Value{Dtype: hexabus.DTYPE_128STRING, Data: "b"}},
+		}},
+	}
+	for _, test := range tests {
+		result, err := r.Query(test.q)
+		if err != nil {
+			t.Fatalf("%s query failed: %s", test.name, err)
+		}
+		if !equal(result, test.expected) {
+			t.Errorf("%s query returned %v, expected %v", test.name, result, test.expected)
+		}
+	}
+	r.Close()
+
+	// a line cut off by a crash is skipped, the next record starts a new line
+	f, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	f.Write([]byte(`{"time":"2026-10-18T12:0`))
+	f.Close()
+	r, err = Open(path)
+	if err != nil {
+		t.Fatalf("Open failed: %s", err)
+	}
+	defer r.Close()
+	extra := Record{start.Add(time.Hour), "fd00::3", 1, hexabus.Value{Dtype: hexabus.DTYPE_BOOL, Data: true}}
+	r.Append(extra)
+	result, err := r.Query(Query{})
+	if err != nil || !equal(result, append(test_records(), extra)) {
+		t.Errorf("log after crash returned %v, %v", result, err)
+	}
+}
+
+func Test_RecorderRun(t *testing.T) {
+	conn, err := net.ListenUDP("udp6", &net.UDPAddr{IP: net.IPv6loopback})
+	if err != nil {
+		t.Skipf("no udp6 loopback: %s", err)
+	}
+	l := hexabus.NewListener(conn)
+	defer l.Close()
+
+	r, err := Open(filepath.Join(t.TempDir(), "history.log"))
+	if err != nil {
+		t.Fatalf("Open failed: %s", err)
+	}
+	defer r.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- r.Run(ctx, l) }()
+
+	sender, err := net.ListenUDP("udp6", &net.UDPAddr{IP: net.IPv6loopback})
+	if err != nil {
+		t.Fatalf("ListenUDP failed: %s", err)
+	}
+	defer sender.Close()
+	packet, _ := hexabus.InfoPacket{Eid: 3, Dtype: hexabus.DTYPE_FLOAT, Data: float32(21.5)}.Bytes()
+	before := time.Now()
+	sender.WriteTo(packet, conn.LocalAddr())
+
+	var result []Record
+	for deadline := time.Now().Add(2 * time.Second); len(result) == 0 && time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		result, err = r.Query(Query{})
+		if err != nil {
+			t.Fatalf("Query failed: %s", err)
+		}
+	}
+	if len(result) != 1 {
+		t.Fatalf("recorded %v", result)
+	}
+	rec := result[0]
+	if rec.Device != sender.LocalAddr().String() || rec.Eid != 3 || rec.Value.Data != float32(21.5) || rec.Time.Before(before) || time.Since(rec.Time) > time.Minute {
+		t.Errorf("recorded %+v", rec)
+	}
+
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Errorf("Run returned %v", err)
+	}
+}
+
+func equal(a, b []Record) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !a[i].Time.Equal(b[i].Time) || a[i].Device != b[i].Device || a[i].Eid != b[i].Eid || a[i].Value != b[i].Value {
+			return false
+		}
+	}
+	return true
+}
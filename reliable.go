@@ -0,0 +1,164 @@
+package hexabus
+
+import (
+	"context"
+	"encoding/binary"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// Defaults used for reliable packets.
+const (
+	// retransmissions before a reliable packet is given up
+	RELIABLE_RETRIES = 4
+
+	// wait before the first retransmission, doubled after every retry
+	RELIABLE_INTERVAL = 250 * time.Millisecond
+
+	// sequence numbers remembered per sender to detect retransmissions
+	RELIABLE_WINDOW = 64
+)
+
+// Sequence returns the sequence number of a reliable packet, ok is false if
+// the packet was not sent with FLAG_RELIABLE or is corrupted.
+func Sequence(packet []byte) (seq uint16, ok bool) {
+	if len(packet) < 10 || checkHeader(packet) != nil || packet[5]&FLAG_RELIABLE == 0 {
+		return 0, false
+	}
+	if checkCRC(packet) != nil {
+		return 0, false
+	}
+	return binary.BigEndian.Uint16(packet[6:8]), true
+}
+
+// insert the sequence number after the flags of an encoded packet and mark
+// it reliable
+func addSeq(packet []byte, seq uint16) []byte {
+	reliable := make([]byte, 8, len(packet)+2)
+	copy(reliable, packet[:6])
+	reliable[5] |= FLAG_RELIABLE
+	binary.BigEndian.PutUint16(reliable[6:8], seq)
+	reliable = append(reliable, packet[6:len(packet)-2]...)
+	return addCRC(reliable)
+}
+
+// remove the sequence number of a reliable packet, the returned packet has
+// the layout and a valid crc of the unreliable packet
+func stripSeq(packet []byte) ([]byte, error) {
+	if packet[5]&FLAG_RELIABLE == 0 {
+		return packet, nil
+	}
+	if len(packet) < 10 {
+		return nil, &LengthError{Ptype: packet[4], Length: len(packet), Expected: 10}
+	}
+	err := checkCRC(packet)
+	if err != nil {
+		return nil, err
+	}
+	stripped := make([]byte, 6, len(packet)-2)
+	copy(stripped, packet[:6])
+	stripped[5] &^= FLAG_RELIABLE
+	stripped = append(stripped, packet[8:len(packet)-2]...)
+	return addCRC(stripped), nil
+}
+
+// sequence numbers of the reliable packets recently received by sender
+type seqWindow struct {
+	mu   sync.Mutex
+	seen map[string][]uint16
+}
+
+// check if seq was received from addr before and remember it
+func (w *seqWindow) duplicate(addr net.Addr, seq uint16) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.seen == nil {
+		w.seen = make(map[string][]uint16)
+	}
+	key := addr.String()
+	for _, s := range w.seen[key] {
+		if s == seq {
+			return true
+		}
+	}
+	seqs := append(w.seen[key], seq)
+	if len(seqs) > RELIABLE_WINDOW {
+		seqs = seqs[1:]
+	}
+	w.seen[key] = seqs
+	return false
+}
+
+// acknowledge a reliable packet
+func sendAck(conn net.PacketConn, addr net.Addr, seq uint16) {
+	packet, _ := AckPacket{FLAG_NONE, seq}.Bytes()
+	conn.WriteTo(packet, addr)
+}
+
+// next sequence number for a peer, every peer starts at a random number so
+// a restarted client isn't mistaken for retransmissions
+func (c *Client) nextSeq(addr *net.UDPAddr) uint16 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.seqs == nil {
+		c.seqs = make(map[string]uint16)
+	}
+	key := addr.String()
+	seq, ok := c.seqs[key]
+	if !ok {
+		seq = uint16(rand.Intn(1 << 16))
+	}
+	seq++
+	c.seqs[key] = seq
+	return seq
+}
+
+// waits between the retransmissions of a reliable packet
+func (c *Client) retryWaits() []time.Duration {
+	retries := c.Retries
+	if retries == 0 {
+		retries = RELIABLE_RETRIES
+	}
+	wait := c.RetryInterval
+	if wait <= 0 {
+		wait = RELIABLE_INTERVAL
+	}
+	waits := []time.Duration{wait}
+	for i := 0; i < retries; i++ {
+		wait *= 2
+		waits = append(waits, wait)
+	}
+	return waits
+}
+
+// SendReliable sends a packet to address with FLAG_RELIABLE and a sequence
+// number and retransmits it until the device acknowledges it. If the retries
+// are spent an *OpError wrapping Error(ERR_NOACK) is returned, an Error
+// Packet received in response is returned as *RemoteError.
+func (c *Client) SendReliable(address string, p Packet) error {
+	return c.SendReliableContext(context.Background(), address, p)
+}
+
+// SendReliableContext is like SendReliable but aborts when ctx is done.
+func (c *Client) SendReliableContext(ctx context.Context, address string, p Packet) error {
+	eid := packetEid(p)
+	packet, addr, err := c.prepare(ctx, address, p)
+	if err != nil {
+		return requestError(ctx, address, p, eid, err)
+	}
+	seq := c.nextSeq(addr)
+	req := &request{addr: addr, cause: seq, ptypes: []byte{PTYPE_ACK, PTYPE_ERROR}, resp: make(chan response, 1)}
+	resp, err := c.roundtrip(ctx, req, addSeq(packet, seq), c.retryWaits()...)
+	if err != nil {
+		if opErr, ok := err.(net.Error); ok && opErr.Timeout() && ctx.Err() == nil {
+			err = Error(ERR_NOACK)
+		}
+		return requestError(ctx, address, p, eid, err)
+	}
+	if e, ok := resp.p.(*ErrorPacket); ok {
+		return remoteError(address, p, eid, e)
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+package hexabus
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// packet conn that drops the first drop datagrams written to it
+type lossy_conn struct {
+	net.PacketConn
+	drop int32
+}
+
+func (c *lossy_conn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if atomic.AddInt32(&c.drop, -1) >= 0 {
+		return len(b), nil
+	}
+	return c.PacketConn.WriteTo(b, addr)
+}
+
+func Test_Sequence(t *testing.T) {
+	packet, _ := WritePacket{FLAG_NONE, 1, DTYPE_UINT32, uint32(42)}.Bytes()
+	reliable := addSeq(packet, 0x1234)
+
+	seq, ok := Sequence(reliable)
+	if !ok || seq != 0x1234 {
+		t.Errorf("Sequence of reliable packet returned %x, %v", seq, ok)
+	}
+	if _, ok := Sequence(packet); ok {
+		t.Errorf("Sequence of unreliable packet returned ok")
+	}
+
+	p, err := Decode(reliable)
+	if err != nil {
+		t.Fatalf("Decode of reliable packet failed: %s", err)
+	}
+	if *p.(*WritePacket) != (WritePacket{FLAG_NONE, 1, DTYPE_UINT32, uint32(42)}) {
+		t.Errorf("Decode of reliable packet returned %+v", p)
+	}
+
+	reliable[len(reliable)-1] ^= 0xff
+	if _, ok := Sequence(reliable); ok {
+		t.Errorf("Sequence of corrupted packet returned ok")
+	}
+	if _, err := Decode(reliable); !errors.Is(err, Error(ERR_CRCFAILED)) {
+		t.Errorf("Decode of corrupted reliable packet returned %v", err)
+	}
+}
+
+func Test_ClientSendReliable(t *testing.T) {
+	var mu sync.Mutex
+	writes := 0
+
+	d := NewDevice("Lossy Plug")
+	d.Register(Endpoint{
+		Eid:   1,
+		Dtype: DTYPE_BOOL,
+		Desc:  "Main Switch",
+		Read:  func() (interface{}, error) { return false, nil },
+		Write: func(data interface{}) error {
+			mu.Lock()
+			defer mu.Unlock()
+			writes++
+			return nil
+		},
+	})
+	d.Register(Endpoint{
+		Eid:   2,
+		Dtype: DTYPE_UINT32,
+		Desc:  "Power Meter",
+		Read:  func() (interface{}, error) { return uint32(230), nil },
+	})
+	conn, err := net.ListenUDP("udp6", &net.UDPAddr{IP: net.IPv6loopback})
+	if err != nil {
+		t.Skipf("no udp6 loopback: %s", err)
+	}
+	// the first two acks get lost, the device receives the write three times
+	go d.Serve(&lossy_conn{conn, 2})
+	defer d.Close()
+	address := conn.LocalAddr().String()
+
+	c := &Client{Reliable: true, RetryInterval: 20 * time.Millisecond}
+	defer c.Close()
+
+	err = c.Write(address, 1, true)
+	if err != nil {
+		t.Errorf("reliable Write failed: %s", err)
+	}
+	mu.Lock()
+	if writes != 1 {
+		t.Errorf("reliable Write was handled %d times", writes)
+	}
+	mu.Unlock()
+
+	err = c.Write(address, 2, uint32(1))
+	if !errors.Is(err, Error(HXB_ERR_WRITEREADONLY)) {
+		t.Errorf("reliable Write on read only EID returned %v", err)
+	}
+
+	// nobody answers on this socket
+	silent, err := net.ListenUDP("udp6", &net.UDPAddr{IP: net.IPv6loopback})
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer silent.Close()
+	start := time.Now()
+	err = c.SendReliable(silent.LocalAddr().String(), WritePacket{FLAG_NONE, 1, DTYPE_BOOL, true})
+	if !errors.Is(err, Error(ERR_NOACK)) {
+		t.Errorf("SendReliable without ack returned %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 600*time.Millisecond {
+		t.Errorf("SendReliable gave up after %s without backoff", elapsed)
+	}
+}
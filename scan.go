@@ -0,0 +1,178 @@
+package hexabus
+
+import (
+	"context"
+	"math/big"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Defaults used by the Scanner.
+const (
+	// devices scanned at the same time
+	SCAN_CONCURRENCY = 16
+
+	// EID's queried on every device
+	SCAN_EIDS = 256
+
+	// smallest prefix length ScanPrefix sweeps
+	SCAN_MIN_PREFIX = 112
+)
+
+// EidError is the failure of a single EID during a scan or of a value that
+// doesn't fit the data type of the EID in Client.Set.
+type EidError struct {
+	Eid uint32
+	Err error
+}
+
+func (e *EidError) Error() string {
+	return "eid " + strconv.FormatUint(uint64(e.Eid), 10) + ": " + e.Err.Error()
+}
+
+func (e *EidError) Unwrap() error {
+	return e.Err
+}
+
+// EidErrors are the EID's that failed in QueryEids.
+type EidErrors []*EidError
+
+func (e EidErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, ", ")
+}
+
+// Unwrap returns the EidErrors for errors.Is and errors.As.
+func (e EidErrors) Unwrap() []error {
+	errs := make([]error, len(e))
+	for i, err := range e {
+		errs[i] = err
+	}
+	return errs
+}
+
+// ScanResult holds the EID's found on one device.
+type ScanResult struct {
+	Address string      // device address
+	Eids    []EID       // EID's that could be queried, see QueryEids
+	Errors  []*EidError // EID's that failed
+	Err     error       // set if the device could not be scanned at all
+}
+
+// ScanProgress is reported after every scanned device.
+type ScanProgress struct {
+	Done   int        // devices scanned so far
+	Total  int        // devices to scan
+	Result ScanResult // result of the device just scanned
+}
+
+// Scanner queries the EID's of many devices concurrently.
+type Scanner struct {
+	// client used for the scan, DefaultClient if nil
+	Client *Client
+
+	// devices scanned at the same time, SCAN_CONCURRENCY if zero
+	Concurrency int
+
+	// EID's queried on every device, SCAN_EIDS if zero
+	EidQty uint16
+
+	// called after every scanned device, calls are serialized
+	Progress func(ScanProgress)
+}
+
+// Scan queries the EID's of all addresses and returns a result for every
+// address in the same order. A failing EID doesn't abort the scan of the
+// device, it is reported in ScanResult.Errors.
+func (s *Scanner) Scan(ctx context.Context, addresses []string) []ScanResult {
+	client := s.Client
+	if client == nil {
+		client = DefaultClient
+	}
+	concurrency := s.Concurrency
+	if concurrency <= 0 {
+		concurrency = SCAN_CONCURRENCY
+	}
+	eid_qty := s.EidQty
+	if eid_qty == 0 {
+		eid_qty = SCAN_EIDS
+	}
+
+	results := make([]ScanResult, len(addresses))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	done := 0
+
+	for w := 0; w < concurrency && w < len(addresses); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				r := ScanResult{Address: addresses[i]}
+				r.Eids, r.Errors, r.Err = client.scanEids(ctx, addresses[i], eid_qty, client.Probe)
+				results[i] = r
+
+				mu.Lock()
+				done++
+				if s.Progress != nil {
+					s.Progress(ScanProgress{done, len(addresses), r})
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	for i := range addresses {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	return results
+}
+
+// ScanPrefix sweeps all addresses of an IPv6 prefix like fd00::/120 and
+// returns the results of the devices that answered. Prefixes shorter than
+// SCAN_MIN_PREFIX are rejected.
+func (s *Scanner) ScanPrefix(ctx context.Context, prefix string) ([]ScanResult, error) {
+	addresses, err := prefixAddresses(prefix)
+	if err != nil {
+		return nil, err
+	}
+	found := []ScanResult{}
+	for _, r := range s.Scan(ctx, addresses) {
+		if opErr, ok := r.Err.(net.Error); ok && opErr.Timeout() {
+			continue
+		}
+		found = append(found, r)
+	}
+	return found, ctx.Err()
+}
+
+// all host addresses of an IPv6 prefix, without the subnet router anycast
+// address
+func prefixAddresses(prefix string) ([]string, error) {
+	_, ipnet, err := net.ParseCIDR(prefix)
+	if err != nil {
+		return nil, err
+	}
+	ones, bits := ipnet.Mask.Size()
+	if bits != 128 || ones < SCAN_MIN_PREFIX {
+		return nil, Error(ERR_PREFIXSIZE)
+	}
+
+	base := new(big.Int).SetBytes(ipnet.IP)
+	addresses := []string{}
+	for host := int64(1); host < int64(1)<<uint(bits-ones); host++ {
+		ip := make(net.IP, net.IPv6len)
+		new(big.Int).Add(base, big.NewInt(host)).FillBytes(ip)
+		addresses = append(addresses, ip.String())
+	}
+	return addresses, nil
+}
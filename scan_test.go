@@ -0,0 +1,62 @@
+package hexabus
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func Test_Scanner(t *testing.T) {
+	d, address := test_device(t)
+	defer d.Close()
+
+	// device that answers nothing
+	conn, err := net.ListenUDP("udp6", &net.UDPAddr{IP: net.IPv6loopback})
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	silent := conn.LocalAddr().String()
+	defer conn.Close()
+
+	progress := 0
+	s := &Scanner{
+		Client:      &Client{Timeout: 200 * time.Millisecond},
+		Concurrency: 2,
+		EidQty:      64,
+		Progress: func(p ScanProgress) {
+			progress++
+			if p.Done != progress || p.Total != 3 {
+				t.Errorf("progress %d/%d reported as call %d", p.Done, p.Total, progress)
+			}
+		},
+	}
+	defer s.Client.Close()
+
+	results := s.Scan(context.Background(), []string{address, silent, address})
+	if progress != 3 {
+		t.Errorf("progress reported %d times, expected 3", progress)
+	}
+	for _, i := range []int{0, 2} {
+		if results[i].Address != address || results[i].Err != nil || len(results[i].Eids) != 5 {
+			t.Errorf("scan of test device returned %+v", results[i])
+		}
+	}
+	if opErr, ok := results[1].Err.(net.Error); !ok || !opErr.Timeout() {
+		t.Errorf("scan of silent device returned %+v", results[1])
+	}
+}
+
+func Test_prefixAddresses(t *testing.T) {
+	addresses, err := prefixAddresses("fd00::100/120")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if len(addresses) != 255 || addresses[0] != "fd00::101" || addresses[254] != "fd00::1ff" {
+		t.Errorf("prefixAddresses returned %d addresses from %s to %s", len(addresses), addresses[0], addresses[len(addresses)-1])
+	}
+	_, err = prefixAddresses("fd00::/64")
+	if err != Error(ERR_PREFIXSIZE) {
+		t.Errorf("prefixAddresses of /64 returned %v", err)
+	}
+}
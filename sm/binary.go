@@ -0,0 +1,480 @@
+package sm
+
+import (
+	"encoding/binary"
+	"github.com/morriswinkler/hexabus"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// MarshalBinary returns the condition, transition and datetime transition
+// tables of the machine. Conditions are numbered in the order of their first
+// use, unused ones are dropped.
+func (m *Machine) MarshalBinary() ([]byte, error) {
+	if len(m.States) == 0 || len(m.States) > MAX_STATES {
+		return nil, &Error{0, strconv.Itoa(len(m.States)) + " states"}
+	}
+
+	var transitions, dt_transitions []Transition
+	for _, t := range m.Transitions {
+		if int(t.From) >= len(m.States) || int(t.Goto) >= len(m.States) || int(t.Else) >= len(m.States) {
+			return nil, &Error{t.line, "unknown state"}
+		}
+		if t.Cond != TRUE_COND_INDEX && int(t.Cond) >= len(m.Conditions) {
+			return nil, &Error{t.line, "unknown condition " + strconv.Itoa(int(t.Cond))}
+		}
+		if t.Cond != TRUE_COND_INDEX && m.Conditions[t.Cond].Kind == COND_DATETIME {
+			dt_transitions = append(dt_transitions, t)
+		} else {
+			transitions = append(transitions, t)
+		}
+	}
+	if len(transitions) > MAX_TRANSITIONS || len(dt_transitions) > MAX_TRANSITIONS {
+		return nil, &Error{0, "more than " + strconv.Itoa(MAX_TRANSITIONS) + " transitions"}
+	}
+
+	// condition table in the order of the transition tables
+	index := map[byte]byte{TRUE_COND_INDEX: TRUE_COND_INDEX}
+	var conds []byte
+	for _, table := range [][]Transition{transitions, dt_transitions} {
+		for _, t := range table {
+			if _, ok := index[t.Cond]; ok {
+				continue
+			}
+			b, err := encodeCondition(m.Conditions[t.Cond])
+			if err != nil {
+				return nil, errorAt(t.line, err)
+			}
+			index[t.Cond] = byte(len(index) - 1)
+			conds = append(conds, b...)
+		}
+	}
+	if len(index)-1 > MAX_CONDITIONS {
+		return nil, &Error{0, "more than " + strconv.Itoa(MAX_CONDITIONS) + " conditions"}
+	}
+
+	b := append([]byte{byte(len(index) - 1)}, conds...)
+	for _, table := range [][]Transition{transitions, dt_transitions} {
+		b = append(b, byte(len(table)))
+		for _, t := range table {
+			value, err := encodeValue(t.Value)
+			if err != nil {
+				return nil, errorAt(t.line, err)
+			}
+			b = append(b, t.From, index[t.Cond])
+			b = binary.LittleEndian.AppendUint32(b, t.Eid)
+			b = append(b, t.Goto, t.Else)
+			b = append(b, value...)
+		}
+	}
+	return b, nil
+}
+
+// struct condition of a condition
+func encodeCondition(c Condition) ([]byte, error) {
+	switch c.Kind {
+	case COND_ENDPOINT:
+		if _, ok := op_names[c.Op]; !ok {
+			return nil, &Error{0, "unknown operator " + strconv.Itoa(int(c.Op))}
+		}
+		if c.Value.Dtype == hexabus.DTYPE_DATETIME {
+			return nil, &Error{0, "DateTime values can only be compared with time fields"}
+		}
+		ip := c.IP.To16()
+		if ip == nil {
+			ip = LOCAL_IP
+		}
+		b := append([]byte{}, ip...)
+		b = binary.LittleEndian.AppendUint32(b, c.Eid)
+		b = append(b, c.Op)
+		value, err := encodeValue(c.Value)
+		if err != nil {
+			return nil, err
+		}
+		return append(b, value...), nil
+	case COND_DATETIME:
+		if _, ok := field_names[c.Field]; !ok {
+			return nil, &Error{0, "unknown time field " + strconv.Itoa(int(c.Field))}
+		}
+		op := c.Field
+		switch c.Op {
+		case OP_GEQ:
+			op |= DATETIME_GEQ
+		case OP_LT:
+		default:
+			return nil, &Error{0, "time fields can only be compared with < and >="}
+		}
+		n, ok := integer(c.Value)
+		if !ok {
+			return nil, &Error{0, "time field value " + c.Value.String()}
+		}
+		var d hexabus.DateTime
+		switch c.Field {
+		case TIME_HOUR:
+			d.Hours = uint8(n)
+		case TIME_MINUTE:
+			d.Minutes = uint8(n)
+		case TIME_SECOND:
+			d.Seconds = uint8(n)
+		case TIME_DAY:
+			d.Day = uint8(n)
+		case TIME_MONTH:
+			d.Month = uint8(n)
+		case TIME_YEAR:
+			d.Year = uint16(n)
+		case TIME_WEEKDAY:
+			d.DayOfWeek = uint8(n)
+		}
+		b := make([]byte, net.IPv6len+4, SM_CONDITION_SIZE)
+		b = append(b, op, hexabus.DTYPE_DATETIME, d.Hours, d.Minutes, d.Seconds, d.Day, d.Month)
+		b = binary.LittleEndian.AppendUint16(b, d.Year)
+		return append(b, d.DayOfWeek), nil
+	}
+	return nil, &Error{0, "unknown condition kind " + strconv.Itoa(int(c.Kind))}
+}
+
+// struct hxb_value of a value, the payload in little endian like the
+// firmware keeps it in memory and zero padded to SM_VALUE_SIZE bytes
+func encodeValue(v hexabus.Value) ([]byte, error) {
+	b := make([]byte, 1+SM_VALUE_SIZE)
+	if v.Dtype == hexabus.DTYPE_UNDEFINED {
+		return b, nil
+	}
+	if err := fits(v.Dtype); err != nil {
+		return nil, err
+	}
+	packet, err := v.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	copy(b, packet)
+	swap(v.Dtype, b[1:])
+	return b, nil
+}
+
+// check that values of dtype fit the fixed size values of the tables
+func fits(dtype byte) error {
+	if hexabus.DtypeSize(dtype) > SM_VALUE_SIZE {
+		return &Error{0, hexabus.DtypeName(dtype) + " values don't fit the state machine tables"}
+	}
+	return nil
+}
+
+// convert the payload of a value between the network byte order of packets
+// and the little endian of the tables
+func swap(dtype byte, payload []byte) {
+	if dtype == hexabus.DTYPE_DATETIME {
+		// only the year has more than one byte
+		payload[5], payload[6] = payload[6], payload[5]
+		return
+	}
+	n := hexabus.DtypeSize(dtype)
+	for i := 0; i < n/2; i++ {
+		payload[i], payload[n-1-i] = payload[n-1-i], payload[i]
+	}
+}
+
+// numeric value of an integer value
+func integer(v hexabus.Value) (uint64, bool) {
+	switch d := v.Data.(type) {
+	case uint8:
+		return uint64(d), true
+	case uint16:
+		return uint64(d), true
+	}
+	return 0, false
+}
+
+// reader of binary tables
+type reader struct {
+	b   []byte
+	err error
+}
+
+// next n bytes, nil and err set if b is too short
+func (r *reader) next(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if len(r.b) < n {
+		r.err = hexabus.Error(hexabus.ERR_PKTLENGTH)
+		return nil
+	}
+	b := r.b[:n]
+	r.b = r.b[n:]
+	return b
+}
+
+func (r *reader) byte() byte {
+	b := r.next(1)
+	if b == nil {
+		return 0
+	}
+	return b[0]
+}
+
+func (r *reader) uint32() uint32 {
+	b := r.next(4)
+	if b == nil {
+		return 0
+	}
+	return binary.LittleEndian.Uint32(b)
+}
+
+func (r *reader) value() hexabus.Value {
+	b := r.next(1 + SM_VALUE_SIZE)
+	if r.err != nil || b[0] == hexabus.DTYPE_UNDEFINED {
+		return hexabus.Value{}
+	}
+	size := hexabus.DtypeSize(b[0])
+	if size == 0 || size > SM_VALUE_SIZE {
+		r.err = hexabus.Error(hexabus.ERR_HXBDTYPE)
+		return hexabus.Value{}
+	}
+	packet := append([]byte{}, b[:1+size]...)
+	swap(b[0], packet[1:])
+	var v hexabus.Value
+	r.err = v.UnmarshalBinary(packet)
+	return v
+}
+
+// UnmarshalBinary decodes binary tables. The tables don't name states, they
+// are named s0, s1, ... up to the highest state used.
+func (m *Machine) UnmarshalBinary(b []byte) error {
+	r := &reader{b: b}
+	mm := Machine{}
+	conds := int(r.byte())
+	for i := 0; i < conds && r.err == nil; i++ {
+		c, err := decodeCondition(r)
+		if r.err != nil {
+			return r.err
+		}
+		if err != nil {
+			return &Error{0, "condition " + strconv.Itoa(i) + ": " + err.Error()}
+		}
+		mm.Conditions = append(mm.Conditions, c)
+	}
+	states := 1
+	for table := 0; table < 2 && r.err == nil; table++ {
+		n := int(r.byte())
+		for i := 0; i < n && r.err == nil; i++ {
+			t := Transition{From: r.byte(), Cond: r.byte(), Eid: r.uint32()}
+			t.Goto, t.Else = r.byte(), r.byte()
+			t.Value = r.value()
+			if r.err != nil {
+				break
+			}
+			if t.Cond != TRUE_COND_INDEX && int(t.Cond) >= conds {
+				return &Error{0, "transition " + strconv.Itoa(len(mm.Transitions)) + ": unknown condition " + strconv.Itoa(int(t.Cond))}
+			}
+			datetime := t.Cond != TRUE_COND_INDEX && mm.Conditions[t.Cond].Kind == COND_DATETIME
+			if datetime != (table == 1) {
+				return &Error{0, "transition " + strconv.Itoa(len(mm.Transitions)) + ": in the wrong table"}
+			}
+			for _, s := range []byte{t.From, t.Goto, t.Else} {
+				if int(s) >= states {
+					states = int(s) + 1
+				}
+			}
+			mm.Transitions = append(mm.Transitions, t)
+		}
+	}
+	if r.err != nil {
+		return r.err
+	}
+	if len(r.b) > 0 {
+		return &Error{0, strconv.Itoa(len(r.b)) + " bytes after the transitions"}
+	}
+	for i := 0; i < states; i++ {
+		mm.States = append(mm.States, "s"+strconv.Itoa(i))
+	}
+	*m = mm
+	return nil
+}
+
+// read a struct condition
+func decodeCondition(r *reader) (Condition, error) {
+	ip := net.IP(append([]byte{}, r.next(net.IPv6len)...))
+	eid := r.uint32()
+	op := r.byte()
+	value := r.next(1 + SM_VALUE_SIZE)
+	if r.err != nil {
+		return Condition{}, r.err
+	}
+	if value[0] != hexabus.DTYPE_DATETIME {
+		c := Condition{Kind: COND_ENDPOINT, Eid: eid, Op: op}
+		if !ip.Equal(LOCAL_IP) {
+			c.IP = ip
+		}
+		if _, ok := op_names[op]; !ok {
+			return Condition{}, &Error{0, "unknown operator " + strconv.Itoa(int(op))}
+		}
+		vr := &reader{b: value}
+		c.Value = vr.value()
+		if vr.err != nil {
+			return Condition{}, vr.err
+		}
+		if c.Value.Dtype == hexabus.DTYPE_UNDEFINED {
+			return Condition{}, &Error{0, "no value"}
+		}
+		return c, nil
+	}
+
+	c := Condition{Kind: COND_DATETIME, Field: op &^ DATETIME_GEQ, Op: OP_LT}
+	if op&DATETIME_GEQ != 0 {
+		c.Op = OP_GEQ
+	}
+	d := value[1:]
+	var n uint64
+	switch c.Field {
+	case TIME_HOUR:
+		n = uint64(d[0])
+	case TIME_MINUTE:
+		n = uint64(d[1])
+	case TIME_SECOND:
+		n = uint64(d[2])
+	case TIME_DAY:
+		n = uint64(d[3])
+	case TIME_MONTH:
+		n = uint64(d[4])
+	case TIME_YEAR:
+		n = uint64(binary.LittleEndian.Uint16(d[5:7]))
+	case TIME_WEEKDAY:
+		n = uint64(d[7])
+	default:
+		return Condition{}, &Error{0, "unknown time fields " + strconv.Itoa(int(c.Field))}
+	}
+	v, err := fieldValue(c.Field, hexabus.Value{Dtype: hexabus.DTYPE_UINT64, Data: n})
+	if err != nil {
+		return Condition{}, &Error{0, "value " + strconv.FormatUint(n, 10) + " of time." + field_names[c.Field] + ": " + err.Error()}
+	}
+	c.Value = v
+	return c, nil
+}
+
+// String returns the machine as source. The tables don't keep names, states
+// are named s0, s1, ... unless they came from Parse, the device running the
+// machine is local, the other devices dev1, dev2, ... and endpoints are named
+// after their EID like ep4.
+func (m *Machine) String() string {
+	type key struct {
+		eid   uint32
+		dtype byte
+	}
+	writable := map[key]bool{}
+	for _, t := range m.Transitions {
+		if t.Value.Dtype != hexabus.DTYPE_UNDEFINED {
+			writable[key{t.Eid, t.Value.Dtype}] = true
+		}
+	}
+
+	var endpoints []string
+	names := map[key]string{}
+	taken := map[string]bool{}
+	endpoint := func(eid uint32, dtype byte) string {
+		k := key{eid, dtype}
+		if name, ok := names[k]; ok {
+			return name
+		}
+		name := "ep" + strconv.FormatUint(uint64(eid), 10)
+		if taken[name] {
+			name += "_" + strings.ToLower(hexabus.DtypeName(dtype))
+		}
+		names[k], taken[name] = name, true
+		access := "read;"
+		if writable[k] {
+			access += " write;"
+		}
+		endpoints = append(endpoints, "endpoint "+name+"("+strconv.FormatUint(uint64(eid), 10)+" : "+strings.ToLower(hexabus.DtypeName(dtype))+") { "+access+" }")
+		return name
+	}
+
+	// the local device first, then the others in the order of their use
+	devices := []string{"local"}
+	addresses := map[string]string{"local": "::1"}
+	lists := map[string][]string{}
+	reference := func(ip net.IP, eid uint32, dtype byte) string {
+		device := "local"
+		if ip != nil {
+			for _, d := range devices {
+				if addresses[d] == ip.String() {
+					device = d
+				}
+			}
+			if device == "local" {
+				device = "dev" + strconv.Itoa(len(devices))
+				devices = append(devices, device)
+				addresses[device] = ip.String()
+			}
+		}
+		name := endpoint(eid, dtype)
+		for _, n := range lists[device] {
+			if n == name {
+				return device + "." + name
+			}
+		}
+		lists[device] = append(lists[device], name)
+		return device + "." + name
+	}
+
+	var body []string
+	for i := range m.States {
+		body = append(body, "\tstate "+m.state(byte(i))+" {")
+		for _, t := range m.Transitions {
+			if int(t.From) != i {
+				continue
+			}
+			if t.Cond == TRUE_COND_INDEX {
+				body = append(body, "\t\talways {")
+			} else if int(t.Cond) >= len(m.Conditions) {
+				body = append(body, "\t\tif (condition"+strconv.Itoa(int(t.Cond))+") {")
+			} else if c := m.Conditions[t.Cond]; c.Kind == COND_DATETIME {
+				body = append(body, "\t\tif ("+field_names[c.Field]+" "+op_names[c.Op]+" "+literal(c.Value)+") {")
+			} else {
+				body = append(body, "\t\tif ("+reference(c.IP, c.Eid, c.Value.Dtype)+" "+op_names[c.Op]+" "+literal(c.Value)+") {")
+			}
+			if t.Value.Dtype != hexabus.DTYPE_UNDEFINED {
+				body = append(body, "\t\t\t"+reference(nil, t.Eid, t.Value.Dtype)+" := "+literal(t.Value)+";")
+			}
+			line := "\t\t\tgoto " + m.state(t.Goto)
+			if t.Else != t.From {
+				line += " else " + m.state(t.Else)
+			}
+			body = append(body, line+";", "\t\t}")
+		}
+		body = append(body, "\t}")
+	}
+
+	lines := endpoints
+	if len(lines) > 0 {
+		lines = append(lines, "")
+	}
+	for _, d := range devices {
+		list := " "
+		if len(lists[d]) > 0 {
+			list = " " + strings.Join(lists[d], ", ") + " "
+		}
+		lines = append(lines, "device "+d+"("+addresses[d]+") {"+list+"}")
+	}
+	lines = append(lines, "", "machine sm on local {")
+	lines = append(lines, body...)
+	lines = append(lines, "}")
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// name of a state
+func (m *Machine) state(i byte) string {
+	if int(i) < len(m.States) {
+		return m.States[i]
+	}
+	return "s" + strconv.Itoa(int(i))
+}
+
+// value as it is written in the source
+func literal(v hexabus.Value) string {
+	if v.Dtype == hexabus.DTYPE_DATETIME {
+		return strconv.Quote(v.String())
+	}
+	return v.String()
+}
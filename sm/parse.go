@@ -0,0 +1,762 @@
+package sm
+
+import (
+	"github.com/morriswinkler/hexabus"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// kinds of tokens
+const (
+	tok_eof    = iota
+	tok_ident  // names and keywords
+	tok_number // numbers and durations, with sign
+	tok_string // quoted string, with the quotes
+	tok_punct  // operators and punctuation
+)
+
+// token of the source
+type token struct {
+	kind byte
+	text string
+	line int
+}
+
+// splits the source into tokens
+type scanner struct {
+	src    string
+	pos    int
+	line   int
+	peeked *token
+}
+
+// skip white space and comments, # and // up to the end of the line and
+// /* */
+func (s *scanner) skip() error {
+	for s.pos < len(s.src) {
+		ch := s.src[s.pos]
+		switch {
+		case ch == '\n':
+			s.line++
+			s.pos++
+		case ch == ' ' || ch == '\t' || ch == '\r':
+			s.pos++
+		case ch == '#' || strings.HasPrefix(s.src[s.pos:], "//"):
+			for s.pos < len(s.src) && s.src[s.pos] != '\n' {
+				s.pos++
+			}
+		case strings.HasPrefix(s.src[s.pos:], "/*"):
+			end := strings.Index(s.src[s.pos+2:], "*/")
+			if end < 0 {
+				return &Error{s.line, "unterminated comment"}
+			}
+			comment := s.src[s.pos : s.pos+2+end+2]
+			s.line += strings.Count(comment, "\n")
+			s.pos += len(comment)
+		default:
+			return nil
+		}
+	}
+	return nil
+}
+
+// next token
+func (s *scanner) next() (token, error) {
+	if s.peeked != nil {
+		t := *s.peeked
+		s.peeked = nil
+		return t, nil
+	}
+	err := s.skip()
+	if err != nil {
+		return token{}, err
+	}
+	if s.pos == len(s.src) {
+		return token{tok_eof, "end of file", s.line}, nil
+	}
+
+	start := s.pos
+	ch := s.src[s.pos]
+	switch {
+	case ch == '_' || letter(ch):
+		for s.pos < len(s.src) && (s.src[s.pos] == '_' || letter(s.src[s.pos]) || digit(s.src[s.pos])) {
+			s.pos++
+		}
+		return token{tok_ident, s.src[start:s.pos], s.line}, nil
+	case digit(ch) || ((ch == '-' || ch == '+') && s.pos+1 < len(s.src) && digit(s.src[s.pos+1])):
+		s.pos++
+		for s.pos < len(s.src) && (s.src[s.pos] == '.' || letter(s.src[s.pos]) || digit(s.src[s.pos])) {
+			s.pos++
+		}
+		return token{tok_number, s.src[start:s.pos], s.line}, nil
+	case ch == '"':
+		for s.pos++; s.pos < len(s.src) && s.src[s.pos] != '"' && s.src[s.pos] != '\n'; s.pos++ {
+			if s.src[s.pos] == '\\' {
+				s.pos++
+			}
+		}
+		if s.pos >= len(s.src) || s.src[s.pos] != '"' {
+			return token{}, &Error{s.line, "unterminated string"}
+		}
+		s.pos++
+		return token{tok_string, s.src[start:s.pos], s.line}, nil
+	}
+	for _, op := range []string{":=", "==", "!=", "<=", ">="} {
+		if strings.HasPrefix(s.src[s.pos:], op) {
+			s.pos += 2
+			return token{tok_punct, op, s.line}, nil
+		}
+	}
+	if strings.IndexByte("{}();,.:<>", ch) < 0 {
+		return token{}, &Error{s.line, "unexpected " + strconv.QuoteRune(rune(ch))}
+	}
+	s.pos++
+	return token{tok_punct, string(ch), s.line}, nil
+}
+
+// next token without consuming it
+func (s *scanner) peek() (token, error) {
+	if s.peeked == nil {
+		t, err := s.next()
+		if err != nil {
+			return token{}, err
+		}
+		s.peeked = &t
+	}
+	return *s.peeked, nil
+}
+
+// source text up to the next end byte, which is consumed as well
+func (s *scanner) raw(end byte) (string, error) {
+	if s.peeked != nil {
+		return "", &Error{s.peeked.line, "unexpected " + s.peeked.text}
+	}
+	i := strings.IndexByte(s.src[s.pos:], end)
+	if i < 0 || strings.Contains(s.src[s.pos:s.pos+i], "\n") {
+		return "", &Error{s.line, "missing " + string(end)}
+	}
+	text := strings.TrimSpace(s.src[s.pos : s.pos+i])
+	s.pos += i + 1
+	return text, nil
+}
+
+func letter(ch byte) bool {
+	return (ch >= 'a' && ch <= 'z') || (ch >= 'A' && ch <= 'Z')
+}
+
+func digit(ch byte) bool {
+	return ch >= '0' && ch <= '9'
+}
+
+// endpoint declaration
+type endpoint struct {
+	eid      uint32
+	dtype    byte
+	writable bool
+}
+
+// device declaration
+type device struct {
+	ip        net.IP          // nil for the device running the machine
+	endpoints map[string]bool // names of the endpoints of the device
+}
+
+// transition whose states are resolved after the machine was read
+type pending struct {
+	t    Transition
+	good token  // goto state
+	bad  *token // else state, nil for none
+}
+
+// state of the parser
+type parser struct {
+	s         scanner
+	m         *Machine
+	endpoints map[string]endpoint
+	devices   map[string]*device
+	states    map[string]byte
+	conds     map[string]byte // index of the conditions by binary encoding
+	tables    [2]int          // transitions and datetime transitions
+}
+
+// Parse reads the source of a state machine, errors are returned as *Error
+// with the line. Endpoints and devices have to be declared before they are
+// used, states may be used before their block.
+func Parse(src string) (*Machine, error) {
+	p := &parser{
+		s:         scanner{src: src, line: 1},
+		endpoints: map[string]endpoint{},
+		devices:   map[string]*device{},
+		states:    map[string]byte{},
+		conds:     map[string]byte{},
+	}
+	for {
+		t, err := p.s.next()
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case t.kind == tok_eof:
+			if p.m == nil {
+				return nil, &Error{0, "no machine declared"}
+			}
+			return p.m, nil
+		case t.text == "endpoint":
+			err = p.endpoint()
+		case t.text == "device":
+			err = p.device()
+		case t.text == "machine" && p.m == nil:
+			err = p.machine()
+		case t.text == "machine":
+			err = &Error{t.line, "only one machine fits the tables"}
+		default:
+			err = unexpected(t)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// error for a token that doesn't fit the grammar
+func unexpected(t token) error {
+	return &Error{t.line, "unexpected " + t.text}
+}
+
+// consume the token text
+func (p *parser) expect(text string) (token, error) {
+	t, err := p.s.next()
+	if err != nil {
+		return token{}, err
+	}
+	if t.text != text || t.kind == tok_string {
+		return token{}, &Error{t.line, "expected " + text + " instead of " + t.text}
+	}
+	return t, nil
+}
+
+// consume a name that isn't a keyword
+func (p *parser) name(what string) (token, error) {
+	t, err := p.s.next()
+	if err != nil {
+		return token{}, err
+	}
+	if t.kind != tok_ident || keywords[t.text] {
+		return token{}, &Error{t.line, "expected " + what + " name instead of " + t.text}
+	}
+	return t, nil
+}
+
+// consume the token text if it comes next
+func (p *parser) accept(text string) (bool, error) {
+	t, err := p.s.peek()
+	if err != nil || t.text != text || t.kind == tok_string {
+		return false, err
+	}
+	p.s.next()
+	return true, nil
+}
+
+var keywords = map[string]bool{
+	"endpoint": true, "device": true, "machine": true,
+	"state": true, "if": true, "always": true, "goto": true, "else": true,
+	"true": true, "false": true,
+}
+
+// endpoint <name>(<eid> : <datatype>) { read; write; broadcast; }
+func (p *parser) endpoint() error {
+	name, err := p.name("endpoint")
+	if err != nil {
+		return err
+	}
+	if _, ok := p.endpoints[name.text]; ok {
+		return &Error{name.line, "endpoint " + name.text + " declared twice"}
+	}
+	if _, err = p.expect("("); err != nil {
+		return err
+	}
+	t, err := p.s.next()
+	if err != nil {
+		return err
+	}
+	eid, err := strconv.ParseUint(t.text, 0, 32)
+	if err != nil || t.kind != tok_number {
+		return &Error{t.line, "invalid eid " + t.text}
+	}
+	if _, err = p.expect(":"); err != nil {
+		return err
+	}
+	t, err = p.s.next()
+	if err != nil {
+		return err
+	}
+	dtype, ok := dtypeNamed(t.text)
+	if !ok || t.kind != tok_ident {
+		return &Error{t.line, "unknown data type " + t.text}
+	}
+	if err = fits(dtype); err != nil {
+		return errorAt(t.line, err)
+	}
+	if _, err = p.expect(")"); err != nil {
+		return err
+	}
+	if _, err = p.expect("{"); err != nil {
+		return err
+	}
+	ep := endpoint{eid: uint32(eid), dtype: dtype}
+	for {
+		t, err := p.s.next()
+		if err != nil {
+			return err
+		}
+		switch t.text {
+		case "}":
+			p.endpoints[name.text] = ep
+			return nil
+		case "write":
+			ep.writable = true
+		case "read", "broadcast":
+		default:
+			return &Error{t.line, "unknown access " + t.text}
+		}
+		if _, err = p.expect(";"); err != nil {
+			return err
+		}
+	}
+}
+
+// device <name>(<address>) { <endpoint>, ... }
+func (p *parser) device() error {
+	name, err := p.name("device")
+	if err != nil {
+		return err
+	}
+	if _, ok := p.devices[name.text]; ok {
+		return &Error{name.line, "device " + name.text + " declared twice"}
+	}
+	if _, ok := lookup(field_names, name.text); ok {
+		return &Error{name.line, "device name " + name.text + " is a time field"}
+	}
+	if _, err = p.expect("("); err != nil {
+		return err
+	}
+	text, err := p.s.raw(')')
+	if err != nil {
+		return err
+	}
+	ip, err := address(text)
+	if err != nil {
+		return errorAt(name.line, err)
+	}
+	if ip.Equal(LOCAL_IP) {
+		ip = nil
+	}
+	if _, err = p.expect("{"); err != nil {
+		return err
+	}
+	d := &device{ip: ip, endpoints: map[string]bool{}}
+	if ok, err := p.accept("}"); ok || err != nil {
+		p.devices[name.text] = d
+		return err
+	}
+	for {
+		t, err := p.name("endpoint")
+		if err != nil {
+			return err
+		}
+		if _, ok := p.endpoints[t.text]; !ok {
+			return &Error{t.line, "unknown endpoint " + t.text}
+		}
+		d.endpoints[t.text] = true
+		t, err = p.s.next()
+		if err != nil {
+			return err
+		}
+		switch t.text {
+		case "}":
+			p.devices[name.text] = d
+			return nil
+		case ",":
+		default:
+			return unexpected(t)
+		}
+	}
+}
+
+// machine <name> on <device> { state <name> { ... } ... }
+func (p *parser) machine() error {
+	if _, err := p.name("machine"); err != nil {
+		return err
+	}
+	if _, err := p.expect("on"); err != nil {
+		return err
+	}
+	t, err := p.name("device")
+	if err != nil {
+		return err
+	}
+	local, ok := p.devices[t.text]
+	if !ok {
+		return &Error{t.line, "unknown device " + t.text}
+	}
+	// the machine's own endpoints are addressed as local ones
+	local.ip = nil
+	if _, err = p.expect("{"); err != nil {
+		return err
+	}
+
+	m := &Machine{}
+	p.m = m
+	var transitions []pending
+	for {
+		t, err := p.s.next()
+		if err != nil {
+			return err
+		}
+		if t.text == "}" {
+			break
+		}
+		if t.text != "state" {
+			return unexpected(t)
+		}
+		name, err := p.name("state")
+		if err != nil {
+			return err
+		}
+		if _, ok := p.states[name.text]; ok {
+			return &Error{name.line, "state " + name.text + " declared twice"}
+		}
+		if len(m.States) == MAX_STATES {
+			return &Error{name.line, "more than " + strconv.Itoa(MAX_STATES) + " states"}
+		}
+		from := byte(len(m.States))
+		p.states[name.text] = from
+		m.States = append(m.States, name.text)
+		if _, err = p.expect("{"); err != nil {
+			return err
+		}
+		for {
+			t, err := p.s.next()
+			if err != nil {
+				return err
+			}
+			if t.text == "}" {
+				break
+			}
+			tr, err := p.transition(t, local)
+			if err != nil {
+				return err
+			}
+			tr.t.From = from
+			transitions = append(transitions, tr)
+		}
+	}
+	if len(m.States) == 0 {
+		return &Error{t.line, "machine without states"}
+	}
+
+	for _, tr := range transitions {
+		tr.t.Goto, err = p.state(tr.good)
+		if err != nil {
+			return err
+		}
+		tr.t.Else = tr.t.From
+		if tr.bad != nil {
+			tr.t.Else, err = p.state(*tr.bad)
+			if err != nil {
+				return err
+			}
+		}
+		m.Transitions = append(m.Transitions, tr.t)
+	}
+	return nil
+}
+
+// if (<condition>) { [<device>.<endpoint> := <value>;] goto <state> [else <state>]; }
+// or always { ... }, t is the if or always
+func (p *parser) transition(t token, local *device) (pending, error) {
+	tr := pending{t: Transition{Cond: TRUE_COND_INDEX, line: t.line}}
+	var err error
+	switch t.text {
+	case "always":
+	case "if":
+		if _, err = p.expect("("); err != nil {
+			return pending{}, err
+		}
+		tr.t.Cond, err = p.condition()
+		if err != nil {
+			return pending{}, err
+		}
+		if _, err = p.expect(")"); err != nil {
+			return pending{}, err
+		}
+	default:
+		return pending{}, unexpected(t)
+	}
+	table := 0
+	if tr.t.Cond != TRUE_COND_INDEX && p.m.Conditions[tr.t.Cond].Kind == COND_DATETIME {
+		table = 1
+	}
+	if p.tables[table] == MAX_TRANSITIONS {
+		return pending{}, &Error{t.line, "more than " + strconv.Itoa(MAX_TRANSITIONS) + " transitions"}
+	}
+	p.tables[table]++
+
+	if _, err = p.expect("{"); err != nil {
+		return pending{}, err
+	}
+	next, err := p.s.peek()
+	if err != nil {
+		return pending{}, err
+	}
+	if next.text != "goto" {
+		d, ep, ref, err := p.reference()
+		if err != nil {
+			return pending{}, err
+		}
+		if d != local {
+			return pending{}, &Error{next.line, ref + " is not an endpoint of the machine's device"}
+		}
+		if !ep.writable {
+			return pending{}, &Error{next.line, ref + " is read only"}
+		}
+		if _, err = p.expect(":="); err != nil {
+			return pending{}, err
+		}
+		tr.t.Eid = ep.eid
+		tr.t.Value, err = p.value(ep.dtype)
+		if err != nil {
+			return pending{}, err
+		}
+		if _, err = p.expect(";"); err != nil {
+			return pending{}, err
+		}
+	}
+	if _, err = p.expect("goto"); err != nil {
+		return pending{}, err
+	}
+	if tr.good, err = p.name("state"); err != nil {
+		return pending{}, err
+	}
+	ok, err := p.accept("else")
+	if err != nil {
+		return pending{}, err
+	}
+	if ok {
+		t, err := p.name("state")
+		if err != nil {
+			return pending{}, err
+		}
+		tr.bad = &t
+	}
+	if _, err = p.expect(";"); err != nil {
+		return pending{}, err
+	}
+	if _, err = p.expect("}"); err != nil {
+		return pending{}, err
+	}
+	return tr, nil
+}
+
+// parse a condition and return its index, equal conditions share the index
+func (p *parser) condition() (byte, error) {
+	first, err := p.s.peek()
+	if err != nil {
+		return 0, err
+	}
+	c := Condition{Kind: COND_DATETIME}
+	var ep endpoint
+	field, ok := lookup(field_names, first.text)
+	if ok && first.kind == tok_ident {
+		p.s.next()
+		c.Field = field
+	} else {
+		var d *device
+		d, ep, _, err = p.reference()
+		if err != nil {
+			return 0, err
+		}
+		c = Condition{Kind: COND_ENDPOINT, IP: d.ip, Eid: ep.eid}
+	}
+
+	t, err := p.s.next()
+	if err != nil {
+		return 0, err
+	}
+	c.Op, ok = lookup(op_names, t.text)
+	if !ok || t.kind != tok_punct {
+		return 0, &Error{t.line, "unknown operator " + t.text}
+	}
+
+	if c.Kind == COND_DATETIME {
+		if c.Op != OP_LT && c.Op != OP_GEQ {
+			return 0, &Error{t.line, "time fields can only be compared with < and >="}
+		}
+		v, err := p.s.next()
+		if err != nil {
+			return 0, err
+		}
+		n, err := strconv.ParseUint(v.text, 0, 16)
+		if err == nil && v.kind == tok_number {
+			c.Value, err = fieldValue(field, hexabus.Value{Dtype: hexabus.DTYPE_UINT16, Data: uint16(n)})
+		}
+		if err != nil || v.kind != tok_number {
+			return 0, &Error{v.line, "invalid " + first.text + " " + v.text}
+		}
+	} else {
+		if c.Op != OP_EQ && c.Op != OP_NEQ && !ordered(ep.dtype) {
+			return 0, &Error{t.line, t.text + " on " + hexabus.DtypeName(ep.dtype) + " endpoint"}
+		}
+		if ep.dtype == hexabus.DTYPE_DATETIME {
+			return 0, &Error{t.line, "DateTime endpoints can't be compared, use the time fields"}
+		}
+		c.Value, err = p.value(ep.dtype)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	b, err := encodeCondition(c)
+	if err != nil {
+		return 0, errorAt(first.line, err)
+	}
+	if i, ok := p.conds[string(b)]; ok {
+		return i, nil
+	}
+	if len(p.m.Conditions) == MAX_CONDITIONS {
+		return 0, &Error{first.line, "more than " + strconv.Itoa(MAX_CONDITIONS) + " conditions"}
+	}
+	i := byte(len(p.m.Conditions))
+	p.conds[string(b)] = i
+	p.m.Conditions = append(p.m.Conditions, c)
+	return i, nil
+}
+
+// <device>.<endpoint>, returned with its source
+func (p *parser) reference() (*device, endpoint, string, error) {
+	t, err := p.name("device")
+	if err != nil {
+		return nil, endpoint{}, "", err
+	}
+	d, ok := p.devices[t.text]
+	if !ok {
+		return nil, endpoint{}, "", &Error{t.line, "unknown device " + t.text}
+	}
+	if _, err = p.expect("."); err != nil {
+		return nil, endpoint{}, "", err
+	}
+	e, err := p.name("endpoint")
+	if err != nil {
+		return nil, endpoint{}, "", err
+	}
+	ep, ok := p.endpoints[e.text]
+	if !ok {
+		return nil, endpoint{}, "", &Error{e.line, "unknown endpoint " + e.text}
+	}
+	if !d.endpoints[e.text] {
+		return nil, endpoint{}, "", &Error{e.line, "device " + t.text + " has no endpoint " + e.text}
+	}
+	return d, ep, t.text + "." + e.text, nil
+}
+
+// value of an endpoint with data type dtype: true, false, a number or a
+// quoted DateTime like "2014-03-06 17:02:15"
+func (p *parser) value(dtype byte) (hexabus.Value, error) {
+	t, err := p.s.next()
+	if err != nil {
+		return hexabus.Value{}, err
+	}
+	text := t.text
+	switch {
+	case t.kind == tok_string:
+		text, err = strconv.Unquote(t.text)
+		if err != nil {
+			return hexabus.Value{}, &Error{t.line, "invalid string " + t.text}
+		}
+	case t.kind == tok_number, t.text == "true", t.text == "false":
+	default:
+		return hexabus.Value{}, &Error{t.line, "expected a value instead of " + t.text}
+	}
+	var v hexabus.Value
+	if dtype == hexabus.DTYPE_DATETIME {
+		// the wall clock fields, independent of the local time zone
+		var tm time.Time
+		tm, err = time.Parse(hexabus.DATETIME_LAYOUT, text)
+		if err == nil {
+			v, err = hexabus.NewValue(dtype, tm)
+		}
+	} else {
+		v, err = hexabus.ParseValue(dtype, text)
+	}
+	if err != nil {
+		return hexabus.Value{}, &Error{t.line, "invalid " + hexabus.DtypeName(dtype) + " value " + t.text + ": " + err.Error()}
+	}
+	return v, nil
+}
+
+// index of a state
+func (p *parser) state(t token) (byte, error) {
+	i, ok := p.states[t.text]
+	if !ok {
+		return 0, &Error{t.line, "unknown state " + t.text}
+	}
+	return i, nil
+}
+
+// data type of a name like uint8, the case doesn't matter
+func dtypeNamed(name string) (byte, bool) {
+	for dtype := 1; dtype < 256; dtype++ {
+		if strings.EqualFold(hexabus.DtypeName(byte(dtype)), name) {
+			return byte(dtype), true
+		}
+	}
+	return 0, false
+}
+
+// value of a time field converted to UInt8, UInt16 for the year
+func fieldValue(field byte, v hexabus.Value) (hexabus.Value, error) {
+	dtype := byte(hexabus.DTYPE_UINT8)
+	if field == TIME_YEAR {
+		dtype = hexabus.DTYPE_UINT16
+	}
+	v, err := hexabus.NewValue(dtype, v)
+	if err != nil {
+		return hexabus.Value{}, err
+	}
+	var u uint64
+	switch d := v.Data.(type) {
+	case uint8:
+		u = uint64(d)
+	case uint16:
+		u = uint64(d)
+	}
+	min := uint64(0)
+	if field == TIME_DAY || field == TIME_MONTH {
+		min = 1
+	}
+	if u < min || u > field_max[field] {
+		return hexabus.Value{}, hexabus.Error(hexabus.ERR_VALUERANGE)
+	}
+	return v, nil
+}
+
+// IPv6 address of a device
+func address(s string) (net.IP, error) {
+	ip := net.ParseIP(s)
+	if ip == nil || ip.To4() != nil || ip.IsUnspecified() {
+		return nil, &Error{0, "invalid IPv6 address " + s}
+	}
+	return ip, nil
+}
+
+// key of a name in a table of names
+func lookup(names map[byte]string, name string) (byte, bool) {
+	for b, n := range names {
+		if n == name {
+			return b, true
+		}
+	}
+	return 0, false
+}
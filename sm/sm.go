@@ -0,0 +1,354 @@
+// Package sm compiles Hexabus state machines into the binary tables that are
+// uploaded to a device with hexabus.SMUploader, and disassembles them again.
+//
+// The source is modelled on the language of hbcomp, the compiler of the
+// Hexabus host software, restricted to what the tables can express:
+//
+//	endpoint relay(1 : bool) { read; write; }
+//	endpoint button(4 : bool) { read; broadcast; }
+//	endpoint temperature(2 : float) { read; broadcast; }
+//
+//	device plug(fd00::50:c4ff:fe04:8390) { relay, temperature }
+//	device sensor(fd00::50:c4ff:fe04:1) { button }
+//
+//	machine lights on plug {
+//		state off {                    # the first state is the initial one
+//			if (sensor.button == true) {
+//				plug.relay := true;
+//				goto on;
+//			}
+//			if (plug.temperature > 25.5) {
+//				goto on;
+//			}
+//		}
+//		state on {
+//			if (sensor.button == true) {
+//				plug.relay := false;
+//				goto off else off;     # off even if the write fails
+//			}
+//			if (hour >= 23) {
+//				plug.relay := false;
+//				goto off;
+//			}
+//		}
+//	}
+//
+// Endpoints are declared with their EID, data type and access, read,
+// write and broadcast, devices with their address and endpoints. The
+// machine runs on one of the devices, only its endpoints can be written.
+// Endpoints and devices have to be declared before their use. Comments
+// start with # or // and run to the end of the line, or are enclosed in /*
+// and */.
+//
+// Every if or always block of a state is a transition: when the condition
+// holds, or always, the value is written to the endpoint and the machine
+// goes to the goto state, or to the else state if the write fails. The
+// write and the else state are optional, without else the machine stays in
+// its state if the write fails. Conditions are
+//
+//	<device>.<endpoint> <op> <value>   value received from a device
+//	<field> < <number>                 date and time of the device
+//	<field> >= <number>
+//
+// with the operators == != < <= > >= for values. Time fields are hour,
+// minute, second, day, month, year and weekday (Sunday = 0). Values are
+// given as text for the data type of their endpoint, see
+// hexabus.ParseValue, like true, 25.5 or 0x10, a DateTime quoted like
+// "2014-03-06 17:02:15". Strings and byte data don't fit the tables. The
+// tables hold one machine with one condition and one write per transition,
+// compound conditions and several writes per block are not supported.
+//
+// The binary tables are the ones the firmware reads after the upload, the
+// packed structs of its state machine:
+//
+//	uint8_t count; struct condition conditions[count];
+//	uint8_t count; struct transition transitions[count];
+//	uint8_t count; struct transition datetime_transitions[count];
+//
+//	struct condition {              // SM_CONDITION_SIZE bytes
+//		uint8_t  sourceIP[16];      // ::1 for the local device
+//		uint32_t sourceEID;
+//		uint8_t  op;                // OP_*, TIME_* for datetime conditions
+//		struct hxb_value value;
+//	};
+//	struct transition {             // SM_TRANSITION_SIZE bytes
+//		uint8_t  fromState;
+//		uint8_t  cond;              // index of the condition, TRUE_COND_INDEX for always
+//		uint32_t eid;               // EID written
+//		uint8_t  goodState;         // goto state
+//		uint8_t  badState;          // else state
+//		struct hxb_value value;     // DTYPE_UNDEFINED for no write
+//	};
+//	struct hxb_value {
+//		uint8_t datatype;
+//		uint8_t data[SM_VALUE_SIZE]; // payload, zero padded
+//	};
+//
+// Numbers are little endian like in the memory of the device. Datetime
+// conditions have a DateTime value with the compared field set, their
+// transitions are in the datetime table which the firmware checks
+// periodically instead of on every received packet.
+package sm
+
+import (
+	"github.com/morriswinkler/hexabus"
+	"net"
+	"strconv"
+)
+
+// Layout of the tables.
+const (
+	// condition index of transitions that always fire
+	TRUE_COND_INDEX = 255
+
+	// payload bytes of a value, larger data types can't be used
+	SM_VALUE_SIZE = 8
+
+	// bytes of a struct condition and a struct transition
+	SM_CONDITION_SIZE  = 16 + 4 + 1 + 1 + SM_VALUE_SIZE
+	SM_TRANSITION_SIZE = 1 + 1 + 4 + 1 + 1 + 1 + SM_VALUE_SIZE
+)
+
+// source address of conditions on the device's own endpoints
+var LOCAL_IP = net.IPv6loopback
+
+// Condition kinds.
+const (
+	COND_ENDPOINT = 0x01 // compares the value of an EID on a device
+	COND_DATETIME = 0x02 // compares a field of the date and time
+)
+
+// Comparison operators, STM_* of the firmware.
+const (
+	OP_EQ  = 0x00 // ==
+	OP_LEQ = 0x01 // <=
+	OP_GEQ = 0x02 // >=
+	OP_LT  = 0x03 // <
+	OP_GT  = 0x04 // >
+	OP_NEQ = 0x05 // !=
+)
+
+// Date and time fields, HXB_SM_* of the firmware. The op of a datetime
+// condition is the field with DATETIME_GEQ set for >= and clear for <.
+const (
+	TIME_HOUR    = 0x01
+	TIME_MINUTE  = 0x02
+	TIME_SECOND  = 0x04
+	TIME_DAY     = 0x08
+	TIME_MONTH   = 0x10
+	TIME_YEAR    = 0x20
+	TIME_WEEKDAY = 0x40
+	DATETIME_GEQ = 0x80
+)
+
+// limits of the one byte counts and indexes
+const (
+	MAX_STATES      = 255
+	MAX_CONDITIONS  = 255
+	MAX_TRANSITIONS = 255 // of each transition table
+)
+
+// Machine is a parsed or disassembled state machine.
+type Machine struct {
+	States      []string // state names, index 0 is the initial state
+	Conditions  []Condition
+	Transitions []Transition
+}
+
+// Condition of a transition.
+type Condition struct {
+	Kind  byte          // COND_*
+	IP    net.IP        // source device of COND_ENDPOINT, nil for the local device
+	Eid   uint32        // source EID of COND_ENDPOINT
+	Field byte          // TIME_* of COND_DATETIME
+	Op    byte          // OP_*, OP_LT or OP_GEQ for COND_DATETIME
+	Value hexabus.Value // compared value
+}
+
+// Transition from one state to another.
+type Transition struct {
+	From  byte          // state the transition leaves
+	Cond  byte          // index of the condition, TRUE_COND_INDEX for always
+	Eid   uint32        // local EID written, if Value is set
+	Value hexabus.Value // written value, DTYPE_UNDEFINED for none
+	Goto  byte          // next state
+	Else  byte          // next state if the write fails
+	line  int           // source line for validation errors
+}
+
+// Error is a syntax or validation error in the state machine source.
+type Error struct {
+	Line int // source line, 0 if unknown
+	Msg  string
+}
+
+func (e *Error) Error() string {
+	if e.Line == 0 {
+		return "state machine: " + e.Msg
+	}
+	return "state machine line " + strconv.Itoa(e.Line) + ": " + e.Msg
+}
+
+// err at a source line, the message of an *Error is kept
+func errorAt(line int, err error) error {
+	if e, ok := err.(*Error); ok {
+		return &Error{line, e.Msg}
+	}
+	return &Error{line, err.Error()}
+}
+
+var op_names = map[byte]string{
+	OP_EQ:  "==",
+	OP_NEQ: "!=",
+	OP_LT:  "<",
+	OP_LEQ: "<=",
+	OP_GT:  ">",
+	OP_GEQ: ">=",
+}
+
+var field_names = map[byte]string{
+	TIME_HOUR:    "hour",
+	TIME_MINUTE:  "minute",
+	TIME_SECOND:  "second",
+	TIME_DAY:     "day",
+	TIME_MONTH:   "month",
+	TIME_YEAR:    "year",
+	TIME_WEEKDAY: "weekday",
+}
+
+// largest value of the time fields, smallest is 0 except for day and month
+var field_max = map[byte]uint64{
+	TIME_HOUR:    23,
+	TIME_MINUTE:  59,
+	TIME_SECOND:  59,
+	TIME_DAY:     31,
+	TIME_MONTH:   12,
+	TIME_YEAR:    65535,
+	TIME_WEEKDAY: 6,
+}
+
+// Compile parses the source of a state machine, validates it against the
+// endpoints of the device running it and of the source devices, see
+// Validate, and returns the binary tables.
+func Compile(src string, local []hexabus.EID, remote map[string][]hexabus.EID) ([]byte, error) {
+	m, err := Parse(src)
+	if err != nil {
+		return nil, err
+	}
+	err = m.Validate(local, remote)
+	if err != nil {
+		return nil, err
+	}
+	return m.MarshalBinary()
+}
+
+// Disassemble decodes binary tables and returns them as source, which
+// compiles to the same tables again, up to the order of the transitions of
+// different states. See Machine.String for the names.
+func Disassemble(program []byte) (string, error) {
+	m := &Machine{}
+	err := m.UnmarshalBinary(program)
+	if err != nil {
+		return "", err
+	}
+	return m.String(), nil
+}
+
+// Validate checks the machine against endpoint lists as returned by
+// hexabus.QueryEids. Written EID's have to be writable endpoints in local,
+// EID's in conditions have to exist on their device. Values are converted
+// to the data type of their endpoint. Devices missing in remote, which is
+// keyed by address, and a nil local list are not checked.
+func (m *Machine) Validate(local []hexabus.EID, remote map[string][]hexabus.EID) error {
+	devices := map[string][]hexabus.EID{}
+	for address, eids := range remote {
+		if ip := net.ParseIP(address); ip != nil {
+			address = ip.String()
+		}
+		devices[address] = eids
+	}
+
+	for i, c := range m.Conditions {
+		if c.Kind != COND_ENDPOINT {
+			continue
+		}
+		var eids []hexabus.EID
+		if c.IP == nil {
+			eids = local
+		} else {
+			eids = devices[c.IP.String()]
+		}
+		if eids == nil {
+			continue
+		}
+		ep, ok := find(eids, c.Eid)
+		if !ok {
+			return &Error{m.conditionLine(i), "eid " + strconv.FormatUint(uint64(c.Eid), 10) + " does not exist on " + source(c.IP)}
+		}
+		v, err := hexabus.NewValue(ep.Dtype, c.Value)
+		if err != nil {
+			return &Error{m.conditionLine(i), "value " + c.Value.String() + " of eid " + strconv.FormatUint(uint64(c.Eid), 10) + ": " + err.Error()}
+		}
+		if c.Op != OP_EQ && c.Op != OP_NEQ && !ordered(v.Dtype) {
+			return &Error{m.conditionLine(i), op_names[c.Op] + " on " + hexabus.DtypeName(v.Dtype) + " eid " + strconv.FormatUint(uint64(c.Eid), 10)}
+		}
+		m.Conditions[i].Value = v
+	}
+
+	for i, t := range m.Transitions {
+		if t.Value.Dtype == hexabus.DTYPE_UNDEFINED || local == nil {
+			continue
+		}
+		eid := strconv.FormatUint(uint64(t.Eid), 10)
+		ep, ok := find(local, t.Eid)
+		if !ok {
+			return &Error{t.line, "eid " + eid + " does not exist"}
+		}
+		if !ep.Writable {
+			return &Error{t.line, "eid " + eid + " is read only"}
+		}
+		v, err := hexabus.NewValue(ep.Dtype, t.Value)
+		if err != nil {
+			return &Error{t.line, "value " + t.Value.String() + " of eid " + eid + ": " + err.Error()}
+		}
+		m.Transitions[i].Value = v
+	}
+	return nil
+}
+
+// line of the first transition using a condition
+func (m *Machine) conditionLine(cond int) int {
+	for _, t := range m.Transitions {
+		if int(t.Cond) == cond {
+			return t.line
+		}
+	}
+	return 0
+}
+
+// endpoint eid in eids
+func find(eids []hexabus.EID, eid uint32) (hexabus.EID, bool) {
+	for _, ep := range eids {
+		if ep.Eid == eid {
+			return ep, true
+		}
+	}
+	return hexabus.EID{}, false
+}
+
+// data types that can be compared with < and >
+func ordered(dtype byte) bool {
+	switch dtype {
+	case hexabus.DTYPE_BOOL, hexabus.DTYPE_128STRING, hexabus.DTYPE_16BYTES, hexabus.DTYPE_66BYTES, hexabus.DTYPE_DATETIME:
+		return false
+	}
+	return true
+}
+
+// name of a source device in messages
+func source(ip net.IP) string {
+	if ip == nil {
+		return "local"
+	}
+	return "[" + ip.String() + "]"
+}
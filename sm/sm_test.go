@@ -0,0 +1,320 @@
+package sm
+
+import (
+	"bytes"
+	"errors"
+	"github.com/morriswinkler/hexabus"
+	"strings"
+	"testing"
+)
+
+const example = `
+endpoint relay(1 : bool) { read; write; }
+endpoint temperature(2 : float) { read; broadcast; }
+endpoint button(4 : bool) { read; broadcast; }
+
+device plug(fd00::50:c4ff:fe04:8390) { relay, temperature }
+device sensor(fd00::50:c4ff:fe04:1) { button }
+
+machine lights on plug {
+	state off { # the first state is the initial one
+		if (sensor.button == true) {
+			plug.relay := true;
+			goto on;
+		}
+		if (plug.temperature > 25.5) {
+			goto on;
+		}
+	}
+	state on {
+		if (sensor.button == true) {
+			plug.relay := false;
+			goto off else off;
+		}
+		/* checked periodically */
+		if (hour >= 23) {
+			plug.relay := false;
+			goto off;
+		}
+	}
+}
+`
+
+var local_eids = []hexabus.EID{
+	{Eid: 1, Dtype: hexabus.DTYPE_BOOL, Writable: true},
+	{Eid: 2, Dtype: hexabus.DTYPE_FLOAT},
+	{Eid: 3, Dtype: hexabus.DTYPE_UINT8, Writable: true},
+}
+
+var remote_eids = map[string][]hexabus.EID{
+	"fd00:0::50:c4ff:fe04:1": {{Eid: 4, Dtype: hexabus.DTYPE_BOOL}},
+}
+
+func Test_Parse(t *testing.T) {
+	m, err := Parse(example)
+	if err != nil {
+		t.Fatalf("Parse failed: %s", err)
+	}
+	if len(m.States) != 2 || m.States[0] != "off" {
+		t.Errorf("states %v", m.States)
+	}
+	// the button conditions are shared
+	if len(m.Conditions) != 3 || len(m.Transitions) != 4 || m.Transitions[0].Cond != m.Transitions[2].Cond {
+		t.Fatalf("%d conditions, %d transitions", len(m.Conditions), len(m.Transitions))
+	}
+	c := m.Conditions[0]
+	if c.Kind != COND_ENDPOINT || c.IP.String() != "fd00::50:c4ff:fe04:1" || c.Eid != 4 || c.Op != OP_EQ || c.Value.Data != true {
+		t.Errorf("condition 0 is %+v", c)
+	}
+	// the machine's own endpoints are local
+	c = m.Conditions[1]
+	if c.IP != nil || c.Eid != 2 || c.Op != OP_GT || c.Value != (hexabus.Value{Dtype: hexabus.DTYPE_FLOAT, Data: float32(25.5)}) {
+		t.Errorf("condition 1 is %+v", c)
+	}
+	c = m.Conditions[2]
+	if c.Kind != COND_DATETIME || c.Field != TIME_HOUR || c.Op != OP_GEQ || c.Value != (hexabus.Value{Dtype: hexabus.DTYPE_UINT8, Data: uint8(23)}) {
+		t.Errorf("condition 2 is %+v", c)
+	}
+	tr := m.Transitions[2]
+	if tr.From != 1 || tr.Eid != 1 || tr.Value.Data != false || tr.Goto != 0 || tr.Else != 0 {
+		t.Errorf("transition 2 is %+v", tr)
+	}
+	if tr = m.Transitions[0]; tr.Else != tr.From {
+		t.Errorf("transition without else goes to %d", tr.Else)
+	}
+	if tr = m.Transitions[1]; tr.Value.Dtype != hexabus.DTYPE_UNDEFINED {
+		t.Errorf("transition without write writes %v", tr.Value)
+	}
+	if tr = m.Transitions[3]; tr.line != 25 {
+		t.Errorf("transition 3 is on line %d", tr.line)
+	}
+}
+
+func Test_Compile(t *testing.T) {
+	program, err := Compile(example, local_eids, remote_eids)
+	if err != nil {
+		t.Fatalf("Compile failed: %s", err)
+	}
+	src, err := Disassemble(program)
+	if err != nil {
+		t.Fatalf("Disassemble failed: %s", err)
+	}
+	again, err := Compile(src, local_eids, remote_eids)
+	if err != nil {
+		t.Fatalf("Compile of disassembled source failed: %s\n%s", err, src)
+	}
+	if !bytes.Equal(program, again) {
+		t.Errorf("disassembled source compiles to %x, expected %x\n%s", again, program, src)
+	}
+
+	// every data type of the tables survives disassembling
+	src = `endpoint a(1 : uint64) { read; }
+endpoint b(1 : int16) { read; }
+endpoint c(1 : double) { read; }
+endpoint d(1 : int8) { read; }
+endpoint w1(1 : datetime) { write; }
+endpoint w2(2 : int64) { write; }
+endpoint w3(3 : timestamp) { write; }
+endpoint w4(4 : uint16) { write; }
+endpoint w5(5 : uint32) { write; }
+endpoint w6(6 : float) { write; }
+device local(::1) { a, b, c, d, w1, w2, w3, w4, w5, w6 }
+machine m on local {
+	state s {
+		if (local.a == 18446744073709551615) { local.w1 := "2024-02-29 13:04:05"; goto s; }
+		if (local.b == -300) { local.w2 := -9000000000; goto s; }
+		if (local.c < 0.1) { local.w3 := 77; goto s; }
+		if (local.d != -3) { local.w4 := 400; goto s; }
+		if (year < 2030) { local.w5 := 70000; goto s; }
+		if (weekday >= 6) { local.w6 := -1.5; goto s; }
+	}
+}`
+	program, err = Compile(src, nil, nil)
+	if err != nil {
+		t.Fatalf("Compile failed: %s", err)
+	}
+	src, err = Disassemble(program)
+	if err != nil {
+		t.Fatalf("Disassemble failed: %s", err)
+	}
+	again, err = Compile(src, nil, nil)
+	if err != nil || !bytes.Equal(program, again) {
+		t.Errorf("disassembled source compiles to %x, %v\n%s", again, err, src)
+	}
+}
+
+// the tables of example, assembled by hand from the structs of the firmware
+func Test_Tables(t *testing.T) {
+	program, err := Compile(example, local_eids, remote_eids)
+	if err != nil {
+		t.Fatalf("Compile failed: %s", err)
+	}
+	expected := []byte{
+		3, // conditions
+
+		// sensor.button == true
+		0xfd, 0x00, 0, 0, 0, 0, 0, 0, 0, 0x50, 0xc4, 0xff, 0xfe, 0x04, 0x00, 0x01,
+		4, 0, 0, 0, // eid
+		OP_EQ,
+		hexabus.DTYPE_BOOL, 1, 0, 0, 0, 0, 0, 0, 0,
+
+		// plug.temperature > 25.5
+		0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1,
+		2, 0, 0, 0,
+		OP_GT,
+		hexabus.DTYPE_FLOAT, 0x00, 0x00, 0xcc, 0x41, 0, 0, 0, 0,
+
+		// hour >= 23
+		0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+		0, 0, 0, 0,
+		TIME_HOUR | DATETIME_GEQ,
+		hexabus.DTYPE_DATETIME, 23, 0, 0, 0, 0, 0, 0, 0,
+
+		3, // transitions: from, cond, eid, goto, else, value
+		0, 0, 1, 0, 0, 0, 1, 0, hexabus.DTYPE_BOOL, 1, 0, 0, 0, 0, 0, 0, 0,
+		0, 1, 0, 0, 0, 0, 1, 0, hexabus.DTYPE_UNDEFINED, 0, 0, 0, 0, 0, 0, 0, 0,
+		1, 0, 1, 0, 0, 0, 0, 0, hexabus.DTYPE_BOOL, 0, 0, 0, 0, 0, 0, 0, 0,
+
+		1, // datetime transitions
+		1, 2, 1, 0, 0, 0, 0, 1, hexabus.DTYPE_BOOL, 0, 0, 0, 0, 0, 0, 0, 0,
+	}
+	if !bytes.Equal(program, expected) {
+		t.Errorf("tables\n%x\nexpected\n%x", program, expected)
+	}
+	if len(expected) != 3+3*SM_CONDITION_SIZE+4*SM_TRANSITION_SIZE {
+		t.Errorf("struct sizes don't add up to %d bytes", len(expected))
+	}
+
+	// always doesn't use a condition
+	program, err = Compile(`endpoint e(1 : uint16) { write; }
+device d(fd00::1) { e }
+machine m on d { state a { always { d.e := 0x1234; goto b; } } state b { } }`, nil, nil)
+	expected = []byte{0, 1, 0, TRUE_COND_INDEX, 1, 0, 0, 0, 1, 0, hexabus.DTYPE_UINT16, 0x34, 0x12, 0, 0, 0, 0, 0, 0, 0}
+	if err != nil || !bytes.Equal(program, expected) {
+		t.Errorf("always compiles to %x, %v, expected %x", program, err, expected)
+	}
+}
+
+// declarations of the Validate and parse error tests, the source following
+// them starts on line 7
+const declarations = `endpoint relay(1 : bool) { read; write; }
+endpoint temperature(2 : float) { read; }
+endpoint level(3 : uint8) { write; }
+endpoint other(9 : uint32) { read; write; }
+device plug(fd00::50:c4ff:fe04:8390) { relay, temperature, level, other }
+device sensor(fd00::50:c4ff:fe04:1) { relay, other }
+`
+
+func Test_Validate(t *testing.T) {
+	tests := []struct {
+		block string
+		msg   string
+	}{
+		{"if (plug.other == 1) { goto a; }", "eid 9 does not exist on local"},
+		{"if (sensor.other == 1) { goto a; }", "eid 9 does not exist on [fd00::50:c4ff:fe04:1]"},
+		{"always { plug.other := 1; goto a; }", "eid 9 does not exist"},
+		{"if (sensor.relay == true) { goto a; }", "eid 1 does not exist on [fd00::50:c4ff:fe04:1]"},
+	}
+	for _, test := range tests {
+		_, err := Compile(declarations+"machine m on plug {\nstate a { "+test.block+" } }", local_eids, remote_eids)
+		var e *Error
+		if !errors.As(err, &e) || e.Line != 8 || !strings.HasPrefix(e.Msg, test.msg) {
+			t.Errorf("%q returned %v, expected %q on line 8", test.block, err, test.msg)
+		}
+	}
+
+	// the device's endpoint list decides over the declared access
+	_, err := Compile(declarations+"machine m on plug { state a { always { plug.temperature := 1; goto a; } } }", local_eids, remote_eids)
+	if err == nil || !strings.Contains(err.Error(), "plug.temperature is read only") {
+		t.Errorf("write of read only endpoint returned %v", err)
+	}
+	local := []hexabus.EID{{Eid: 3, Dtype: hexabus.DTYPE_UINT8}}
+	_, err = Compile(declarations+"machine m on plug { state a { always { plug.level := 1; goto a; } } }", local, nil)
+	if err == nil || !strings.Contains(err.Error(), "eid 3 is read only") {
+		t.Errorf("write of an endpoint the device reports read only returned %v", err)
+	}
+
+	// unknown devices are not checked
+	if _, err := Compile(declarations+"device other(fd00::2) { other }\nmachine m on plug { state a { if (other.other == 1) { goto a; } } }", local_eids, remote_eids); err != nil {
+		t.Errorf("condition on unknown device returned %s", err)
+	}
+}
+
+func Test_ParseErrors(t *testing.T) {
+	tests := []struct {
+		src  string
+		line int
+		msg  string
+	}{
+		{"", 0, "no machine declared"},
+		{"machine m on plug { }", 7, "machine without states"},
+		{"machine m on x { }", 7, "unknown device x"},
+		{"machine m on plug { state a { } state a { } }", 7, "state a declared twice"},
+		{"machine m on plug { state a { always { goto b; } } }", 7, "unknown state b"},
+		{"machine m on plug {\n state a {\n always { goto a; }\n }\n}\nmachine n on plug { }", 12, "only one machine"},
+		{"machine m on plug { state a { if (x.relay == 1) { goto a; } } }", 7, "unknown device x"},
+		{"machine m on plug { state a { if (plug.x == 1) { goto a; } } }", 7, "unknown endpoint x"},
+		{"machine m on plug { state a { if (sensor.level == 1) { goto a; } } }", 7, "device sensor has no endpoint level"},
+		{"machine m on plug { state a { if (plug.relay == \"x) { goto a; } } }", 7, "unterminated string"},
+		{"machine m on plug { state a { if (plug.relay =< 1) { goto a; } } }", 7, "unexpected '='"},
+		{"machine m on plug { state a { if (plug.relay < true) { goto a; } } }", 7, "< on Bool endpoint"},
+		{"machine m on plug { state a { if (plug.level == 300) { goto a; } } }", 7, "invalid UInt8 value 300"},
+		{"machine m on plug { state a { if (hour >= 24) { goto a; } } }", 7, "invalid hour 24"},
+		{"machine m on plug { state a { if (day >= 0) { goto a; } } }", 7, "invalid day 0"},
+		{"machine m on plug { state a { if (hour == 12) { goto a; } } }", 7, "time fields can only be compared with < and >="},
+		{"machine m on plug { state a { if (week >= 1) { goto a; } } }", 7, "unknown device week"},
+		{"machine m on plug { state a { always { sensor.relay := true; goto a; } } }", 7, "sensor.relay is not an endpoint of the machine's device"},
+		{"machine m on plug { state a { always { plug.relay := true; } } }", 7, "expected goto instead of }"},
+		{"machine m on plug { state a { always { goto a else; } } }", 7, "expected state name instead of ;"},
+		{"machine m on plug {\n/* unterminated", 8, "unterminated comment"},
+		{"device d(10.0.0.1) { }", 7, "invalid IPv6 address 10.0.0.1"},
+		{"device d(::) { }", 7, "invalid IPv6 address ::"},
+		{"device hour(fd00::1) { }", 7, "device name hour is a time field"},
+		{"device plug(fd00::1) { }", 7, "device plug declared twice"},
+		{"endpoint e(1 : string) { read; }", 7, "String values don't fit"},
+		{"endpoint e(1 : int) { read; }", 7, "unknown data type int"},
+		{"endpoint e(1 : bool) { execute; }", 7, "unknown access execute"},
+		{"endpoint relay(5 : bool) { }", 7, "endpoint relay declared twice"},
+		{"while", 7, "unexpected while"},
+		{"machine m on plug { state a { always { goto a; } } } @", 7, "unexpected '@'"},
+	}
+	for _, test := range tests {
+		src := test.src
+		if src != "" {
+			src = declarations + src
+		}
+		_, err := Parse(src)
+		var e *Error
+		if !errors.As(err, &e) || e.Line != test.line || !strings.HasPrefix(e.Msg, test.msg) {
+			t.Errorf("%q returned %v, expected %q on line %d", test.src, err, test.msg, test.line)
+		}
+	}
+}
+
+func Test_UnmarshalBinary(t *testing.T) {
+	program, err := Compile(example, local_eids, remote_eids)
+	if err != nil {
+		t.Fatalf("Compile failed: %s", err)
+	}
+	m := &Machine{}
+	for i := 0; i < len(program); i++ {
+		if err := m.UnmarshalBinary(program[:i]); err != hexabus.Error(hexabus.ERR_PKTLENGTH) {
+			t.Errorf("%d of %d bytes returned %v", i, len(program), err)
+		}
+	}
+	if err := m.UnmarshalBinary(append(program, 0)); err == nil {
+		t.Errorf("trailing byte was accepted")
+	}
+
+	// condition index of the datetime transition
+	bad := append([]byte{}, program...)
+	i := len(bad) - SM_TRANSITION_SIZE + 1
+	bad[i] = 3
+	if err := m.UnmarshalBinary(bad); err == nil || !strings.Contains(err.Error(), "unknown condition 3") {
+		t.Errorf("condition 3 of 3 returned %v", err)
+	}
+	bad[i] = 0
+	if err := m.UnmarshalBinary(bad); err == nil || !strings.Contains(err.Error(), "wrong table") {
+		t.Errorf("endpoint condition in the datetime table returned %v", err)
+	}
+}
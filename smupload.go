@@ -0,0 +1,149 @@
+package hexabus
+
+import (
+	"context"
+	"strconv"
+)
+
+// Endpoints and values of the state machine upload, the EID's are the ones
+// of the firmware's endpoint registry shared/endpoints.h.
+const (
+	// UInt8, STM_STATE_* of the state machine, stopped during the upload
+	EP_SM_CONTROL = 9
+
+	// 66Bytes, receives the chunks of the state machine program
+	EP_SM_UP_RECEIVER = 10
+
+	// Bool, the device answers every chunk with an Info Packet on this EID,
+	// true if the chunk was stored
+	EP_SM_UP_ACKNAK = 11
+
+	// state machine halted
+	STM_STATE_STOPPED = 0
+
+	// state machine running
+	STM_STATE_RUNNING = 1
+)
+
+// Defaults used by the SMUploader.
+const (
+	// program bytes per chunk, the first of the 65 payload bytes is the
+	// chunk number
+	SM_CHUNK_SIZE = BYTES66_PACKET_MAX_BUFFER_LENGTH_ - 1
+
+	// chunks addressable by the one byte chunk number
+	SM_MAX_CHUNKS = 256
+
+	// retransmissions of a chunk the device rejected or didn't answer
+	SM_UPLOAD_RETRIES = 3
+)
+
+// ChunkError is the failure of a single chunk of a state machine upload.
+type ChunkError struct {
+	Chunk int
+	Err   error
+}
+
+func (e *ChunkError) Error() string {
+	return "chunk " + strconv.Itoa(e.Chunk) + ": " + e.Err.Error()
+}
+
+func (e *ChunkError) Unwrap() error {
+	return e.Err
+}
+
+// SMUploader uploads compiled state machine programs to Hexabus devices.
+// The program is split into chunks of SM_CHUNK_SIZE bytes, the last one is
+// padded with zeros. Every chunk is written to EP_SM_UP_RECEIVER as 66Bytes
+// payload starting with the chunk number and has to be acknowledged by the
+// device on EP_SM_UP_ACKNAK before the next one is sent.
+type SMUploader struct {
+	// client used for the upload, DefaultClient if nil
+	Client *Client
+
+	// retransmissions of a chunk, SM_UPLOAD_RETRIES if zero, negative for
+	// none
+	Retries int
+
+	// called after every acknowledged chunk
+	Progress func(done, total int)
+}
+
+// Upload stops the state machine of the device at address, transfers
+// program and starts the state machine again. If a chunk is rejected after
+// all retries a *ChunkError wrapping Error(ERR_NAK) is returned and the
+// state machine stays stopped, as it holds an incomplete program.
+func (u *SMUploader) Upload(ctx context.Context, address string, program []byte) error {
+	c := u.Client
+	if c == nil {
+		c = DefaultClient
+	}
+	retries := u.Retries
+	if retries == 0 {
+		retries = SM_UPLOAD_RETRIES
+	} else if retries < 0 {
+		retries = 0
+	}
+
+	total := (len(program) + SM_CHUNK_SIZE - 1) / SM_CHUNK_SIZE
+	if total == 0 || total > SM_MAX_CHUNKS {
+		return Error(ERR_VALUERANGE)
+	}
+
+	err := c.write(ctx, address, WritePacket{FLAG_NONE, EP_SM_CONTROL, DTYPE_UINT8, uint8(STM_STATE_STOPPED)}, EP_SM_CONTROL)
+	if err != nil {
+		return err
+	}
+	for i := 0; i < total; i++ {
+		chunk := make([]byte, SM_CHUNK_SIZE+1)
+		chunk[0] = byte(i)
+		copy(chunk[1:], program[i*SM_CHUNK_SIZE:])
+		err = u.sendChunk(ctx, c, address, chunk, retries)
+		if err != nil {
+			return &ChunkError{i, err}
+		}
+		if u.Progress != nil {
+			u.Progress(i+1, total)
+		}
+	}
+	return c.write(ctx, address, WritePacket{FLAG_NONE, EP_SM_CONTROL, DTYPE_UINT8, uint8(STM_STATE_RUNNING)}, EP_SM_CONTROL)
+}
+
+// write a chunk until the device acknowledges it
+func (u *SMUploader) sendChunk(ctx context.Context, c *Client, address string, chunk []byte, retries int) error {
+	p := WritePacket{FLAG_NONE, EP_SM_UP_RECEIVER, DTYPE_66BYTES, chunk}
+	var err error
+	for try := 0; try <= retries; try++ {
+		var resp response
+		resp, err = c.exchange(ctx, address, p, EP_SM_UP_ACKNAK, PTYPE_INFO, PTYPE_ERROR)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil {
+			continue
+		}
+		switch r := resp.p.(type) {
+		case *ErrorPacket:
+			// the device can't take chunks at all
+			return remoteError(address, p, EP_SM_UP_RECEIVER, r)
+		case *InfoPacket:
+			if ack, ok := r.Data.(bool); ok && ack {
+				return nil
+			}
+			err = &RemoteError{address, EP_SM_UP_RECEIVER, PTYPE_WRITE, Error(ERR_NAK)}
+		}
+	}
+	return err
+}
+
+// UploadStateMachine uploads a compiled state machine program to the device
+// at address using the DefaultClient, see SMUploader.
+func UploadStateMachine(address string, program []byte) error {
+	return UploadStateMachineContext(context.Background(), address, program)
+}
+
+// UploadStateMachineContext is like UploadStateMachine but aborts when ctx
+// is done.
+func UploadStateMachineContext(ctx context.Context, address string, program []byte) error {
+	return (&SMUploader{}).Upload(ctx, address, program)
+}
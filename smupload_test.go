@@ -0,0 +1,136 @@
+package hexabus
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fake device receiving a state machine upload, rejects the first attempt of
+// every chunk in nak, ignores the first attempt of every chunk in lost and
+// rejects chunks while the state machine runs
+type sm_device struct {
+	mu      sync.Mutex
+	program []byte
+	state   []uint8
+	tries   map[byte]int
+	nak     map[byte]bool
+	lost    map[byte]bool
+}
+
+func (d *sm_device) serve(t *testing.T) (string, func()) {
+	conn, err := net.ListenUDP("udp6", &net.UDPAddr{IP: net.IPv6loopback})
+	if err != nil {
+		t.Skipf("no udp6 loopback: %s", err)
+	}
+	d.tries = make(map[byte]int)
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, raddr, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			p, err := Decode(buf[:n])
+			if err != nil {
+				continue
+			}
+			w, ok := p.(*WritePacket)
+			if !ok {
+				continue
+			}
+			d.mu.Lock()
+			var reply Packet
+			// EID's as in the firmware's shared/endpoints.h
+			switch w.Eid {
+			case 9:
+				d.state = append(d.state, w.Data.(uint8))
+			case 10:
+				chunk := w.Data.([]byte)
+				d.tries[chunk[0]]++
+				first := d.tries[chunk[0]] == 1
+				running := len(d.state) > 0 && d.state[len(d.state)-1] == STM_STATE_RUNNING
+				if first && d.lost[chunk[0]] {
+					break
+				}
+				ack := !running && !(first && d.nak[chunk[0]])
+				if ack {
+					offset := int(chunk[0]) * SM_CHUNK_SIZE
+					for len(d.program) < offset+SM_CHUNK_SIZE {
+						d.program = append(d.program, 0)
+					}
+					copy(d.program[offset:], chunk[1:])
+				}
+				reply = InfoPacket{FLAG_NONE, 11, DTYPE_BOOL, ack}
+			}
+			d.mu.Unlock()
+			if reply != nil {
+				packet, _ := reply.Bytes()
+				conn.WriteToUDP(packet, raddr)
+			}
+		}
+	}()
+	return conn.LocalAddr().String(), func() { conn.Close() }
+}
+
+func Test_SMUpload(t *testing.T) {
+	d := &sm_device{nak: map[byte]bool{1: true}, lost: map[byte]bool{2: true}}
+	address, stop := d.serve(t)
+	defer stop()
+
+	c := &Client{Timeout: 100 * time.Millisecond}
+	defer c.Close()
+
+	program := make([]byte, 3*SM_CHUNK_SIZE+10)
+	for i := range program {
+		program[i] = byte(i * 7)
+	}
+	progress := []int{}
+	u := &SMUploader{Client: c, Progress: func(done, total int) {
+		if total != 4 {
+			t.Errorf("upload of %d bytes reported %d chunks", len(program), total)
+		}
+		progress = append(progress, done)
+	}}
+	err := u.Upload(context.Background(), address, program)
+	if err != nil {
+		t.Fatalf("Upload failed: %s", err)
+	}
+
+	d.mu.Lock()
+	if !bytes.Equal(d.program[:len(program)], program) || len(d.program) != 4*SM_CHUNK_SIZE {
+		t.Errorf("device received %x", d.program)
+	}
+	if len(d.state) != 2 || d.state[0] != STM_STATE_STOPPED || d.state[1] != STM_STATE_RUNNING {
+		t.Errorf("state machine went through %v, expected stop and start", d.state)
+	}
+	if d.tries[0] != 1 || d.tries[1] != 2 || d.tries[2] != 2 {
+		t.Errorf("chunks were sent %v times", d.tries)
+	}
+	d.mu.Unlock()
+	if len(progress) != 4 || progress[3] != 4 {
+		t.Errorf("Progress was called with %v", progress)
+	}
+
+	// every chunk is rejected while the state machine runs
+	d.mu.Lock()
+	d.state = append(d.state, STM_STATE_RUNNING)
+	d.mu.Unlock()
+	u = &SMUploader{Client: c, Retries: -1}
+	err = u.sendChunk(context.Background(), c, address, make([]byte, SM_CHUNK_SIZE+1), 0)
+	var remoteErr *RemoteError
+	if !errors.Is(err, Error(ERR_NAK)) || !errors.As(err, &remoteErr) || remoteErr.Eid != EP_SM_UP_RECEIVER {
+		t.Errorf("rejected chunk returned %v", err)
+	}
+
+	if err := u.Upload(context.Background(), address, nil); err != Error(ERR_VALUERANGE) {
+		t.Errorf("Upload of empty program returned %v", err)
+	}
+	if err := u.Upload(context.Background(), address, make([]byte, SM_MAX_CHUNKS*SM_CHUNK_SIZE+1)); err != Error(ERR_VALUERANGE) {
+		t.Errorf("Upload of oversized program returned %v", err)
+	}
+}
@@ -3,25 +3,74 @@ package hexabus
 import (
 	"bytes"
 	"encoding/binary"
+	"fmt"
+	"math"
+	"time"
 )
 
-// struct to hold DTYPE_TIMESTAMP
+// layout of DateTime.String for time.Format and time.Parse
+const DATETIME_LAYOUT = "2006-01-02 15:04:05"
+
+// struct to hold DTYPE_TIMESTAMP, the seconds since the device booted
 type Timestamp struct {
 	TotalSeconds uint32
 }
 
+// NewTimestamp returns d as Timestamp, fractions of a second are truncated.
+// Durations that are negative or exceed the 32 bit seconds return
+// Error(ERR_VALUERANGE).
+func NewTimestamp(d time.Duration) (Timestamp, error) {
+	s := d / time.Second
+	if s < 0 || s > math.MaxUint32 {
+		return Timestamp{}, Error(ERR_VALUERANGE)
+	}
+	return Timestamp{uint32(s)}, nil
+}
+
+// TimestampSince returns the time elapsed since boot as Timestamp, the uptime
+// of a device that booted at boot.
+func TimestampSince(boot time.Time) (Timestamp, error) {
+	return NewTimestamp(time.Since(boot))
+}
+
+// Duration returns the timestamp as time.Duration.
+func (t Timestamp) Duration() time.Duration {
+	return time.Duration(t.TotalSeconds) * time.Second
+}
+
+// Time returns the point in time of the timestamp for a device that booted
+// at boot.
+func (t Timestamp) Time(boot time.Time) time.Time {
+	return boot.Add(t.Duration())
+}
+
+// String returns the timestamp as duration like 26h3m12s.
+func (t Timestamp) String() string {
+	return t.Duration().String()
+}
+
 // decodes the payload from a timestamp packet into a Timestamp structure
-// takes as argument a Packet.Data interface{}
+// takes as argument a Packet.Data interface{}, the decoded Timestamp or the
+// 4 raw payload bytes
 func (t *Timestamp) Decode(data interface{}) (err error) {
-	buf := bytes.NewBuffer(data.([]byte))
-	err = binary.Read(buf, binary.BigEndian, t)
-	if err != nil {
-		return err
+	switch data := data.(type) {
+	case Timestamp:
+		*t = data
+		return nil
+	case Value:
+		return t.Decode(data.Data)
+	case []byte:
+		if len(data) != dtype_sizes[DTYPE_TIMESTAMP] {
+			return Error(ERR_PKTLENGTH)
+		}
+		buf := bytes.NewBuffer(data)
+		return binary.Read(buf, binary.BigEndian, t)
 	}
-	return nil
+	return Error(HXB_ERR_DATATYPE)
 }
 
-// struct to hold DTYPE_DATETIME
+// struct to hold DTYPE_DATETIME, a wall clock time without zone, DayOfWeek
+// counts from Sunday = 0 like time.Weekday
 type DateTime struct {
 	Hours     uint8
 	Minutes   uint8
@@ -32,13 +81,79 @@ type DateTime struct {
 	DayOfWeek uint8
 }
 
+// DateTimeFromTime returns the wall clock time of t in its location as
+// DateTime, the day of the week is computed from the date.
+func DateTimeFromTime(t time.Time) (DateTime, error) {
+	if t.Year() < 0 || t.Year() > math.MaxUint16 {
+		return DateTime{}, Error(ERR_VALUERANGE)
+	}
+	return DateTime{
+		Hours:     uint8(t.Hour()),
+		Minutes:   uint8(t.Minute()),
+		Seconds:   uint8(t.Second()),
+		Day:       uint8(t.Day()),
+		Month:     uint8(t.Month()),
+		Year:      uint16(t.Year()),
+		DayOfWeek: uint8(t.Weekday()),
+	}, nil
+}
+
+// Check validates the fields of d, a field out of its range like month 13,
+// February 30 or a day of the week that doesn't fit the date returns
+// Error(ERR_VALUERANGE).
+func (d DateTime) Check() error {
+	if d.Hours > 23 || d.Minutes > 59 || d.Seconds > 59 || d.Month < 1 || d.Month > 12 || d.Day < 1 {
+		return Error(ERR_VALUERANGE)
+	}
+	t := d.time(time.UTC)
+	if t.Day() != int(d.Day) || t.Weekday() != time.Weekday(d.DayOfWeek) {
+		return Error(ERR_VALUERANGE)
+	}
+	return nil
+}
+
+// Time returns d as time.Time in loc.
+func (d DateTime) Time(loc *time.Location) (time.Time, error) {
+	err := d.Check()
+	if err != nil {
+		return time.Time{}, err
+	}
+	return d.time(loc), nil
+}
+
+// fields of d as time.Time, out of range fields are normalized
+func (d DateTime) time(loc *time.Location) time.Time {
+	return time.Date(int(d.Year), time.Month(d.Month), int(d.Day), int(d.Hours), int(d.Minutes), int(d.Seconds), 0, loc)
+}
+
+// String returns the date and time in DATETIME_LAYOUT.
+func (d DateTime) String() string {
+	return fmt.Sprintf("%04d-%02d-%02d %02d:%02d:%02d", d.Year, d.Month, d.Day, d.Hours, d.Minutes, d.Seconds)
+}
+
 // decodes the payload from a datetime packet into a DateTime structure
-// takes as argument a Packet.Data interface{}
+// takes as argument a Packet.Data interface{}, the decoded DateTime or the
+// 8 raw payload bytes. The fields are taken as the device sent them, Time
+// checks them.
 func (d *DateTime) Decode(data interface{}) (err error) {
-	buf := bytes.NewBuffer(data.([]byte))
-	err = binary.Read(buf, binary.BigEndian, d)
-	if err != nil {
-		return err
+	switch data := data.(type) {
+	case DateTime:
+		*d = data
+		return nil
+	case Value:
+		return d.Decode(data.Data)
+	case []byte:
+		if len(data) != dtype_sizes[DTYPE_DATETIME] {
+			return Error(ERR_PKTLENGTH)
+		}
+		var v DateTime
+		buf := bytes.NewBuffer(data)
+		err = binary.Read(buf, binary.BigEndian, &v)
+		if err != nil {
+			return err
+		}
+		*d = v
+		return nil
 	}
-	return nil
+	return Error(HXB_ERR_DATATYPE)
 }
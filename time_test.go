@@ -0,0 +1,98 @@
+package hexabus
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_DateTime(t *testing.T) {
+	loc := time.FixedZone("CET", 3600)
+	tm := time.Date(2014, time.March, 6, 17, 2, 15, 0, loc)
+
+	d, err := DateTimeFromTime(tm)
+	if err != nil || d != (DateTime{17, 2, 15, 6, 3, 2014, 4}) {
+		t.Errorf("DateTimeFromTime returned %+v, %v", d, err)
+	}
+	if d.String() != "2014-03-06 17:02:15" {
+		t.Errorf("String of DateTime returned %q", d.String())
+	}
+	back, err := d.Time(loc)
+	if err != nil || !back.Equal(tm) {
+		t.Errorf("Time of DateTime returned %s, %v", back, err)
+	}
+
+	invalid := []DateTime{
+		{},
+		{24, 0, 0, 6, 3, 2014, 4},
+		{17, 60, 0, 6, 3, 2014, 4},
+		{17, 2, 15, 6, 13, 2014, 4},
+		{17, 2, 15, 30, 2, 2014, 0},
+		{17, 2, 15, 6, 3, 2014, 5},
+	}
+	for _, d := range invalid {
+		if _, err := d.Time(time.UTC); err != Error(ERR_VALUERANGE) {
+			t.Errorf("Time of invalid DateTime %+v returned %v", d, err)
+		}
+		if _, err := (InfoPacket{FLAG_NONE, 1, DTYPE_UNDEFINED, d}).Bytes(); err != Error(ERR_VALUERANGE) {
+			t.Errorf("encoding invalid DateTime %+v returned %v", d, err)
+		}
+	}
+
+	// the decoded DateTime can be passed to Decode as well as the raw payload
+	packet, _ := InfoPacket{FLAG_NONE, 1, DTYPE_DATETIME, tm}.Bytes()
+	p, err := Decode(packet)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	var v DateTime
+	if err := v.Decode(p.(*InfoPacket).Data); err != nil || v != d {
+		t.Errorf("Decode of DateTime returned %+v, %v", v, err)
+	}
+	if err := v.Decode(packet[11:19]); err != nil || v != d {
+		t.Errorf("Decode of DateTime payload returned %+v, %v", v, err)
+	}
+	if err := v.Decode(uint32(1)); err != Error(HXB_ERR_DATATYPE) {
+		t.Errorf("Decode of uint32 as DateTime returned %v", err)
+	}
+
+	// a device with a wrong day of the week still sends a decodable packet
+	packet[18] = (packet[18] + 1) % 7
+	p, err = Decode(addCRC(packet[:len(packet)-2]))
+	if err != nil {
+		t.Fatalf("Decode of wrong day of the week returned %s", err)
+	}
+	v = p.(*InfoPacket).Data.(DateTime)
+	if _, err := v.Time(time.UTC); v.DayOfWeek != packet[18] || err != Error(ERR_VALUERANGE) {
+		t.Errorf("wrong day of the week decoded as %+v, Time returned %v", v, err)
+	}
+}
+
+func Test_Timestamp(t *testing.T) {
+	ts, err := NewTimestamp(26*time.Hour + 3*time.Minute + 12*time.Second + time.Millisecond)
+	if err != nil || ts != (Timestamp{93792}) {
+		t.Errorf("NewTimestamp returned %+v, %v", ts, err)
+	}
+	if ts.String() != "26h3m12s" || ts.Duration() != 93792*time.Second {
+		t.Errorf("Timestamp %d returned %q, %s", ts.TotalSeconds, ts.String(), ts.Duration())
+	}
+	boot := time.Date(2014, time.March, 6, 0, 0, 0, 0, time.UTC)
+	if !ts.Time(boot).Equal(boot.Add(93792 * time.Second)) {
+		t.Errorf("Time of Timestamp returned %s", ts.Time(boot))
+	}
+	up, err := TimestampSince(time.Now().Add(-time.Minute))
+	if err != nil || up.TotalSeconds < 59 || up.TotalSeconds > 61 {
+		t.Errorf("TimestampSince returned %+v, %v", up, err)
+	}
+	if _, err := NewTimestamp(-time.Second); err != Error(ERR_VALUERANGE) {
+		t.Errorf("NewTimestamp of negative duration returned %v", err)
+	}
+
+	v, err := ParseValue(DTYPE_TIMESTAMP, "1h30m")
+	if err != nil || v != (Value{DTYPE_TIMESTAMP, Timestamp{5400}}) {
+		t.Errorf("ParseValue of duration returned %#v, %v", v, err)
+	}
+	var decoded Timestamp
+	if err := decoded.Decode(v); err != nil || decoded != (Timestamp{5400}) {
+		t.Errorf("Decode of Timestamp Value returned %+v, %v", decoded, err)
+	}
+}
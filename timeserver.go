@@ -0,0 +1,92 @@
+package hexabus
+
+import (
+	"context"
+	"time"
+)
+
+// Defaults used by the TimeServer.
+const (
+	// time between two broadcasts of the date and time
+	TIMESERVER_INTERVAL = 60 * time.Second
+)
+
+// TimeServer periodically broadcasts the current date and time as
+// DTYPE_DATETIME Info Packet to the multicast group. Hexabus devices without
+// a real time clock take the time for their state machines from it.
+type TimeServer struct {
+	// EID the time is broadcast on, multiples of 32 are descriptors
+	Eid uint32
+
+	// outgoing interface for the multicast group, system default if empty
+	Interface string
+
+	// local address to bind to, any address if empty
+	LocalAddr string
+
+	// destination of the broadcasts, MULTICAST_GROUP if empty
+	Address string
+
+	// time between two broadcasts, TIMESERVER_INTERVAL if zero
+	Interval time.Duration
+
+	// time zone of the broadcast time, time.Local if nil
+	Location *time.Location
+
+	// called with every failed broadcast, usually an *OpError
+	Failed func(error)
+}
+
+// Run broadcasts the time right away and then every interval until ctx is
+// done, which is returned as ctx.Err(). A failed broadcast, like while the
+// network is down, doesn't stop the server, it is passed to Failed.
+func (s *TimeServer) Run(ctx context.Context) error {
+	if s.Eid%32 == 0 {
+		return descriptorEidError(s.Eid)
+	}
+	interval := s.Interval
+	if interval <= 0 {
+		interval = TIMESERVER_INTERVAL
+	}
+
+	c := &Client{Interface: s.Interface, LocalAddr: s.LocalAddr}
+	defer c.Close()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		err := s.broadcast(c)
+		if err != nil && ctx.Err() == nil && s.Failed != nil {
+			s.Failed(err)
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Broadcast sends the current time once.
+func (s *TimeServer) Broadcast() error {
+	c := &Client{Interface: s.Interface, LocalAddr: s.LocalAddr}
+	defer c.Close()
+	return s.broadcast(c)
+}
+
+// send the current time with c
+func (s *TimeServer) broadcast(c *Client) error {
+	loc := s.Location
+	if loc == nil {
+		loc = time.Local
+	}
+	address := s.Address
+	if address == "" {
+		address = MULTICAST_GROUP
+	}
+	now, err := DateTimeFromTime(time.Now().In(loc))
+	if err != nil {
+		return err
+	}
+	return c.Send(address, InfoPacket{FLAG_NONE, s.Eid, DTYPE_DATETIME, now})
+}
@@ -0,0 +1,75 @@
+package hexabus
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func Test_TimeServer(t *testing.T) {
+	conn, err := net.ListenUDP("udp6", &net.UDPAddr{IP: net.IPv6loopback})
+	if err != nil {
+		t.Skipf("no udp6 loopback: %s", err)
+	}
+	l := NewListener(conn)
+	defer l.Close()
+
+	loc := time.FixedZone("UTC+14", 14*3600)
+	s := &TimeServer{Eid: 25, Address: conn.LocalAddr().String(), Interval: 50 * time.Millisecond, Location: loc}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- s.Run(ctx) }()
+
+	timeout := time.After(2 * time.Second)
+	for i := 0; i < 2; i++ {
+		select {
+		case ev := <-l.Events():
+			p, ok := ev.Packet.(*InfoPacket)
+			if !ok || p.Eid != 25 || p.Dtype != DTYPE_DATETIME {
+				t.Fatalf("received %+v, %v, expected DateTime Info Packet", ev.Packet, ev.Err)
+			}
+			d := p.Data.(DateTime)
+			sent, err := d.Time(loc)
+			if err != nil {
+				t.Fatalf("received invalid DateTime %+v: %s", d, err)
+			}
+			if diff := time.Since(sent); diff < -time.Second || diff > 2*time.Second {
+				t.Errorf("received %s, %s off", d, diff)
+			}
+		case <-timeout:
+			t.Fatalf("no broadcast received")
+		}
+	}
+
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Errorf("Run returned %v after cancel", err)
+	}
+
+	if err := (&TimeServer{Eid: 32}).Run(context.Background()); err == nil || err.Error() != "eid 32 is reserved for a descriptor" {
+		t.Errorf("Run on descriptor EID returned %v", err)
+	}
+
+	// failed broadcasts are reported and the server keeps running
+	failed := make(chan error, 10)
+	s = &TimeServer{Eid: 25, Address: "192.0.2.1", Interval: 20 * time.Millisecond, Failed: func(err error) { failed <- err }}
+	ctx, cancel = context.WithCancel(context.Background())
+	go func() { done <- s.Run(ctx) }()
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-failed:
+			if err == nil {
+				t.Errorf("Failed called without error")
+			}
+		case err := <-done:
+			t.Fatalf("Run returned %v after a failed broadcast", err)
+		case <-time.After(2 * time.Second):
+			t.Fatalf("failed broadcast not reported")
+		}
+	}
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Errorf("Run returned %v after cancel", err)
+	}
+}
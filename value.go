@@ -0,0 +1,428 @@
+package hexabus
+
+import (
+	"encoding/hex"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Value is a payload with an explicit hexabus data type. Data always holds
+// the Go type of Dtype:
+//
+//	DTYPE_BOOL       bool
+//	DTYPE_UINT8      uint8
+//	DTYPE_UINT16     uint16
+//	DTYPE_UINT32     uint32
+//	DTYPE_UINT64     uint64
+//	DTYPE_INT8       int8
+//	DTYPE_INT16      int16
+//	DTYPE_INT32      int32
+//	DTYPE_INT64      int64
+//	DTYPE_FLOAT      float32
+//	DTYPE_DOUBLE     float64
+//	DTYPE_DATETIME   DateTime, converted from time.Time
+//	DTYPE_TIMESTAMP  Timestamp, converted from time.Duration
+//	DTYPE_128STRING  string
+//	DTYPE_16BYTES    []byte of length 16
+//	DTYPE_66BYTES    []byte of length 65
+//
+// A Value can be used as Data of every packet and is encoded with its data
+// type, the Value method of the packets returns the received payload as
+// Value.
+type Value struct {
+	Dtype byte
+	Data  interface{}
+}
+
+// size and signedness of the integer data types
+var int_dtypes = map[byte]struct {
+	bits   uint
+	signed bool
+}{
+	DTYPE_UINT8:  {8, false},
+	DTYPE_UINT16: {16, false},
+	DTYPE_UINT32: {32, false},
+	DTYPE_UINT64: {64, false},
+	DTYPE_INT8:   {8, true},
+	DTYPE_INT16:  {16, true},
+	DTYPE_INT32:  {32, true},
+	DTYPE_INT64:  {64, true},
+}
+
+// NewValue converts data to the Go type of dtype. Integers and floats are
+// converted between all numeric data types as long as the value fits,
+// otherwise Error(ERR_VALUERANGE) is returned. Integers converted to a float
+// have to be represented exactly, 16777217 for example isn't as Float. Data
+// that can't be converted returns Error(HXB_ERR_DATATYPE).
+func NewValue(dtype byte, data interface{}) (Value, error) {
+	if v, ok := data.(Value); ok {
+		data = v.Data
+	}
+	if t, ok := data.(Timestamp); ok && dtype != DTYPE_TIMESTAMP {
+		data = t.TotalSeconds
+	}
+
+	if t, ok := int_dtypes[dtype]; ok {
+		u, neg, ok := integer(data)
+		if !ok {
+			return Value{}, Error(HXB_ERR_DATATYPE)
+		}
+		limit := uint64(math.MaxUint64) >> (64 - t.bits)
+		if t.signed {
+			limit >>= 1
+			if neg {
+				limit++
+			}
+		} else if neg {
+			return Value{}, Error(ERR_VALUERANGE)
+		}
+		if u > limit {
+			return Value{}, Error(ERR_VALUERANGE)
+		}
+		i := int64(u)
+		if neg {
+			i = -int64(u-1) - 1
+		}
+		switch dtype {
+		case DTYPE_UINT8:
+			return Value{dtype, uint8(u)}, nil
+		case DTYPE_UINT16:
+			return Value{dtype, uint16(u)}, nil
+		case DTYPE_UINT32:
+			return Value{dtype, uint32(u)}, nil
+		case DTYPE_UINT64:
+			return Value{dtype, u}, nil
+		case DTYPE_INT8:
+			return Value{dtype, int8(i)}, nil
+		case DTYPE_INT16:
+			return Value{dtype, int16(i)}, nil
+		case DTYPE_INT32:
+			return Value{dtype, int32(i)}, nil
+		}
+		return Value{dtype, i}, nil
+	}
+
+	switch dtype {
+	case DTYPE_BOOL:
+		if b, ok := data.(bool); ok {
+			return Value{dtype, b}, nil
+		}
+	case DTYPE_FLOAT, DTYPE_DOUBLE:
+		f, ok := float(data)
+		if !ok {
+			break
+		}
+		if dtype == DTYPE_FLOAT {
+			if math.Abs(f) > math.MaxFloat32 && !math.IsInf(f, 0) {
+				return Value{}, Error(ERR_VALUERANGE)
+			}
+			f = float64(float32(f))
+		}
+		// integers have to convert without rounding
+		if u, neg, ok := integer(data); ok && !exact(u, neg, f) {
+			return Value{}, Error(ERR_VALUERANGE)
+		}
+		if dtype == DTYPE_DOUBLE {
+			return Value{dtype, f}, nil
+		}
+		return Value{dtype, float32(f)}, nil
+	case DTYPE_DATETIME:
+		if t, ok := data.(time.Time); ok {
+			d, err := DateTimeFromTime(t)
+			if err != nil {
+				return Value{}, err
+			}
+			data = d
+		}
+		if d, ok := data.(DateTime); ok {
+			if err := d.Check(); err != nil {
+				return Value{}, err
+			}
+			return Value{dtype, d}, nil
+		}
+	case DTYPE_TIMESTAMP:
+		if t, ok := data.(Timestamp); ok {
+			return Value{dtype, t}, nil
+		}
+		if d, ok := data.(time.Duration); ok {
+			t, err := NewTimestamp(d)
+			if err != nil {
+				return Value{}, err
+			}
+			return Value{dtype, t}, nil
+		}
+		v, err := NewValue(DTYPE_UINT32, data)
+		if err != nil {
+			return Value{}, err
+		}
+		return Value{dtype, Timestamp{v.Data.(uint32)}}, nil
+	case DTYPE_128STRING:
+		if s, ok := data.(string); ok {
+			if len(s) > STRING_PACKET_MAX_BUFFER_LENGTH {
+				return Value{}, Error(ERR_STRBUFF)
+			}
+			return Value{dtype, s}, nil
+		}
+	case DTYPE_16BYTES, DTYPE_66BYTES:
+		if b, ok := data.([]byte); ok {
+			if (dtype == DTYPE_16BYTES && len(b) != 16) || (dtype == DTYPE_66BYTES && len(b) != 65) {
+				return Value{}, Error(ERR_BYTESIZE)
+			}
+			return Value{dtype, b}, nil
+		}
+	default:
+		return Value{}, Error(ERR_HXBDTYPE)
+	}
+	return Value{}, Error(HXB_ERR_DATATYPE)
+}
+
+// ValueOf returns data as Value, the data type is taken from the Go type of
+// data like encData does.
+func ValueOf(data interface{}) (Value, error) {
+	if v, ok := data.(Value); ok {
+		return NewValue(v.Dtype, v.Data)
+	}
+	dtype, err := dtypeOf(data)
+	if err != nil {
+		return Value{}, err
+	}
+	return Value{dtype, data}, nil
+}
+
+// ParseValue converts the text representation of a value, as given on the
+// command line, to dtype. Integers may be given in decimal, hex (0x) or
+// octal (0), bools as 1/true/on or 0/false/off and byte data as hex. A
+// DateTime is given as local time like 2014-03-06 17:02:15 and a Timestamp
+// in seconds or as duration like 26h3m12s.
+func ParseValue(dtype byte, s string) (Value, error) {
+	if dtype == DTYPE_TIMESTAMP && strings.ContainsAny(s, "hms") {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return Value{}, err
+		}
+		return NewValue(dtype, d)
+	}
+	if _, ok := int_dtypes[dtype]; ok || dtype == DTYPE_TIMESTAMP {
+		if strings.HasPrefix(s, "-") {
+			i, err := strconv.ParseInt(s, 0, 64)
+			if err != nil {
+				return Value{}, err
+			}
+			return NewValue(dtype, i)
+		}
+		u, err := strconv.ParseUint(s, 0, 64)
+		if err != nil {
+			return Value{}, err
+		}
+		return NewValue(dtype, u)
+	}
+
+	switch dtype {
+	case DTYPE_BOOL:
+		switch strings.ToLower(s) {
+		case "1", "true", "on":
+			return Value{dtype, true}, nil
+		case "0", "false", "off":
+			return Value{dtype, false}, nil
+		}
+		return Value{}, Error(HXB_ERR_INVALID_VALUE)
+	case DTYPE_FLOAT, DTYPE_DOUBLE:
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return Value{}, err
+		}
+		return NewValue(dtype, f)
+	case DTYPE_DATETIME:
+		t, err := time.ParseInLocation(DATETIME_LAYOUT, s, time.Local)
+		if err != nil {
+			return Value{}, err
+		}
+		return NewValue(dtype, t)
+	case DTYPE_128STRING:
+		return NewValue(dtype, s)
+	case DTYPE_16BYTES, DTYPE_66BYTES:
+		b, err := hex.DecodeString(s)
+		if err != nil {
+			return Value{}, err
+		}
+		return NewValue(dtype, b)
+	}
+	return Value{}, Error(ERR_HXBDTYPE)
+}
+
+// Coerce converts data to dtype like NewValue, strings are parsed with
+// ParseValue unless dtype is DTYPE_128STRING.
+func Coerce(dtype byte, data interface{}) (Value, error) {
+	if s, ok := data.(string); ok && dtype != DTYPE_128STRING {
+		return ParseValue(dtype, s)
+	}
+	return NewValue(dtype, data)
+}
+
+// String returns the value as text, byte data is returned as hex.
+func (v Value) String() string {
+	switch data := v.Data.(type) {
+	case []byte:
+		return hex.EncodeToString(data)
+	case float32:
+		return strconv.FormatFloat(float64(data), 'g', -1, 32)
+	case float64:
+		return strconv.FormatFloat(data, 'g', -1, 64)
+	case string:
+		return data
+	case Timestamp:
+		return strconv.FormatUint(uint64(data.TotalSeconds), 10)
+	}
+	u, neg, ok := integer(v.Data)
+	if ok {
+		s := strconv.FormatUint(u, 10)
+		if neg {
+			s = "-" + s
+		}
+		return s
+	}
+	if b, ok := v.Data.(bool); ok {
+		return strconv.FormatBool(b)
+	}
+	if d, ok := v.Data.(DateTime); ok {
+		return d.String()
+	}
+	return ""
+}
+
+// MarshalBinary returns the data type followed by the payload as it is sent
+// in packets.
+func (v Value) MarshalBinary() ([]byte, error) {
+	packet, err := encTyped(make([]byte, 11), v.Dtype, v.Data)
+	if err != nil {
+		return nil, err
+	}
+	return packet[10:], nil
+}
+
+// UnmarshalBinary decodes the data type and payload written by
+// MarshalBinary, b has to hold exactly one value.
+func (v *Value) UnmarshalBinary(b []byte) error {
+	if len(b) == 0 {
+		return Error(ERR_PKTLENGTH)
+	}
+	size, ok := dtype_sizes[b[0]]
+	if !ok {
+		return Error(ERR_HXBDTYPE)
+	}
+	if len(b) != size+1 {
+		return Error(ERR_PKTLENGTH)
+	}
+	data, err := decData(b[1:], b[0])
+	if err != nil {
+		return err
+	}
+	v.Dtype, v.Data = b[0], data
+	return nil
+}
+
+// payload of a packet as Value
+func packetValue(dtype byte, data interface{}) Value {
+	if dtype != DTYPE_UNDEFINED {
+		if v, err := NewValue(dtype, data); err == nil {
+			return v
+		}
+	}
+	if v, err := ValueOf(data); err == nil {
+		return v
+	}
+	return Value{dtype, data}
+}
+
+// Value returns the payload as Value.
+func (p InfoPacket) Value() Value { return packetValue(p.Dtype, p.Data) }
+
+// Value returns the payload as Value.
+func (p WritePacket) Value() Value { return packetValue(p.Dtype, p.Data) }
+
+// Value returns the payload as Value.
+func (p ReportPacket) Value() Value { return packetValue(p.Dtype, p.Data) }
+
+// Value returns the payload as Value.
+func (p PInfoPacket) Value() Value { return packetValue(p.Dtype, p.Data) }
+
+// Value returns the property value as Value.
+func (p EpPropReportPacket) Value() Value { return packetValue(p.Dtype, p.Data) }
+
+// Value returns the property value as Value.
+func (p EpPropWritePacket) Value() Value { return packetValue(p.Dtype, p.Data) }
+
+// absolute value and sign of an integer or of a float without fraction
+func integer(data interface{}) (u uint64, neg bool, ok bool) {
+	switch d := data.(type) {
+	case int:
+		return signed(int64(d))
+	case int8:
+		return signed(int64(d))
+	case int16:
+		return signed(int64(d))
+	case int32:
+		return signed(int64(d))
+	case int64:
+		return signed(d)
+	case uint:
+		return uint64(d), false, true
+	case uint8:
+		return uint64(d), false, true
+	case uint16:
+		return uint64(d), false, true
+	case uint32:
+		return uint64(d), false, true
+	case uint64:
+		return d, false, true
+	case float32:
+		return integral(float64(d))
+	case float64:
+		return integral(d)
+	}
+	return 0, false, false
+}
+
+// absolute value and sign of a signed integer
+func signed(i int64) (uint64, bool, bool) {
+	if i < 0 {
+		return uint64(-(i + 1)) + 1, true, true
+	}
+	return uint64(i), false, true
+}
+
+// absolute value and sign of a float without fraction
+func integral(f float64) (uint64, bool, bool) {
+	if f != math.Trunc(f) || math.Abs(f) >= 1<<64 {
+		return 0, false, false
+	}
+	if f < 0 {
+		return uint64(-f), true, true
+	}
+	return uint64(f), false, true
+}
+
+// reports if the integer u, negative if neg, equals f
+func exact(u uint64, neg bool, f float64) bool {
+	if neg {
+		f = -f
+	}
+	return f >= 0 && f < 1<<64 && uint64(f) == u
+}
+
+// float value of an integer or float
+func float(data interface{}) (float64, bool) {
+	switch d := data.(type) {
+	case float32:
+		return float64(d), true
+	case float64:
+		return d, true
+	}
+	u, neg, ok := integer(data)
+	if neg {
+		return -float64(u), ok
+	}
+	return float64(u), ok
+}
@@ -0,0 +1,133 @@
+package hexabus
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func Test_NewValue(t *testing.T) {
+	valid := []struct {
+		dtype    byte
+		data     interface{}
+		expected interface{}
+	}{
+		{DTYPE_UINT32, uint8(5), uint32(5)},
+		{DTYPE_UINT8, 255, uint8(255)},
+		{DTYPE_INT8, -128, int8(-128)},
+		{DTYPE_INT64, int64(-9223372036854775808), int64(-9223372036854775808)},
+		{DTYPE_UINT64, uint64(18446744073709551615), uint64(18446744073709551615)},
+		{DTYPE_UINT16, float64(1000), uint16(1000)},
+		{DTYPE_FLOAT, 3, float32(3)},
+		{DTYPE_DOUBLE, float32(0.5), float64(0.5)},
+		{DTYPE_FLOAT, uint32(16777216), float32(16777216)},
+		{DTYPE_DOUBLE, int64(-1 << 63), float64(-1 << 63)},
+		{DTYPE_TIMESTAMP, 60, Timestamp{60}},
+		{DTYPE_UINT32, Timestamp{60}, uint32(60)},
+		{DTYPE_BOOL, true, true},
+		{DTYPE_128STRING, "Main Switch", "Main Switch"},
+		{DTYPE_UINT32, Value{DTYPE_UINT8, uint8(7)}, uint32(7)},
+	}
+	for _, v := range valid {
+		value, err := NewValue(v.dtype, v.data)
+		if err != nil || value.Dtype != v.dtype || value.Data != v.expected {
+			t.Errorf("NewValue(%s, %#v) returned %#v, %v, expected %#v", DtypeName(v.dtype), v.data, value, err, v.expected)
+		}
+	}
+
+	invalid := []struct {
+		dtype byte
+		data  interface{}
+		err   error
+	}{
+		{DTYPE_UINT8, 256, Error(ERR_VALUERANGE)},
+		{DTYPE_UINT32, -1, Error(ERR_VALUERANGE)},
+		{DTYPE_INT8, 128, Error(ERR_VALUERANGE)},
+		{DTYPE_INT16, -32769, Error(ERR_VALUERANGE)},
+		{DTYPE_FLOAT, float64(1e39), Error(ERR_VALUERANGE)},
+		{DTYPE_FLOAT, uint32(16777217), Error(ERR_VALUERANGE)},
+		{DTYPE_DOUBLE, uint64(1<<53 + 1), Error(ERR_VALUERANGE)},
+		{DTYPE_DOUBLE, uint64(18446744073709551615), Error(ERR_VALUERANGE)},
+		{DTYPE_UINT8, 1.5, Error(HXB_ERR_DATATYPE)},
+		{DTYPE_UINT32, "5", Error(HXB_ERR_DATATYPE)},
+		{DTYPE_BOOL, 1, Error(HXB_ERR_DATATYPE)},
+		{DTYPE_16BYTES, make_byte_slice(15), Error(ERR_BYTESIZE)},
+		{DTYPE_UNDEFINED, 1, Error(ERR_HXBDTYPE)},
+	}
+	for _, v := range invalid {
+		_, err := NewValue(v.dtype, v.data)
+		if err != v.err {
+			t.Errorf("NewValue(%s, %#v) returned %v, expected %v", DtypeName(v.dtype), v.data, err, v.err)
+		}
+	}
+}
+
+func Test_ParseValue(t *testing.T) {
+	valid := map[string]Value{
+		"on":         {DTYPE_BOOL, true},
+		"0x10":       {DTYPE_UINT8, uint8(16)},
+		"-40":        {DTYPE_INT16, int16(-40)},
+		"4294967295": {DTYPE_UINT32, uint32(4294967295)},
+		"21.5":       {DTYPE_FLOAT, float32(21.5)},
+		"Kitchen":    {DTYPE_128STRING, "Kitchen"},
+	}
+	for s, expected := range valid {
+		v, err := ParseValue(expected.Dtype, s)
+		if err != nil || v != expected {
+			t.Errorf("ParseValue(%s, %q) returned %#v, %v", DtypeName(expected.Dtype), s, v, err)
+		}
+		if v.String() != s && s != "on" && s != "0x10" {
+			t.Errorf("String of %#v returned %q, expected %q", v, v.String(), s)
+		}
+	}
+
+	_, err := ParseValue(DTYPE_UINT8, "300")
+	if err != Error(ERR_VALUERANGE) {
+		t.Errorf("ParseValue of out of range value returned %v", err)
+	}
+	_, err = ParseValue(DTYPE_BOOL, "maybe")
+	if err == nil {
+		t.Errorf("ParseValue of invalid bool returned no error")
+	}
+}
+
+func Test_ValuePacket(t *testing.T) {
+	// the data type of the packet wins over the Go type of the data
+	packet, err := InfoPacket{FLAG_NONE, 2, DTYPE_UINT32, uint8(5)}.Bytes()
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	p, err := Decode(packet)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if *p.(*InfoPacket) != (InfoPacket{FLAG_NONE, 2, DTYPE_UINT32, uint32(5)}) {
+		t.Errorf("InfoPacket with uint8 for UInt32 decoded as %+v", p)
+	}
+	if p.(*InfoPacket).Value() != (Value{DTYPE_UINT32, uint32(5)}) {
+		t.Errorf("Value of InfoPacket returned %#v", p.(*InfoPacket).Value())
+	}
+
+	_, err = InfoPacket{FLAG_NONE, 2, DTYPE_UINT8, uint32(300)}.Bytes()
+	if err != Error(ERR_VALUERANGE) {
+		t.Errorf("InfoPacket with out of range value returned %v", err)
+	}
+
+	packet, err = WritePacket{FLAG_NONE, 1, DTYPE_UNDEFINED, Value{DTYPE_INT32, -7}}.Bytes()
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	p, err = Decode(packet)
+	if err != nil || *p.(*WritePacket) != (WritePacket{FLAG_NONE, 1, DTYPE_INT32, int32(-7)}) {
+		t.Errorf("WritePacket with Value decoded as %+v, %v", p, err)
+	}
+
+	b, err := json.Marshal(Value{DTYPE_UINT16, 443})
+	if err != nil || string(b) != `{"datatype":"UInt16","value":443}` {
+		t.Errorf("Marshal of Value returned %s, %v", b, err)
+	}
+	var v Value
+	err = json.Unmarshal(b, &v)
+	if err != nil || v != (Value{DTYPE_UINT16, uint16(443)}) {
+		t.Errorf("Unmarshal of Value returned %#v, %v", v, err)
+	}
+}